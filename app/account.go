@@ -3,14 +3,10 @@ package retrogit
 import (
 	"bytes"
 	"encoding/gob"
-	"errors"
+	"fmt"
 	"time"
 
-	"appengine"
-	"appengine/datastore"
-
 	"code.google.com/p/goauth2/oauth"
-	"github.com/google/go-github/github"
 )
 
 type Account struct {
@@ -18,20 +14,69 @@ type Account struct {
 	// The datastore API doesn't store maps, and the token contains one. We
 	// thefore store a gob-serialized version instead.
 	OAuthTokenSerialized []byte
-	OAuthToken           oauth.Token    `datastore:"-,"`
+	OAuthToken           oauth.Token    `datastore:"-," json:"-"`
 	TimezoneName         string         `datastore:",noindex"`
-	TimezoneLocation     *time.Location `datastore:"-,"`
-	HasTimezoneSet       bool           `datastore:"-,"`
+	TimezoneLocation     *time.Location `datastore:"-," json:"-"`
+	HasTimezoneSet       bool           `datastore:"-," json:"-"`
 	ExcludedRepoIds      []int          `datastore:",noindex"`
 	DigestEmailAddress   string
 	Frequency            string
 	WeeklyDay            time.Weekday
+	// Day of the month (1-31) that monthly digests are sent on. In months that
+	// don't have that day, they're sent on the last day instead.
+	MonthlyDay int
+	// Hour of the day (in the account's timezone) that digests are sent at.
+	// Accounts that were created before it could be chosen don't have it set,
+	// and get DefaultDeliveryHour.
+	DeliveryHour    int
+	HasDeliveryHour bool
+	// Kinds of activity (besides commits) that are included in digests.
+	IncludePullRequests bool
+	IncludeIssues       bool
+	IncludeReviews      bool
+	// Digests are always sent with a plain text part; this omits the HTML one.
+	TextOnlyEmail bool
+	// Incoming webhooks that digests are also posted to (see
+	// DeliveryChannels).
+	SlackWebhookURL string `datastore:",noindex"`
+	TeamsWebhookURL string `datastore:",noindex"`
+	// Generic webhook that the digest is posted to as JSON, signed with
+	// WebhookSecret (see WebhookChannel).
+	WebhookURL    string `datastore:",noindex"`
+	WebhookSecret string `datastore:",noindex"`
+	// Secret that's part of the digest feed's URL (see FeedURL). Empty if the
+	// feed is turned off.
+	FeedToken string `datastore:",noindex"`
+	// Other GitHub users whose repositories and commits are included in the
+	// account's digests (see LinkedIdentity). Serialized for the same reason
+	// as OAuthToken.
+	LinkedIdentitiesSerialized []byte           `datastore:",noindex"`
+	LinkedIdentities           []LinkedIdentity `datastore:"-," json:"-"`
+	// GitLab instance and personal access token that repositories and commits
+	// are also read from (see GitLabProvider). GitLab isn't used if there's no
+	// token.
+	GitLabURL   string `datastore:",noindex"`
+	GitLabToken string `datastore:",noindex"`
+	// ID of the token's GitLab user (0 for tokens saved before it was
+	// recorded), to tell when the token is for someone else.
+	GitLabUserId int `datastore:",noindex"`
+	// Path globs of repositories on the server (see LocalGitProvider), and the
+	// author emails of the user's commits in them.
+	LocalRepositoryGlobs []string `datastore:",noindex"`
+	LocalAuthorEmails    []string `datastore:",noindex"`
+	// Other emails and names that the user's commits may be authored (or
+	// co-authored) as, e.g. from before they were added to their GitHub
+	// account (see AuthorMatcher).
+	AuthorAliases []string `datastore:",noindex"`
+	// How long sent digests are kept in the history, in days (see
+	// DigestArchiveForever). Accounts that were created before it could be
+	// chosen get DefaultDigestArchiveDays.
+	DigestArchiveDays    int  `datastore:",noindex"`
+	HasDigestArchiveDays bool `datastore:",noindex"`
 }
 
-func getAccount(c appengine.Context, githubUserId int) (*Account, error) {
-	key := datastore.NewKey(c, "Account", "", int64(githubUserId), nil)
-	account := new(Account)
-	err := datastore.Get(c, key, account)
+func getAccount(c Context, githubUserId int) (*Account, error) {
+	account, err := storage.GetAccount(c, githubUserId)
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +94,19 @@ func initAccount(account *Account) error {
 	if err != nil {
 		return err
 	}
+	if len(account.LinkedIdentitiesSerialized) > 0 {
+		r = bytes.NewBuffer(account.LinkedIdentitiesSerialized)
+		err = gob.NewDecoder(r).Decode(&account.LinkedIdentities)
+		if err != nil {
+			return err
+		}
+	}
+	return initAccountSettings(account)
+}
+
+// initAccountSettings fills in the defaults of settings that the account
+// hasn't chosen.
+func initAccountSettings(account *Account) (err error) {
 	account.HasTimezoneSet = len(account.TimezoneName) > 0
 	if !account.HasTimezoneSet {
 		account.TimezoneName = "America/Los_Angeles"
@@ -56,6 +114,15 @@ func initAccount(account *Account) error {
 	if len(account.Frequency) == 0 {
 		account.Frequency = "daily"
 	}
+	if account.MonthlyDay == 0 {
+		account.MonthlyDay = 1
+	}
+	if !account.HasDeliveryHour {
+		account.DeliveryHour = DefaultDeliveryHour
+	}
+	if !account.HasDigestArchiveDays {
+		account.DigestArchiveDays = DefaultDigestArchiveDays
+	}
 	account.TimezoneLocation, err = time.LoadLocation(account.TimezoneName)
 	if err != nil {
 		return err
@@ -63,10 +130,8 @@ func initAccount(account *Account) error {
 	return nil
 }
 
-func getAllAccounts(c appengine.Context) ([]Account, error) {
-	q := datastore.NewQuery("Account")
-	var accounts []Account
-	_, err := q.GetAll(c, &accounts)
+func getAllAccounts(c Context) ([]Account, error) {
+	accounts, err := storage.GetAllAccounts(c)
 	if err != nil {
 		return nil, err
 	}
@@ -88,29 +153,72 @@ func (account *Account) IsRepoIdExcluded(repoId int) bool {
 	return false
 }
 
-func (account *Account) Put(c appengine.Context) error {
+func (account *Account) Schedule() *DigestSchedule {
+	return &DigestSchedule{
+		Frequency:    account.Frequency,
+		WeeklyDay:    account.WeeklyDay,
+		MonthlyDay:   account.MonthlyDay,
+		DeliveryHour: account.DeliveryHour,
+		Location:     account.TimezoneLocation,
+	}
+}
+
+func (account *Account) Put(c Context) error {
 	w := new(bytes.Buffer)
 	err := gob.NewEncoder(w).Encode(&account.OAuthToken)
 	if err != nil {
 		return err
 	}
 	account.OAuthTokenSerialized = w.Bytes()
-	key := datastore.NewKey(c, "Account", "", int64(account.GitHubUserId), nil)
-	_, err = datastore.Put(c, key, account)
-	return err
+	account.LinkedIdentitiesSerialized = nil
+	if len(account.LinkedIdentities) > 0 {
+		w = new(bytes.Buffer)
+		err = gob.NewEncoder(w).Encode(&account.LinkedIdentities)
+		if err != nil {
+			return err
+		}
+		account.LinkedIdentitiesSerialized = w.Bytes()
+	}
+	return storage.PutAccount(c, account)
 }
 
-func (account *Account) Delete(c appengine.Context) error {
-	key := datastore.NewKey(c, "Account", "", int64(account.GitHubUserId), nil)
-	err := datastore.Delete(c, key)
-	return err
+func (account *Account) Delete(c Context) error {
+	// Team subscriptions can't be sent without the owner's OAuth token, so
+	// they go away with the account.
+	subscriptions, err := storage.GetTeamSubscriptionsForOwner(c, account.GitHubUserId)
+	if err != nil {
+		return err
+	}
+	for i := range subscriptions {
+		err = storage.DeleteTeamSubscription(c, subscriptions[i].Id)
+		if err != nil {
+			return err
+		}
+	}
+	err = storage.DeleteCommitIndex(c, account.GitHubUserId)
+	if err != nil {
+		return err
+	}
+	err = storage.DeleteWebhookDeliveries(c, account.GitHubUserId)
+	if err != nil {
+		return err
+	}
+	err = storage.DeleteAPITokens(c, account.GitHubUserId)
+	if err != nil {
+		return err
+	}
+	err = storage.DeleteArchivedDigests(c, account.GitHubUserId, time.Now())
+	if err != nil {
+		return err
+	}
+	return storage.DeleteAccount(c, account.GitHubUserId)
 }
 
-func (account *Account) GetDigestEmailAddress(githubClient *github.Client) (string, error) {
+func (account *Account) GetDigestEmailAddress(provider Provider) (string, error) {
 	if len(account.DigestEmailAddress) > 0 {
 		return account.DigestEmailAddress, nil
 	}
-	emails, _, err := githubClient.Users.ListEmails(nil)
+	emails, err := provider.GetEmails()
 	if err != nil {
 		return "", err
 	}
@@ -131,5 +239,5 @@ func (account *Account) GetDigestEmailAddress(githubClient *github.Client) (stri
 	for _, email := range emails {
 		return *email.Email, nil
 	}
-	return "", errors.New("No email addresses found in GitHub account")
+	return "", fmt.Errorf("No email addresses found in %s account", provider.Name())
 }
@@ -5,8 +5,6 @@ import (
 	"sort"
 	"strconv"
 
-	"appengine"
-
 	"github.com/google/go-github/github"
 )
 
@@ -26,7 +24,7 @@ func (a AdminUserDataByGitHubUserId) Less(i, j int) bool {
 }
 
 func usersAdminHandler(w http.ResponseWriter, r *http.Request) *AppError {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	accounts, err := getAllAccounts(c)
 	if err != nil {
 		return InternalError(err, "Could not look up accounts")
@@ -37,11 +35,11 @@ func usersAdminHandler(w http.ResponseWriter, r *http.Request) *AppError {
 		go func(account *Account) {
 			oauthTransport := githubOAuthTransport(c)
 			oauthTransport.Token = &account.OAuthToken
-			githubClient := github.NewClient(oauthTransport.Client())
+			githubClient := newGitHubClient(oauthTransport.Client())
 
 			user, _, err := githubClient.Users.Get("")
 
-			emailAddress, err := account.GetDigestEmailAddress(githubClient)
+			emailAddress, err := account.GetDigestEmailAddress(newGitHubProvider(githubClient, nil))
 			if err != nil {
 				emailAddress = err.Error()
 			}
@@ -74,7 +72,7 @@ func digestAdminHandler(w http.ResponseWriter, r *http.Request) *AppError {
 	if err != nil {
 		return BadRequest(err, "Malformed user_id value")
 	}
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	account, err := getAccount(c, userId)
 	if account == nil {
 		return BadRequest(err, "user_id does not point to an account")
@@ -85,7 +83,7 @@ func digestAdminHandler(w http.ResponseWriter, r *http.Request) *AppError {
 
 	oauthTransport := githubOAuthTransport(c)
 	oauthTransport.Token = &account.OAuthToken
-	githubClient := github.NewClient(oauthTransport.Client())
+	githubClient := newGitHubClient(oauthTransport.Client())
 
 	digest, err := newDigest(c, githubClient, account)
 	if err != nil {
@@ -103,7 +101,7 @@ func reposAdminHandler(w http.ResponseWriter, r *http.Request) *AppError {
 	if err != nil {
 		return BadRequest(err, "Malformed user_id value")
 	}
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	account, err := getAccount(c, userId)
 	if account == nil {
 		return BadRequest(err, "user_id does not point to an account")
@@ -114,7 +112,7 @@ func reposAdminHandler(w http.ResponseWriter, r *http.Request) *AppError {
 
 	oauthTransport := githubOAuthTransport(c)
 	oauthTransport.Token = &account.OAuthToken
-	githubClient := github.NewClient(oauthTransport.Client())
+	githubClient := newGitHubClient(oauthTransport.Client())
 
 	user, _, err := githubClient.Users.Get("")
 	repos, reposErr := getRepos(c, githubClient, account, user)
@@ -135,7 +133,7 @@ func deleteAccountAdminHandler(w http.ResponseWriter, r *http.Request) *AppError
 	if err != nil {
 		return BadRequest(err, "Malformed user_id value")
 	}
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	account, err := getAccount(c, userId)
 	if account == nil {
 		return BadRequest(err, "user_id does not point to an account")
@@ -147,3 +145,16 @@ func deleteAccountAdminHandler(w http.ResponseWriter, r *http.Request) *AppError
 	account.Delete(c)
 	return RedirectToRoute("users-admin")
 }
+
+func cacheAdminHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	var data = map[string]interface{}{
+		"Backend": githubConfig.Cache.Backend,
+		"Metrics": responseCacheMetrics.Snapshot(),
+	}
+	if sizedCache, ok := responseCache.(SizedResponseCache); ok {
+		entries, bytes := sizedCache.Size()
+		data["Entries"] = entries
+		data["Bytes"] = bytes
+	}
+	return templates["cache-admin"].Render(w, data)
+}
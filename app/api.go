@@ -0,0 +1,425 @@
+package retrogit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	// Makes tokens recognizable (e.g. by secret scanners).
+	APITokenPrefix = "rgp_"
+	// LastUsedTime is only updated this often, to avoid a write per request.
+	APITokenLastUsedGranularity = time.Hour
+	maxAPIRequestBytes          = 1 << 20
+)
+
+// APIToken is a personal token that authenticates /api/v1 requests as the
+// user that created it. Only a hash of the token is stored, so it's only
+// shown once, when created.
+type APIToken struct {
+	// Hex-encoded SHA-256 of the token.
+	Hash         string `datastore:"-"`
+	GitHubUserId int
+	Name         string    `datastore:",noindex"`
+	CreationTime time.Time `datastore:",noindex"`
+	LastUsedTime time.Time `datastore:",noindex"`
+}
+
+func (token *APIToken) DisplayCreationTime(location *time.Location) string {
+	return token.CreationTime.In(location).Format(DigestDisplayDateFormat)
+}
+
+func (token *APIToken) DisplayLastUsedTime(location *time.Location) string {
+	if token.LastUsedTime.IsZero() {
+		return "Never"
+	}
+	return token.LastUsedTime.In(location).Format(DigestDisplayDateFormat)
+}
+
+// sort.Interface implementation for sorting APITokens, oldest first.
+type ByCreationTime []APIToken
+
+func (a ByCreationTime) Len() int           { return len(a) }
+func (a ByCreationTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByCreationTime) Less(i, j int) bool { return a[i].CreationTime.Before(a[j].CreationTime) }
+
+// newAPIToken returns a new token value and the APIToken that stores it.
+func newAPIToken(githubUserId int, name string) (string, *APIToken, error) {
+	randomPart, err := randomHex(20)
+	if err != nil {
+		return "", nil, err
+	}
+	value := APITokenPrefix + randomPart
+	return value, &APIToken{
+		Hash:         hashAPIToken(value),
+		GitHubUserId: githubUserId,
+		Name:         name,
+		CreationTime: time.Now(),
+	}, nil
+}
+
+func hashAPIToken(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+func getAPITokens(c Context, githubUserId int) ([]APIToken, error) {
+	tokens, err := storage.GetAPITokens(c, githubUserId)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(ByCreationTime(tokens))
+	return tokens, nil
+}
+
+type APIState struct {
+	Account      *Account
+	GitHubClient *github.Client
+	Token        *APIToken
+}
+
+// APIHandler is the /api/v1 equivalent of SignedInAppHandler. Requests are
+// authenticated with an API token in the Authorization header (either as
+// "token <value>" or "Bearer <value>"), and errors are returned as JSON.
+type APIHandler func(http.ResponseWriter, *http.Request, *APIState) *AppError
+
+func (fn APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if panicData := recover(); panicData != nil {
+			handleAPIError(Panic(panicData), w, r)
+		}
+	}()
+	makeUncacheable(w)
+	c := newContext(r)
+	token, err := authenticateAPIRequest(c, r)
+	if err != nil {
+		handleAPIError(APIUnauthorized(err), w, r)
+		return
+	}
+	account, err := getAccount(c, token.GitHubUserId)
+	if err != nil {
+		handleAPIError(APIUnauthorized(err), w, r)
+		return
+	}
+	if time.Since(token.LastUsedTime) > APITokenLastUsedGranularity {
+		token.LastUsedTime = time.Now()
+		err = storage.PutAPIToken(c, token)
+		if err != nil {
+			c.Warningf("Could not update API token last used time: %s", err.Error())
+		}
+	}
+
+	oauthTransport := githubOAuthTransport(c)
+	oauthTransport.Token = &account.OAuthToken
+	githubClient := newGitHubClient(oauthTransport.Client())
+
+	state := &APIState{
+		Account:      account,
+		GitHubClient: githubClient,
+		Token:        token,
+	}
+	if e := fn(w, r, state); e != nil {
+		handleAPIError(e, w, r)
+	}
+}
+
+func authenticateAPIRequest(c Context, r *http.Request) (*APIToken, error) {
+	authorization := strings.Fields(r.Header.Get("Authorization"))
+	if len(authorization) != 2 ||
+		(!strings.EqualFold(authorization[0], "token") && !strings.EqualFold(authorization[0], "bearer")) {
+		return nil, errors.New("Missing API token")
+	}
+	value := authorization[1]
+	if !strings.HasPrefix(value, APITokenPrefix) {
+		return nil, errors.New("Malformed API token")
+	}
+	token, err := storage.GetAPIToken(c, hashAPIToken(value))
+	if err == ErrAPITokenNotFound {
+		return nil, errors.New("Unknown or revoked API token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func APIUnauthorized(err error) *AppError {
+	return &AppError{
+		Error:   err,
+		Message: err.Error(),
+		Code:    http.StatusUnauthorized,
+		Type:    AppErrorTypeBadInput,
+	}
+}
+
+// handleAPIError is the JSON equivalent of handleAppError.
+func handleAPIError(e *AppError, w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	code := e.Code
+	message := e.Message
+	if e.Type == AppErrorTypeGitHubFetch {
+		if gitHubError, ok := (e.Error).(*github.ErrorResponse); ok {
+			gitHubStatus := gitHubError.Response.StatusCode
+			if gitHubStatus == http.StatusUnauthorized ||
+				gitHubStatus == http.StatusForbidden {
+				// The API token is fine, it's the account's GitHub
+				// authorization that needs to be renewed.
+				code = http.StatusForbidden
+				message = "GitHub authorization failed, sign in to RetroGit again to renew it"
+			}
+		}
+	}
+	if e.Type == AppErrorTypeBadInput {
+		c.Infof("%v", e.Error)
+	} else {
+		c.Errorf("%v", e.Error)
+		if !isDevelopment() {
+			sendAppErrorMail(e, r)
+		}
+		if e.Error != nil && isDevelopment() {
+			message = fmt.Sprintf("%s: %s", message, e.Error.Error())
+		}
+	}
+	writeAPIResponse(w, code, map[string]string{"message": message})
+}
+
+func writeAPIResponse(w http.ResponseWriter, code int, value interface{}) *AppError {
+	responseBytes, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return InternalError(err, "Could not serialize response")
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(responseBytes)
+	w.Write([]byte("\n"))
+	return nil
+}
+
+// apiDigestHandler returns the digest for the date and frequency in the
+// optional "date" and "frequency" parameters (see parseDigestParameters).
+func apiDigestHandler(w http.ResponseWriter, r *http.Request, state *APIState) *AppError {
+	c := newContext(r)
+	date, frequency, appErr := parseDigestParameters(r, state.Account)
+	if appErr != nil {
+		return appErr
+	}
+	digest, err := newDigestForDate(c, state.GitHubClient, state.Account, date, frequency)
+	if err == ErrDigestDateTooEarly {
+		return BadRequest(err, "Date is before your oldest repository")
+	}
+	if err != nil {
+		return GitHubFetchError(err, "digest")
+	}
+	return writeAPIResponse(w, http.StatusOK, newDigestJSON(digest))
+}
+
+type RepoJSON struct {
+	Id              int       `json:"id"`
+	FullName        string    `json:"full_name"`
+	URL             string    `json:"html_url"`
+	Private         bool      `json:"private"`
+	Fork            bool      `json:"fork"`
+	Vintage         time.Time `json:"vintage"`
+	IncludeInDigest bool      `json:"include_in_digest"`
+}
+
+func apiReposHandler(w http.ResponseWriter, r *http.Request, state *APIState) *AppError {
+	c := newContext(r)
+	user, _, err := state.GitHubClient.Users.Get("")
+	if err != nil {
+		return GitHubFetchError(err, "user")
+	}
+	repos, err := getRepos(c, state.GitHubClient, state.Account, user)
+	if err != nil {
+		return GitHubFetchError(err, "repositories")
+	}
+	reposJSON := make([]RepoJSON, len(repos.AllRepos))
+	for i, repo := range repos.AllRepos {
+		reposJSON[i] = RepoJSON{
+			Id:              *repo.ID,
+			FullName:        *repo.FullName,
+			URL:             *repo.HTMLURL,
+			Private:         repo.Private != nil && *repo.Private,
+			Fork:            repo.Fork != nil && *repo.Fork,
+			Vintage:         repo.Vintage,
+			IncludeInDigest: repo.IncludeInDigest,
+		}
+	}
+	return writeAPIResponse(w, http.StatusOK, reposJSON)
+}
+
+// SettingsJSON mirrors the settings page. All fields are returned by GET
+// requests, and PUT requests only change the fields that they include.
+type SettingsJSON struct {
+	Frequency           *string `json:"frequency"`
+	WeeklyDay           *int    `json:"weekly_day"`
+	MonthlyDay          *int    `json:"monthly_day"`
+	DeliveryHour        *int    `json:"delivery_hour"`
+	TimezoneName        *string `json:"timezone_name"`
+	IncludePullRequests *bool   `json:"include_pull_requests"`
+	IncludeIssues       *bool   `json:"include_issues"`
+	IncludeReviews      *bool   `json:"include_reviews"`
+	// A verified address from the user's GitHub account, or "disabled".
+	EmailAddress    *string `json:"email_address"`
+	TextOnlyEmail   *bool   `json:"text_only_email"`
+	SlackWebhookURL *string `json:"slack_webhook_url"`
+	TeamsWebhookURL *string `json:"teams_webhook_url"`
+	WebhookURL      *string `json:"webhook_url"`
+	ExcludedRepoIds *[]int  `json:"excluded_repo_ids"`
+}
+
+func newSettingsJSON(account *Account, emailAddress string) *SettingsJSON {
+	weeklyDay := int(account.WeeklyDay)
+	excludedRepoIds := account.ExcludedRepoIds
+	if excludedRepoIds == nil {
+		excludedRepoIds = make([]int, 0)
+	}
+	return &SettingsJSON{
+		Frequency:           &account.Frequency,
+		WeeklyDay:           &weeklyDay,
+		MonthlyDay:          &account.MonthlyDay,
+		DeliveryHour:        &account.DeliveryHour,
+		TimezoneName:        &account.TimezoneName,
+		IncludePullRequests: &account.IncludePullRequests,
+		IncludeIssues:       &account.IncludeIssues,
+		IncludeReviews:      &account.IncludeReviews,
+		EmailAddress:        &emailAddress,
+		TextOnlyEmail:       &account.TextOnlyEmail,
+		SlackWebhookURL:     &account.SlackWebhookURL,
+		TeamsWebhookURL:     &account.TeamsWebhookURL,
+		WebhookURL:          &account.WebhookURL,
+		ExcludedRepoIds:     &excludedRepoIds,
+	}
+}
+
+func apiSettingsHandler(w http.ResponseWriter, r *http.Request, state *APIState) *AppError {
+	emailAddress, err := state.Account.GetDigestEmailAddress(newGitHubProvider(state.GitHubClient, nil))
+	if err != nil {
+		return GitHubFetchError(err, "emails")
+	}
+	return writeAPIResponse(w, http.StatusOK, newSettingsJSON(state.Account, emailAddress))
+}
+
+func apiSaveSettingsHandler(w http.ResponseWriter, r *http.Request, state *APIState) *AppError {
+	c := newContext(r)
+	account := state.Account
+	var settings SettingsJSON
+	err := json.NewDecoder(io.LimitReader(r.Body, maxAPIRequestBytes)).Decode(&settings)
+	if err != nil {
+		return BadRequest(err, "Malformed settings JSON")
+	}
+
+	if settings.Frequency != nil {
+		if *settings.Frequency != "daily" && *settings.Frequency != "weekly" && *settings.Frequency != "monthly" {
+			return BadRequest(nil, "Malformed frequency value")
+		}
+		account.Frequency = *settings.Frequency
+	}
+	if settings.WeeklyDay != nil {
+		if *settings.WeeklyDay < 0 || *settings.WeeklyDay > 6 {
+			return BadRequest(nil, "Malformed weekly_day value")
+		}
+		account.WeeklyDay = time.Weekday(*settings.WeeklyDay)
+	}
+	if settings.MonthlyDay != nil {
+		if *settings.MonthlyDay < 1 || *settings.MonthlyDay > 31 {
+			return BadRequest(nil, "Malformed monthly_day value")
+		}
+		account.MonthlyDay = *settings.MonthlyDay
+	}
+	if settings.DeliveryHour != nil {
+		if *settings.DeliveryHour < 0 || *settings.DeliveryHour > 23 {
+			return BadRequest(nil, "Malformed delivery_hour value")
+		}
+		account.DeliveryHour = *settings.DeliveryHour
+		account.HasDeliveryHour = true
+	}
+	if settings.TimezoneName != nil {
+		account.TimezoneLocation, err = time.LoadLocation(*settings.TimezoneName)
+		if err != nil {
+			return BadRequest(err, "Malformed timezone_name value")
+		}
+		account.TimezoneName = account.TimezoneLocation.String()
+	}
+	if settings.IncludePullRequests != nil {
+		account.IncludePullRequests = *settings.IncludePullRequests
+	}
+	if settings.IncludeIssues != nil {
+		account.IncludeIssues = *settings.IncludeIssues
+	}
+	if settings.IncludeReviews != nil {
+		account.IncludeReviews = *settings.IncludeReviews
+	}
+	if settings.EmailAddress != nil {
+		appErr := validateEmailAddress(state.GitHubClient, *settings.EmailAddress)
+		if appErr != nil {
+			return appErr
+		}
+		account.DigestEmailAddress = *settings.EmailAddress
+	}
+	if settings.TextOnlyEmail != nil {
+		account.TextOnlyEmail = *settings.TextOnlyEmail
+	}
+	for _, webhookSetting := range []struct {
+		value   *string
+		account *string
+	}{
+		{settings.SlackWebhookURL, &account.SlackWebhookURL},
+		{settings.TeamsWebhookURL, &account.TeamsWebhookURL},
+		{settings.WebhookURL, &account.WebhookURL},
+	} {
+		if webhookSetting.value == nil {
+			continue
+		}
+		webhookURL := strings.TrimSpace(*webhookSetting.value)
+		err := validateWebhookURL(webhookURL)
+		if err != nil {
+			return BadRequest(err, "Malformed webhook URL")
+		}
+		*webhookSetting.account = webhookURL
+	}
+	if account.WebhookURL != "" && account.WebhookSecret == "" {
+		account.WebhookSecret, err = newWebhookSecret()
+		if err != nil {
+			return InternalError(err, "Could not generate webhook secret")
+		}
+	}
+	if settings.ExcludedRepoIds != nil {
+		account.ExcludedRepoIds = *settings.ExcludedRepoIds
+	}
+
+	err = account.Put(c)
+	if err != nil {
+		return InternalError(err, "Could not save user")
+	}
+	return apiSettingsHandler(w, r, state)
+}
+
+// validateEmailAddress checks that digests can be sent to emailAddress, i.e.
+// that it's "disabled" or one of the user's addresses on GitHub (the same
+// choices as on the settings page).
+func validateEmailAddress(githubClient *github.Client, emailAddress string) *AppError {
+	if emailAddress == "disabled" {
+		return nil
+	}
+	emails, _, err := githubClient.Users.ListEmails(nil)
+	if err != nil {
+		return GitHubFetchError(err, "emails")
+	}
+	for _, email := range emails {
+		if *email.Email == emailAddress {
+			return nil
+		}
+	}
+	return BadRequest(nil, fmt.Sprintf("%s is not one of your GitHub email addresses", emailAddress))
+}
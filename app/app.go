@@ -10,9 +10,7 @@ import (
 	"net/http"
 	"path/filepath"
 	"strings"
-
-	"appengine"
-	"appengine/mail"
+	texttemplate "text/template"
 
 	"github.com/google/go-github/github"
 	"github.com/gorilla/sessions"
@@ -153,7 +151,7 @@ func (fn SignedInAppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		handleAppError(NotSignedIn(r), w, r)
 		return
 	}
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	account, err := getAccount(c, userId)
 	if account == nil || err != nil {
 		handleAppError(NotSignedIn(r), w, r)
@@ -162,7 +160,7 @@ func (fn SignedInAppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	oauthTransport := githubOAuthTransport(c)
 	oauthTransport.Token = &account.OAuthToken
-	githubClient := github.NewClient(oauthTransport.Client())
+	githubClient := newGitHubClient(oauthTransport.Client())
 
 	state := &AppSignedInState{
 		Account:        account,
@@ -190,7 +188,7 @@ func makeUncacheable(w http.ResponseWriter) {
 }
 
 func handleAppError(e *AppError, w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	if e.Type == AppErrorTypeGitHubFetch {
 		if gitHubError, ok := (e.Error).(*github.ErrorResponse); ok {
 			gitHubStatus := gitHubError.Response.StatusCode
@@ -216,11 +214,11 @@ func handleAppError(e *AppError, w http.ResponseWriter, r *http.Request) {
 	}
 	if e.Type != AppErrorTypeBadInput {
 		c.Errorf("%v", e.Error)
-		if !appengine.IsDevAppServer() {
+		if !isDevelopment() {
 			sendAppErrorMail(e, r)
 		}
 		var data = map[string]interface{}{
-			"ShowDetails": appengine.IsDevAppServer(),
+			"ShowDetails": isDevelopment(),
 			"Error":       e,
 		}
 		w.WriteHeader(e.Code)
@@ -236,12 +234,15 @@ func handleAppError(e *AppError, w http.ResponseWriter, r *http.Request) {
 }
 
 func sendAppErrorMail(e *AppError, r *http.Request) {
+	if len(mailConfig.AdminRecipients) == 0 {
+		return
+	}
 	session, _ := sessionStore.Get(r, sessionConfig.CookieName)
 	userId, _ := session.Values[sessionConfig.UserIdKey].(int)
 
-	errorMessage := &mail.Message{
-		Sender:  "RetroGit Admin <digests@retrogit.com>",
-		To:      []string{"mihai.parparita@gmail.com"},
+	errorMessage := &MailMessage{
+		Sender:  mailConfig.AdminSender,
+		To:      mailConfig.AdminRecipients,
 		Subject: fmt.Sprintf("RetroGit Internal Error on %s", r.URL),
 		Body: fmt.Sprintf(`Request URL: %s
 HTTP status code: %d
@@ -257,8 +258,8 @@ Error: %s`,
 			e.Message,
 			e.Error),
 	}
-	c := appengine.NewContext(r)
-	err := mail.Send(c, errorMessage)
+	c := newContext(r)
+	err := mailer.Send(c, errorMessage)
 	if err != nil {
 		c.Errorf("Error %s sending error email.", err.Error())
 	}
@@ -300,20 +301,12 @@ func loadTemplates() (templates map[string]*Template) {
 			if err != nil {
 				return "", err
 			}
-			var baseUrl string
-			if appengine.IsDevAppServer() {
-				baseUrl = "http://localhost:8080"
-			} else {
-				baseUrl = "https://www.retrogit.com"
-			}
-			return baseUrl + url.String(), nil
+			return baseUrl() + url.String(), nil
 		},
 		"absoluteUrlForPath": func(path string) string {
-			if appengine.IsDevAppServer() {
-				return "http://localhost:8080" + path
-			}
-			return "https://www.retrogit.com" + path
+			return baseUrl() + path
 		},
+		"githubUrl": githubURL,
 		"style": func(names ...string) (result template.CSS) {
 			for _, name := range names {
 				result += styles[name]
@@ -351,6 +344,47 @@ func loadTemplates() (templates map[string]*Template) {
 	return templates
 }
 
+// loadTextTemplates loads the plain text versions of emails (from .txt files),
+// which are sent alongside the HTML ones.
+func loadTextTemplates() (templates map[string]*texttemplate.Template) {
+	funcMap := texttemplate.FuncMap{
+		"absoluteRouteUrl": func(name string) (string, error) {
+			url, err := router.Get(name).URL()
+			if err != nil {
+				return "", err
+			}
+			return baseUrl() + url.String(), nil
+		},
+		"githubUrl": githubURL,
+		// Removes the zero-width spaces that safeFormattedDate adds, since
+		// plain text isn't subject to date detection.
+		"plain": unsafeFormattedText,
+		"underline": func(s string) string {
+			return strings.Repeat("=", len([]rune(s)))
+		},
+	}
+	sharedFileNames, err := filepath.Glob("templates/shared/*.txt")
+	if err != nil {
+		log.Panicf("Could not read shared text template file names %s", err.Error())
+	}
+	templateFileNames, err := filepath.Glob("templates/*.txt")
+	if err != nil {
+		log.Panicf("Could not read text template file names %s", err.Error())
+	}
+	templates = make(map[string]*texttemplate.Template)
+	for _, templateFileName := range templateFileNames {
+		templateName := filepath.Base(templateFileName)
+		templateName = strings.TrimSuffix(templateName, filepath.Ext(templateName))
+		fileNames := append([]string{templateFileName}, sharedFileNames...)
+		parsedTemplate, err := texttemplate.New(filepath.Base(templateFileName)).Funcs(funcMap).ParseFiles(fileNames...)
+		if err != nil {
+			log.Panicf("Could not parse text template files for %s: %s", templateFileName, err.Error())
+		}
+		templates[templateName] = parsedTemplate
+	}
+	return templates
+}
+
 func loadStyles() (result map[string]template.CSS) {
 	stylesBytes, err := ioutil.ReadFile("config/styles.json")
 	if err != nil {
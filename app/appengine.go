@@ -0,0 +1,151 @@
+//go:build appengine
+// +build appengine
+
+package retrogit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"appengine"
+	"appengine/delay"
+	"appengine/mail"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+)
+
+func init() {
+	http.Handle("/", initApp())
+}
+
+func newContext(r *http.Request) Context {
+	return appengine.NewContext(r)
+}
+
+func isDevelopment() bool {
+	return appengine.IsDevAppServer()
+}
+
+func baseUrl() string {
+	if appengine.IsDevAppServer() {
+		return "http://localhost:8080"
+	}
+	return "https://www.retrogit.com"
+}
+
+func newGitHubTransport(c Context) http.RoundTripper {
+	appengineTransport := &urlfetch.Transport{Context: c.(appengine.Context)}
+	appengineTransport.Deadline = time.Second * 60
+	return &CachingTransport{
+		Transport: appengineTransport,
+		Cache:     responseCache,
+		Context:   c,
+	}
+}
+
+func privateURLsAllowed() bool {
+	return appengine.IsDevAppServer()
+}
+
+func newGitLabTransport(c Context) http.RoundTripper {
+	return &CachingTransport{
+		Transport: &PublicHostTransport{
+			Transport: &urlfetch.Transport{Context: c.(appengine.Context), Deadline: time.Second * 60},
+		},
+		Cache:   responseCache,
+		Context: c,
+	}
+}
+
+func newWebhookTransport(c Context) http.RoundTripper {
+	return &PublicHostTransport{
+		Transport: &urlfetch.Transport{Context: c.(appengine.Context), Deadline: time.Second * 30},
+	}
+}
+
+func newResponseCache(config ResponseCacheConfig) (ResponseCache, error) {
+	switch config.Backend {
+	case "", "memcache":
+		return &MemcacheResponseCache{config.maxEntryBytes()}, nil
+	case "memory":
+		return newMemoryResponseCache(config), nil
+	case "none":
+		return noResponseCache{}, nil
+	}
+	return nil, fmt.Errorf("Response cache backend %s is not available on App Engine", config.Backend)
+}
+
+// Local repositories can't be read on App Engine, which has no git command or
+// persistent filesystem.
+func localRepositoriesEnabled() bool {
+	return false
+}
+
+func newLocalGitProvider(account *Account) (Provider, error) {
+	return nil, errors.New("Local repositories are not available on App Engine")
+}
+
+func newMailer(config MailConfig) (Mailer, error) {
+	switch config.Backend {
+	case "", "appengine":
+		return &AppEngineMailer{}, nil
+	}
+	return nil, fmt.Errorf("Mail backend %s is not available on App Engine", config.Backend)
+}
+
+type AppEngineMailer struct{}
+
+func (m *AppEngineMailer) Send(c Context, message *MailMessage) error {
+	return mail.Send(c.(appengine.Context), &mail.Message{
+		Sender:   message.Sender,
+		To:       message.To,
+		Subject:  message.Subject,
+		Body:     message.Body,
+		HTMLBody: message.HTMLBody,
+	})
+}
+
+// Wraps delay.Function so that the functions that it runs can take a Context
+// instead of an appengine.Context as their first argument.
+type delayedFunc struct {
+	*delay.Function
+}
+
+var appengineContextType = reflect.TypeOf((*appengine.Context)(nil)).Elem()
+
+func newDelayedFunc(key string, fn interface{}) *delayedFunc {
+	fnValue := reflect.ValueOf(fn)
+	fnType := fnValue.Type()
+	argTypes := make([]reflect.Type, fnType.NumIn())
+	argTypes[0] = appengineContextType
+	for i := 1; i < fnType.NumIn(); i++ {
+		argTypes[i] = fnType.In(i)
+	}
+	returnTypes := make([]reflect.Type, fnType.NumOut())
+	for i := range returnTypes {
+		returnTypes[i] = fnType.Out(i)
+	}
+	wrapperType := reflect.FuncOf(argTypes, returnTypes, false)
+	wrapper := reflect.MakeFunc(wrapperType, func(args []reflect.Value) []reflect.Value {
+		args[0] = args[0].Convert(fnType.In(0))
+		return fnValue.Call(args)
+	})
+	return &delayedFunc{delay.Func(key, wrapper.Interface())}
+}
+
+func (f *delayedFunc) Call(c Context, args ...interface{}) {
+	f.Function.Call(c.(appengine.Context), args...)
+}
+
+func (f *delayedFunc) CallLater(c Context, delay time.Duration, args ...interface{}) error {
+	task, err := f.Function.Task(args...)
+	if err != nil {
+		return err
+	}
+	task.Delay = delay
+	_, err = taskqueue.Add(c.(appengine.Context), task, "")
+	return err
+}
@@ -0,0 +1,145 @@
+package retrogit
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// Trailers that credit other authors of a commit, e.g.
+// "Co-authored-by: Jane Doe <jane@example.com>".
+var coAuthoredByPattern = regexp.MustCompile(`(?im)^co-authored-by:[ \t]*([^<\n]*?)[ \t]*<([^>\n]+)>[ \t]*$`)
+
+// AuthorMatcher decides whether commits are the user's, by the login that
+// their author is associated with, their author's email or name, or by their
+// Co-authored-by trailers. Comparisons are case-insensitive. Since emails
+// and names are unverified, commits that GitHub attributes to another user
+// aren't matched by them, and trailers (which anyone can write) are only
+// matched by email.
+type AuthorMatcher struct {
+	logins map[string]bool
+	emails map[string]bool
+	names  map[string]bool
+}
+
+func newAuthorMatcher() *AuthorMatcher {
+	return &AuthorMatcher{
+		logins: make(map[string]bool),
+		emails: make(map[string]bool),
+		names:  make(map[string]bool),
+	}
+}
+
+func (m *AuthorMatcher) addLogin(login string) {
+	m.logins[strings.ToLower(login)] = true
+}
+
+func (m *AuthorMatcher) addEmail(email string) {
+	m.emails[strings.ToLower(email)] = true
+}
+
+func (m *AuthorMatcher) addName(name string) {
+	if name = strings.TrimSpace(name); name != "" {
+		m.names[strings.ToLower(name)] = true
+	}
+}
+
+// addAliases adds author aliases (see Account.AuthorAliases), which are either
+// emails or names.
+func (m *AuthorMatcher) addAliases(aliases []string) {
+	for _, alias := range aliases {
+		if isEmailAuthorAlias(alias) {
+			m.addEmail(alias)
+		} else {
+			m.addName(alias)
+		}
+	}
+}
+
+func (m *AuthorMatcher) matches(commit *github.RepositoryCommit) bool {
+	isAttributed := commit.Author != nil && commit.Author.Login != nil
+	if isAttributed && m.logins[strings.ToLower(*commit.Author.Login)] {
+		return true
+	}
+	if commit.Commit == nil {
+		return false
+	}
+	if author := commit.Commit.Author; author != nil && !isAttributed {
+		if author.Email != nil && m.emails[strings.ToLower(*author.Email)] {
+			return true
+		}
+		if author.Name != nil && m.names[strings.ToLower(strings.TrimSpace(*author.Name))] {
+			return true
+		}
+	}
+	if commit.Commit.Message != nil {
+		for _, coAuthor := range coAuthoredByPattern.FindAllStringSubmatch(*commit.Commit.Message, -1) {
+			if m.emails[strings.ToLower(coAuthor[2])] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filter returns the commits that match, without any duplicates (by SHA).
+func (m *AuthorMatcher) filter(commits []github.RepositoryCommit) []github.RepositoryCommit {
+	filteredCommits := make([]github.RepositoryCommit, 0)
+	seenSHAs := make(map[string]bool)
+	for i := range commits {
+		if seenSHAs[*commits[i].SHA] || !m.matches(&commits[i]) {
+			continue
+		}
+		seenSHAs[*commits[i].SHA] = true
+		filteredCommits = append(filteredCommits, commits[i])
+	}
+	return filteredCommits
+}
+
+func isEmailAuthorAlias(alias string) bool {
+	return strings.Contains(alias, "@")
+}
+
+// parseAuthorAliases parses one alias per line. Ones that contain an @ are
+// emails, and have to be well-formed; the rest are names.
+func parseAuthorAliases(value string) ([]string, error) {
+	aliases := make([]string, 0)
+	seenAliases := make(map[string]bool)
+	for _, alias := range strings.Split(value, "\n") {
+		alias = strings.TrimSpace(alias)
+		if alias == "" {
+			continue
+		}
+		if isEmailAuthorAlias(alias) {
+			address, err := mail.ParseAddress(alias)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not an email address: %s", alias, err.Error())
+			}
+			alias = address.Address
+		} else if strings.ContainsAny(alias, "<>") {
+			return nil, errors.New("Author names can't contain < or >")
+		}
+		if !seenAliases[strings.ToLower(alias)] {
+			seenAliases[strings.ToLower(alias)] = true
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases, nil
+}
+
+// authorAliasesEqual returns whether a and b match the same commits.
+func authorAliasesEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package retrogit
+
+import (
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func newTestCommit(login string, name string, email string, message string) *github.RepositoryCommit {
+	sha := "abc123"
+	commit := &github.RepositoryCommit{
+		SHA: &sha,
+		Commit: &github.Commit{
+			Author:  &github.CommitAuthor{Name: &name, Email: &email},
+			Message: &message,
+		},
+	}
+	if login != "" {
+		commit.Author = &github.User{Login: &login}
+	}
+	return commit
+}
+
+func TestAuthorMatcher(t *testing.T) {
+	matcher := newAuthorMatcher()
+	matcher.addLogin("octocat")
+	matcher.addAliases([]string{"old@example.com", "Mona Lisa"})
+
+	for _, test := range []struct {
+		description string
+		commit      *github.RepositoryCommit
+		matches     bool
+	}{
+		{"login", newTestCommit("OctoCat", "", "", "Fix"), true},
+		{"email alias", newTestCommit("", "", "OLD@example.com", "Fix"), true},
+		{"name alias", newTestCommit("", "mona lisa", "other@example.com", "Fix"), true},
+		{"name alias of another user's commit", newTestCommit("someone", "Mona Lisa", "other@example.com", "Fix"), false},
+		{"email alias of another user's commit", newTestCommit("someone", "", "old@example.com", "Fix"), false},
+		{"co-author email", newTestCommit("someone", "", "", "Fix\n\nCo-authored-by: Someone <old@example.com>"), true},
+		{"co-author name", newTestCommit("someone", "", "", "Fix\n\nCo-authored-by: Mona Lisa <other@example.com>"), false},
+		{"other author", newTestCommit("", "Someone", "other@example.com", "Fix"), false},
+	} {
+		if matches := matcher.matches(test.commit); matches != test.matches {
+			t.Errorf("%s: matches = %t, want %t", test.description, matches, test.matches)
+		}
+	}
+}
+
+func TestAuthorAliasesEqual(t *testing.T) {
+	if !authorAliasesEqual([]string{"Old@Example.com", "Mona Lisa"}, []string{"old@example.com", "mona lisa"}) {
+		t.Errorf("Aliases that only differ in case are not equal")
+	}
+	if authorAliasesEqual([]string{"old@example.com"}, []string{"old@example.com", "Mona Lisa"}) {
+		t.Errorf("Different aliases are equal")
+	}
+}
+
+func TestAuthorMatcherWithoutAliases(t *testing.T) {
+	originalBaseURL := githubConfig.BaseURL
+	githubConfig.BaseURL = DefaultGitHubBaseURL
+	defer func() { githubConfig.BaseURL = originalBaseURL }()
+	userId, login := 1, "octocat"
+	// Like GitHubProvider.authorMatcher for a user without aliases.
+	matcher := newAuthorMatcher()
+	matcher.addLogin(login)
+	matcher.addEmail("octocat@example.com")
+	for _, email := range githubNoreplyEmails(&github.User{ID: &userId, Login: &login}) {
+		matcher.addEmail(email)
+	}
+
+	for _, test := range []struct {
+		description string
+		commit      *github.RepositoryCommit
+		matches     bool
+	}{
+		{"own commit", newTestCommit("octocat", "", "", "Fix"), true},
+		{"co-author email", newTestCommit("hubot", "", "", "Pair\n\nCo-authored-by: Octo Cat <octocat@example.com>"), true},
+		{"co-author noreply email", newTestCommit("hubot", "", "", "Pair\n\nCo-authored-by: Octo Cat <1+octocat@users.noreply.github.com>"), true},
+		{"legacy co-author noreply email", newTestCommit("hubot", "", "", "Pair\n\nCo-authored-by: Octo Cat <octocat@users.noreply.github.com>"), true},
+		{"other co-author", newTestCommit("hubot", "", "", "Pair\n\nCo-authored-by: Octo Cat <cat@example.com>"), false},
+		{"other author", newTestCommit("hubot", "", "", "Fix"), false},
+	} {
+		if matches := matcher.matches(test.commit); matches != test.matches {
+			t.Errorf("%s: matches = %t, want %t", test.description, matches, test.matches)
+		}
+	}
+}
@@ -0,0 +1,736 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	boltAccountBucket = []byte("Account")
+	boltVintageBucket = []byte("RepoVintage")
+	boltJobBucket     = []byte("Job")
+
+	boltTeamSubscriptionBucket = []byte("TeamSubscription")
+	boltIndexedCommitBucket    = []byte("IndexedCommit")
+	boltCommitIndexStateBucket = []byte("CommitIndexState")
+	boltWebhookDeliveryBucket  = []byte("WebhookDelivery")
+	boltWebhookPayloadBucket   = []byte("WebhookPayload")
+	boltAPITokenBucket         = []byte("APIToken")
+
+	boltArchivedDigestBucket        = []byte("ArchivedDigest")
+	boltArchivedDigestContentBucket = []byte("ArchivedDigestContent")
+)
+
+// Indexed commits are keyed by user and push date (rather than by
+// indexedCommitKey) so that they can be range scanned.
+const boltIndexedCommitDateFormat = "20060102150405"
+
+func newStorage(config StorageConfig) (Storage, error) {
+	switch config.Backend {
+	case "", "bolt":
+		return newBoltStorage(config.Path)
+	}
+	return nil, fmt.Errorf("Storage backend %s is not available outside of App Engine", config.Backend)
+}
+
+// Stores accounts, vintages, team subscriptions, commit indexes, webhook
+// delivery logs, API tokens and archived digests as JSON in an embedded BoltDB
+// file, for running outside of App Engine. Bucket and key names mirror the
+// datastore kinds and keys.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+func newBoltStorage(path string) (*BoltStorage, error) {
+	if path == "" {
+		path = "retrogit.db"
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltAccountBucket, boltVintageBucket, boltJobBucket, boltTeamSubscriptionBucket,
+			boltIndexedCommitBucket, boltCommitIndexStateBucket, boltWebhookDeliveryBucket, boltWebhookPayloadBucket,
+			boltAPITokenBucket, boltArchivedDigestBucket, boltArchivedDigestContentBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStorage) accountKey(githubUserId int) []byte {
+	return []byte(strconv.Itoa(githubUserId))
+}
+
+func (s *BoltStorage) GetAccount(c Context, githubUserId int) (*Account, error) {
+	var account *Account
+	err := s.db.View(func(tx *bolt.Tx) error {
+		accountBytes := tx.Bucket(boltAccountBucket).Get(s.accountKey(githubUserId))
+		if accountBytes == nil {
+			return ErrAccountNotFound
+		}
+		account = new(Account)
+		return json.Unmarshal(accountBytes, account)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *BoltStorage) GetAllAccounts(c Context) ([]Account, error) {
+	var accounts []Account
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAccountBucket).ForEach(func(k, v []byte) error {
+			var account Account
+			if err := json.Unmarshal(v, &account); err != nil {
+				return err
+			}
+			accounts = append(accounts, account)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (s *BoltStorage) PutAccount(c Context, account *Account) error {
+	accountBytes, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAccountBucket).Put(s.accountKey(account.GitHubUserId), accountBytes)
+	})
+}
+
+func (s *BoltStorage) DeleteAccount(c Context, githubUserId int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAccountBucket).Delete(s.accountKey(githubUserId))
+	})
+}
+
+func (s *BoltStorage) GetVintages(c Context, userId int, repoIds []int) ([]*RepoVintage, error) {
+	vintages := make([]*RepoVintage, len(repoIds))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltVintageBucket)
+		for i := range repoIds {
+			vintageBytes := bucket.Get([]byte(vintageKey(userId, repoIds[i])))
+			if vintageBytes == nil {
+				continue
+			}
+			vintages[i] = new(RepoVintage)
+			if err := json.Unmarshal(vintageBytes, vintages[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vintages, nil
+}
+
+func (s *BoltStorage) PutVintage(c Context, vintage *RepoVintage) error {
+	vintageBytes, err := json.Marshal(vintage)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltVintageBucket).Put(
+			[]byte(vintageKey(vintage.UserId, vintage.RepoId)), vintageBytes)
+	})
+}
+
+func (s *BoltStorage) DeleteVintages(c Context, userId int) error {
+	// Keys start with the user ID (see vintageKey).
+	prefix := []byte(fmt.Sprintf("%d-", userId))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltVintageBucket)
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) teamSubscriptionKey(id int64) []byte {
+	return []byte(strconv.FormatInt(id, 10))
+}
+
+func (s *BoltStorage) GetTeamSubscription(c Context, id int64) (*TeamSubscription, error) {
+	var subscription *TeamSubscription
+	err := s.db.View(func(tx *bolt.Tx) error {
+		subscriptionBytes := tx.Bucket(boltTeamSubscriptionBucket).Get(s.teamSubscriptionKey(id))
+		if subscriptionBytes == nil {
+			return ErrTeamSubscriptionNotFound
+		}
+		subscription = new(TeamSubscription)
+		return json.Unmarshal(subscriptionBytes, subscription)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+func (s *BoltStorage) GetTeamSubscriptionsForOwner(c Context, ownerGitHubUserId int) ([]TeamSubscription, error) {
+	subscriptions, err := s.GetAllTeamSubscriptions(c)
+	if err != nil {
+		return nil, err
+	}
+	ownerSubscriptions := make([]TeamSubscription, 0)
+	for i := range subscriptions {
+		if subscriptions[i].OwnerGitHubUserId == ownerGitHubUserId {
+			ownerSubscriptions = append(ownerSubscriptions, subscriptions[i])
+		}
+	}
+	return ownerSubscriptions, nil
+}
+
+func (s *BoltStorage) GetAllTeamSubscriptions(c Context) ([]TeamSubscription, error) {
+	var subscriptions []TeamSubscription
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTeamSubscriptionBucket).ForEach(func(k, v []byte) error {
+			var subscription TeamSubscription
+			if err := json.Unmarshal(v, &subscription); err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, subscription)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+func (s *BoltStorage) PutTeamSubscription(c Context, subscription *TeamSubscription) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTeamSubscriptionBucket)
+		if subscription.Id == 0 {
+			id, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			subscription.Id = int64(id)
+		}
+		subscriptionBytes, err := json.Marshal(subscription)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(s.teamSubscriptionKey(subscription.Id), subscriptionBytes)
+	})
+}
+
+func (s *BoltStorage) DeleteTeamSubscription(c Context, id int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTeamSubscriptionBucket).Delete(s.teamSubscriptionKey(id))
+	})
+}
+
+func (s *BoltStorage) indexedCommitKeyPrefix(userId int, pushDate time.Time) []byte {
+	return []byte(fmt.Sprintf("%d-%s", userId, pushDate.UTC().Format(boltIndexedCommitDateFormat)))
+}
+
+func (s *BoltStorage) indexedCommitKey(commit *IndexedCommit) []byte {
+	prefix := s.indexedCommitKeyPrefix(commit.UserId, commit.PushDate)
+	return append(prefix, []byte(fmt.Sprintf("-%d-%s", commit.RepoId, commit.SHA))...)
+}
+
+func (s *BoltStorage) GetIndexedCommits(c Context, userId int, startTime time.Time, endTime time.Time) ([]IndexedCommit, error) {
+	commits := make([]IndexedCommit, 0)
+	startKey := s.indexedCommitKeyPrefix(userId, startTime)
+	endKey := s.indexedCommitKeyPrefix(userId, endTime)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltIndexedCommitBucket).Cursor()
+		for k, v := cursor.Seek(startKey); k != nil && bytes.Compare(k, endKey) < 0; k, v = cursor.Next() {
+			var commit IndexedCommit
+			if err := json.Unmarshal(v, &commit); err != nil {
+				return err
+			}
+			commits = append(commits, commit)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
+
+func (s *BoltStorage) PutIndexedCommits(c Context, commits []IndexedCommit) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltIndexedCommitBucket)
+		for i := range commits {
+			commitBytes, err := json.Marshal(&commits[i])
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(s.indexedCommitKey(&commits[i]), commitBytes); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) GetCommitIndexStates(c Context, userId int, repoIds []int) ([]*CommitIndexState, error) {
+	states := make([]*CommitIndexState, len(repoIds))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltCommitIndexStateBucket)
+		for i := range repoIds {
+			stateBytes := bucket.Get([]byte(commitIndexStateKey(userId, repoIds[i])))
+			if stateBytes == nil {
+				continue
+			}
+			states[i] = new(CommitIndexState)
+			if err := json.Unmarshal(stateBytes, states[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (s *BoltStorage) PutCommitIndexState(c Context, state *CommitIndexState) error {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCommitIndexStateBucket).Put(
+			[]byte(commitIndexStateKey(state.UserId, state.RepoId)), stateBytes)
+	})
+}
+
+func (s *BoltStorage) DeleteCommitIndex(c Context, userId int) error {
+	// Both buckets' keys start with the user ID.
+	prefix := []byte(fmt.Sprintf("%d-", userId))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, bucketName := range [][]byte{boltIndexedCommitBucket, boltCommitIndexStateBucket} {
+			bucket := tx.Bucket(bucketName)
+			var keys [][]byte
+			cursor := bucket.Cursor()
+			for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			for _, k := range keys {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Webhook deliveries are keyed by user and then by a sequence number, so that
+// a user's are in chronological order.
+func (s *BoltStorage) webhookDeliveryKeyPrefix(githubUserId int) []byte {
+	return []byte(fmt.Sprintf("%d-", githubUserId))
+}
+
+func (s *BoltStorage) PutWebhookDelivery(c Context, delivery *WebhookDelivery) error {
+	deliveryBytes, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltWebhookDeliveryBucket)
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		prefix := s.webhookDeliveryKeyPrefix(delivery.GitHubUserId)
+		key := append(prefix, []byte(fmt.Sprintf("%020d", sequence))...)
+		if err := bucket.Put(key, deliveryBytes); err != nil {
+			return err
+		}
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for i := 0; i < len(keys)-WebhookDeliveryLogSize; i++ {
+			if err := bucket.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) GetWebhookDeliveries(c Context, githubUserId int) ([]WebhookDelivery, error) {
+	deliveries := make([]WebhookDelivery, 0)
+	prefix := s.webhookDeliveryKeyPrefix(githubUserId)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltWebhookDeliveryBucket).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var delivery WebhookDelivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Newest first.
+	for i, j := 0, len(deliveries)-1; i < j; i, j = i+1, j-1 {
+		deliveries[i], deliveries[j] = deliveries[j], deliveries[i]
+	}
+	return deliveries, nil
+}
+
+func (s *BoltStorage) webhookPayloadKey(githubUserId int, deliveryId string) []byte {
+	return []byte(fmt.Sprintf("%d-%s", githubUserId, deliveryId))
+}
+
+func (s *BoltStorage) PutWebhookPayload(c Context, githubUserId int, deliveryId string, payload []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWebhookPayloadBucket).Put(s.webhookPayloadKey(githubUserId, deliveryId), payload)
+	})
+}
+
+func (s *BoltStorage) GetWebhookPayload(c Context, githubUserId int, deliveryId string) ([]byte, error) {
+	var payload []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		payloadBytes := tx.Bucket(boltWebhookPayloadBucket).Get(s.webhookPayloadKey(githubUserId, deliveryId))
+		if payloadBytes == nil {
+			return ErrWebhookPayloadNotFound
+		}
+		payload = append([]byte(nil), payloadBytes...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (s *BoltStorage) DeleteWebhookPayload(c Context, githubUserId int, deliveryId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWebhookPayloadBucket).Delete(s.webhookPayloadKey(githubUserId, deliveryId))
+	})
+}
+
+func (s *BoltStorage) DeleteWebhookDeliveries(c Context, githubUserId int) error {
+	// Both deliveries and payloads are keyed by "<user ID>-".
+	prefix := s.webhookDeliveryKeyPrefix(githubUserId)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, bucketName := range [][]byte{boltWebhookDeliveryBucket, boltWebhookPayloadBucket} {
+			bucket := tx.Bucket(bucketName)
+			var keys [][]byte
+			cursor := bucket.Cursor()
+			for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			for _, k := range keys {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) GetAPIToken(c Context, hash string) (*APIToken, error) {
+	var token *APIToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tokenBytes := tx.Bucket(boltAPITokenBucket).Get([]byte(hash))
+		if tokenBytes == nil {
+			return ErrAPITokenNotFound
+		}
+		token = new(APIToken)
+		return json.Unmarshal(tokenBytes, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *BoltStorage) GetAPITokens(c Context, githubUserId int) ([]APIToken, error) {
+	tokens := make([]APIToken, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPITokenBucket).ForEach(func(k, v []byte) error {
+			var token APIToken
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+			if token.GitHubUserId == githubUserId {
+				tokens = append(tokens, token)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *BoltStorage) PutAPIToken(c Context, token *APIToken) error {
+	tokenBytes, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPITokenBucket).Put([]byte(token.Hash), tokenBytes)
+	})
+}
+
+func (s *BoltStorage) DeleteAPIToken(c Context, hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPITokenBucket).Delete([]byte(hash))
+	})
+}
+
+func (s *BoltStorage) DeleteAPITokens(c Context, githubUserId int) error {
+	tokens, err := s.GetAPITokens(c, githubUserId)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltAPITokenBucket)
+		for i := range tokens {
+			if err := bucket.Delete([]byte(tokens[i].Hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Archived digests (and their contents) are keyed by user and then by ID,
+// which are assigned in increasing order, so that a user's are in
+// chronological order.
+func (s *BoltStorage) archivedDigestKey(githubUserId int, id int64) []byte {
+	return []byte(fmt.Sprintf("%d-%020d", githubUserId, id))
+}
+
+func (s *BoltStorage) PutArchivedDigest(c Context, digest *ArchivedDigest, content *ArchivedDigestContent) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltArchivedDigestBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		digest.Id = int64(id)
+		digestBytes, err := json.Marshal(digest)
+		if err != nil {
+			return err
+		}
+		contentBytes, err := json.Marshal(content)
+		if err != nil {
+			return err
+		}
+		key := s.archivedDigestKey(digest.GitHubUserId, digest.Id)
+		if err := bucket.Put(key, digestBytes); err != nil {
+			return err
+		}
+		return tx.Bucket(boltArchivedDigestContentBucket).Put(key, contentBytes)
+	})
+}
+
+func (s *BoltStorage) GetArchivedDigests(c Context, githubUserId int) ([]ArchivedDigest, error) {
+	digests := make([]ArchivedDigest, 0)
+	prefix := []byte(fmt.Sprintf("%d-", githubUserId))
+	// The user's keys are followed by ones that start with "<id>." (since "."
+	// sorts right after "-"), so the newest one is right before those.
+	end := []byte(fmt.Sprintf("%d.", githubUserId))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltArchivedDigestBucket).Cursor()
+		k, v := cursor.Seek(end)
+		if k == nil {
+			k, v = cursor.Last()
+		} else {
+			k, v = cursor.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix) && len(digests) < DigestHistoryLimit; k, v = cursor.Prev() {
+			var digest ArchivedDigest
+			if err := json.Unmarshal(v, &digest); err != nil {
+				return err
+			}
+			digests = append(digests, digest)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+func (s *BoltStorage) GetArchivedDigest(c Context, githubUserId int, id int64) (*ArchivedDigest, *ArchivedDigestContent, error) {
+	var digest *ArchivedDigest
+	var content *ArchivedDigestContent
+	key := s.archivedDigestKey(githubUserId, id)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		digestBytes := tx.Bucket(boltArchivedDigestBucket).Get(key)
+		contentBytes := tx.Bucket(boltArchivedDigestContentBucket).Get(key)
+		if digestBytes == nil || contentBytes == nil {
+			return ErrArchivedDigestNotFound
+		}
+		digest = new(ArchivedDigest)
+		if err := json.Unmarshal(digestBytes, digest); err != nil {
+			return err
+		}
+		content = new(ArchivedDigestContent)
+		return json.Unmarshal(contentBytes, content)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return digest, content, nil
+}
+
+func (s *BoltStorage) DeleteArchivedDigests(c Context, githubUserId int, before time.Time) error {
+	prefix := []byte(fmt.Sprintf("%d-", githubUserId))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltArchivedDigestBucket)
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var digest ArchivedDigest
+			if err := json.Unmarshal(v, &digest); err != nil {
+				return err
+			}
+			// Digests are in chronological order, so the rest are newer.
+			if !digest.SendTime.Before(before) {
+				break
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		contentBucket := tx.Bucket(boltArchivedDigestContentBucket)
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			if err := contentBucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) AddJob(c Context, job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltJobBucket)
+		if job.Id == "" {
+			id, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			job.Id = strconv.FormatUint(id, 10)
+		} else if bucket.Get([]byte(job.Id)) != nil {
+			return nil
+		}
+		return s.putJob(bucket, job)
+	})
+}
+
+func (s *BoltStorage) LeaseJobs(c Context, now time.Time, leaseDuration time.Duration, limit int) ([]*Job, error) {
+	var jobs []*Job
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltJobBucket)
+		// Jobs are few enough that a full scan is simpler than maintaining an
+		// index by RunAt.
+		err := bucket.ForEach(func(k, v []byte) error {
+			job := new(Job)
+			if err := json.Unmarshal(v, job); err != nil {
+				return err
+			}
+			if !job.RunAt.After(now) {
+				jobs = append(jobs, job)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Sort(JobsByRunAt(jobs))
+		if len(jobs) > limit {
+			jobs = jobs[:limit]
+		}
+		for _, job := range jobs {
+			job.Attempts++
+			job.RunAt = now.Add(leaseDuration)
+			if err := s.putJob(bucket, job); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *BoltStorage) UpdateJob(c Context, job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltJobBucket)
+		// The job may have been deleted in the meantime (e.g. if its lease
+		// expired and another run of it completed).
+		if bucket.Get([]byte(job.Id)) == nil {
+			return nil
+		}
+		return s.putJob(bucket, job)
+	})
+}
+
+func (s *BoltStorage) DeleteJob(c Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJobBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStorage) putJob(bucket *bolt.Bucket, job *Job) error {
+	jobBytes, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(job.Id), jobBytes)
+}
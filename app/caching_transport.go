@@ -8,79 +8,118 @@ import (
 	"io"
 	"net/http"
 	"net/http/httputil"
-	"strings"
-	"time"
-
-	"appengine"
-	"appengine/memcache"
 )
 
-// Simple http.RoundTripper implementation which wraps an existing transport and
-// caches all responses for GET and HEAD requests. Meant to speed up the
-// iteration cycle during development.
+// http.RoundTripper implementation which wraps an existing transport and
+// caches GET responses that have an ETag or Last-Modified header. Cached
+// responses are always revalidated with a conditional request; GitHub doesn't
+// count 304 responses against the rate limit, so unchanged data is
+// effectively free to refetch.
 type CachingTransport struct {
 	Transport http.RoundTripper
-	Context   appengine.Context
+	Cache     ResponseCache
+	Context   Context
 }
 
-func (t *CachingTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	if req.Method != "GET" && req.Method != "HEAD" {
+func (t *CachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
 		return t.Transport.RoundTrip(req)
 	}
-	// The Go App Engine runtime has a 250 byte limit for memcache keys, so we
-	// need to hash the URL to make sure we stay under it.
-	cacheHash := md5.New()
-	io.WriteString(cacheHash, req.URL.String())
-	authorizationHeaders, ok := req.Header["Authorization"]
-	if ok {
-		for i := range authorizationHeaders {
-			io.WriteString(cacheHash, authorizationHeaders[i])
+	cacheKey := responseCacheKey(req)
+
+	var cachedResp *http.Response
+	cachedRespBytes, ok, err := t.Cache.Get(t.Context, cacheKey)
+	if err != nil {
+		responseCacheMetrics.addError()
+		t.Context.Errorf("Error getting cached response: %v", err)
+	} else if ok {
+		cachedResp, err = http.ReadResponse(bufio.NewReader(bytes.NewBuffer(cachedRespBytes)), req)
+		if err != nil {
+			responseCacheMetrics.addError()
+			t.Context.Errorf("Error reading bytes for cached response: %v", err)
+			cachedResp = nil
 		}
-	} else {
-		io.WriteString(cacheHash, "Unauthorized")
 	}
-	cacheKey := fmt.Sprintf("CachingTransport:%x", cacheHash.Sum(nil))
 
-	cachedRespItem, err := memcache.Get(t.Context, cacheKey)
-	if err != nil && err != memcache.ErrCacheMiss {
-		t.Context.Errorf("Error getting cached response: %v", err)
-		return t.Transport.RoundTrip(req)
+	if cachedResp == nil {
+		responseCacheMetrics.addMiss()
+		resp, err := t.Transport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		t.store(req, cacheKey, resp)
+		return resp, nil
+	}
+
+	// RoundTrippers must not modify the request, so the conditional headers
+	// are added to a copy.
+	conditionalReq := new(http.Request)
+	*conditionalReq = *req
+	conditionalReq.Header = make(http.Header, len(req.Header)+2)
+	for k, v := range req.Header {
+		conditionalReq.Header[k] = v
+	}
+	if etag := cachedResp.Header.Get("ETag"); etag != "" {
+		conditionalReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := cachedResp.Header.Get("Last-Modified"); lastModified != "" {
+		conditionalReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := t.Transport.RoundTrip(conditionalReq)
+	if err != nil {
+		cachedResp.Body.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		responseCacheMetrics.addStale()
+		cachedResp.Body.Close()
+		t.store(req, cacheKey, resp)
+		return resp, nil
 	}
-	if err == nil {
-		cacheRespBuffer := bytes.NewBuffer(cachedRespItem.Value)
-		resp, err := http.ReadResponse(bufio.NewReader(cacheRespBuffer), req)
-		if err == nil {
-			return resp, nil
-		} else {
-			t.Context.Errorf("Error readings bytes for cached response: %v", err)
+	responseCacheMetrics.addHit()
+	resp.Body.Close()
+	// The rate limit headers of the 304 are more current than the cached ones.
+	for _, header := range []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"} {
+		if value := resp.Header.Get(header); value != "" {
+			cachedResp.Header.Set(header, value)
 		}
 	}
-	t.Context.Infof("Fetching %s", req.URL)
-	resp, err = t.Transport.RoundTrip(req)
-	if err != nil || resp.StatusCode != 200 {
+	return cachedResp, nil
+}
+
+func (t *CachingTransport) store(req *http.Request, cacheKey string, resp *http.Response) {
+	if resp.StatusCode != http.StatusOK ||
+		(resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "") {
 		return
 	}
 	respBytes, err := httputil.DumpResponse(resp, true)
 	if err != nil {
+		responseCacheMetrics.addError()
 		t.Context.Errorf("Error dumping bytes for cached response: %v", err)
-		return resp, nil
-	}
-	var expiration time.Duration = time.Hour
-	if strings.HasPrefix(req.URL.Path, "/repos/") &&
-		(strings.HasSuffix(req.URL.Path, "/commits") ||
-			strings.HasSuffix(req.URL.Path, "/stats/contributors")) {
-		expiration = 0
+		return
 	}
-	err = memcache.Set(
-		t.Context,
-		&memcache.Item{
-			Key:        cacheKey,
-			Value:      respBytes,
-			Expiration: expiration,
-		})
+	err = t.Cache.Put(t.Context, cacheKey, respBytes)
 	if err != nil {
+		responseCacheMetrics.addError()
 		t.Context.Errorf("Error setting cached response for %s (cache key %s, %d bytes to cache): %v",
 			req.URL, cacheKey, len(respBytes), err)
+		return
+	}
+	responseCacheMetrics.addStore()
+}
+
+func responseCacheKey(req *http.Request) string {
+	// The Go App Engine runtime has a 250 byte limit for memcache keys, so we
+	// need to hash the URL to make sure we stay under it.
+	cacheHash := md5.New()
+	io.WriteString(cacheHash, req.URL.String())
+	authorizationHeaders, ok := req.Header["Authorization"]
+	if ok {
+		for i := range authorizationHeaders {
+			io.WriteString(cacheHash, authorizationHeaders[i])
+		}
+	} else {
+		io.WriteString(cacheHash, "Unauthorized")
 	}
-	return resp, nil
+	return fmt.Sprintf("CachingTransport:%x", cacheHash.Sum(nil))
 }
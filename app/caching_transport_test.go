@@ -0,0 +1,141 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func cacheableResponse(etag string, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		fmt.Fprint(w, body)
+	}
+}
+
+func newTestCachingClient() *http.Client {
+	return &http.Client{Transport: &CachingTransport{
+		Transport: http.DefaultTransport,
+		Cache:     newMemoryResponseCache(ResponseCacheConfig{}),
+		Context:   &logContext{},
+	}}
+}
+
+func getTestResponse(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestCachingTransportRevalidates(t *testing.T) {
+	server := newRateLimitedServer(
+		cacheableResponse(`"v1"`, "cached"),
+		func(w http.ResponseWriter) {
+			w.Header().Set("X-RateLimit-Remaining", "4998")
+			w.WriteHeader(http.StatusNotModified)
+		})
+	defer server.Close()
+	client := newTestCachingClient()
+
+	getTestResponse(t, client, server.URL+"/repos")
+	resp, body := getTestResponse(t, client, server.URL+"/repos")
+
+	if server.requestCount() != 2 {
+		t.Fatalf("Expected 2 requests, got %d", server.requestCount())
+	}
+	if ifNoneMatch := server.headers[0].Get("If-None-Match"); ifNoneMatch != "" {
+		t.Errorf("First request was conditional (If-None-Match: %s)", ifNoneMatch)
+	}
+	if ifNoneMatch := server.headers[1].Get("If-None-Match"); ifNoneMatch != `"v1"` {
+		t.Errorf("Revalidation was sent with If-None-Match: %s", ifNoneMatch)
+	}
+	if resp.StatusCode != http.StatusOK || body != "cached" {
+		t.Errorf("Expected the cached response, got %d %q", resp.StatusCode, body)
+	}
+	if remaining := resp.Header.Get("X-RateLimit-Remaining"); remaining != "4998" {
+		t.Errorf("Expected the 304's rate limit, got %s", remaining)
+	}
+}
+
+func TestCachingTransportOnlyStoresValidatedSuccesses(t *testing.T) {
+	server := newRateLimitedServer(
+		func(w http.ResponseWriter) {
+			fmt.Fprint(w, "no validator")
+		},
+		func(w http.ResponseWriter) {
+			w.Header().Set("ETag", `"missing"`)
+			w.WriteHeader(http.StatusNotFound)
+		},
+		cacheableResponse(`"v2"`, "cached"))
+	defer server.Close()
+	client := newTestCachingClient()
+
+	for i := 0; i < 4; i++ {
+		getTestResponse(t, client, server.URL+"/repos")
+	}
+
+	for i, expected := range []string{"", "", "", `"v2"`} {
+		if ifNoneMatch := server.headers[i].Get("If-None-Match"); ifNoneMatch != expected {
+			t.Errorf("Request %d had If-None-Match: %s, expected %s", i, ifNoneMatch, expected)
+		}
+	}
+}
+
+func TestDiskResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retrogit-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := newDiskResponseCache(ResponseCacheConfig{Directory: dir, MaxBytes: 12, MaxEntryBytes: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &logContext{}
+
+	for _, key := range []string{"Test:a", "Test:b"} {
+		err := cache.Put(c, key, []byte("123456"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Modification times may not be fine-grained enough to tell the entries
+	// apart otherwise.
+	now := time.Now()
+	os.Chtimes(cache.path("Test:a"), now.Add(-time.Hour*2), now.Add(-time.Hour*2))
+	os.Chtimes(cache.path("Test:b"), now.Add(-time.Hour), now.Add(-time.Hour))
+	if _, ok, _ := cache.Get(c, "Test:a"); !ok {
+		t.Fatal("Test:a is not cached")
+	}
+	err = cache.Put(c, "Test:c", []byte("123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.Put(c, "Test:large", []byte("123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]bool{"Test:a": true, "Test:b": false, "Test:c": true, "Test:large": false} {
+		if _, ok, _ := cache.Get(c, key); ok != expected {
+			t.Errorf("%s cached: %t, expected %t", key, ok, expected)
+		}
+	}
+	if count, bytes := cache.Size(); count != 2 || bytes != 12 {
+		t.Errorf("Expected 2 entries with 12 bytes, got %d with %d", count, bytes)
+	}
+}
@@ -0,0 +1,116 @@
+package retrogit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/google/go-github/github"
+)
+
+// IntervalRepoCommits are the commits that the digest's user made in a
+// repository during one of its intervals, newest first.
+type IntervalRepoCommits struct {
+	intervalDigest *IntervalDigest
+	repo           *Repo
+	provider       Provider
+	commits        []github.RepositoryCommit
+	err            error
+}
+
+// CommitFetcher looks up the commits of a Digest, for each of its intervals
+// and the repositories from provider that may have activity in them. Errors
+// are reported per repository, so that one inaccessible repository doesn't
+// prevent the digest from being sent.
+type CommitFetcher interface {
+	FetchCommits(provider Provider, digest *Digest) []*IntervalRepoCommits
+}
+
+type GitHubConfig struct {
+	// "rest" (the default) or "graphql".
+	CommitFetcher string
+	// How many GitHub API requests are made at once when fetching a digest.
+	// Defaults to DefaultFetchParallelism.
+	FetchParallelism int
+	// Where GitHub API responses are cached, so that they can be revalidated
+	// with conditional requests.
+	Cache ResponseCacheConfig
+	// Past commits are read from a per-user index (which is updated daily)
+	// instead of being fetched each time a digest is generated.
+	CommitIndex CommitIndexConfig
+	// Root of the GitHub instance's web pages, used for links and OAuth.
+	// Defaults to DefaultGitHubBaseURL; set it to the root of a GitHub
+	// Enterprise Server instance (e.g. "https://github.example.com/") to use
+	// that instead.
+	BaseURL string
+	// API endpoints. They default to github.com's, or to the ones under
+	// BaseURL if it points to GitHub Enterprise Server.
+	APIURL     string
+	UploadURL  string
+	GraphQLURL string
+	// OAuth endpoints, which default to the ones under BaseURL.
+	OAuthAuthURL  string
+	OAuthTokenURL string
+}
+
+func initGitHubConfig() (config GitHubConfig, fetcher CommitFetcher, cache ResponseCache) {
+	configBytes, err := ioutil.ReadFile("config/github.json")
+	if err == nil {
+		err = json.Unmarshal(configBytes, &config)
+		if err != nil {
+			log.Panicf("Could not parse GitHub config %s: %s", configBytes, err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		log.Panicf("Could not read GitHub config: %s", err.Error())
+	}
+	err = config.initURLs()
+	if err != nil {
+		log.Panicf("Could not initialize GitHub URLs: %s", err.Error())
+	}
+	fetcher, err = newCommitFetcher(config.CommitFetcher)
+	if err != nil {
+		log.Panicf("Could not initialize commit fetcher: %s", err.Error())
+	}
+	cache, err = newResponseCache(config.Cache)
+	if err != nil {
+		log.Panicf("Could not initialize response cache: %s", err.Error())
+	}
+	return
+}
+
+func newCommitFetcher(name string) (CommitFetcher, error) {
+	switch name {
+	case "", "rest":
+		return &RESTCommitFetcher{}, nil
+	case "graphql":
+		return &GraphQLCommitFetcher{}, nil
+	}
+	return nil, fmt.Errorf("Unknown commit fetcher %s", name)
+}
+
+// RESTCommitFetcher lists the commits of each (interval, repository) pair with
+// a separate (paged) REST API request, FetchParallelism at a time. It works
+// with any Provider.
+type RESTCommitFetcher struct{}
+
+func (f *RESTCommitFetcher) FetchCommits(provider Provider, digest *Digest) []*IntervalRepoCommits {
+	pool := newGitHubWorkerPool(githubConfig.FetchParallelism)
+	results := make([]*IntervalRepoCommits, 0)
+	var resultsMutex sync.Mutex
+	for _, intervalDigest := range digest.IntervalDigests {
+		for _, repo := range intervalDigest.providerRepos(provider) {
+			intervalDigest, repo := intervalDigest, repo
+			pool.Go(func() {
+				commits, err := provider.ListCommits(pool, repo, intervalDigest.StartTime, intervalDigest.EndTime)
+				resultsMutex.Lock()
+				results = append(results, &IntervalRepoCommits{intervalDigest, repo, provider, commits, err})
+				resultsMutex.Unlock()
+			})
+		}
+	}
+	pool.Wait()
+	return results
+}
@@ -0,0 +1,277 @@
+package retrogit
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	// Commits newer than this aren't indexed, since they may still change
+	// (e.g. if a branch with older commits is merged). It's a bit over a
+	// year so that the most recent digest interval is always fetched live.
+	DefaultCommitIndexLiveWindowDays = 400
+	// The hour (in UTC) that the commit indexes of accounts with IDs that are
+	// a multiple of 24 are updated. Other accounts are spread out over the
+	// rest of the day.
+	CommitIndexBaseHour = 3
+)
+
+// IndexedCommit is the subset of a commit that is needed to display it in a
+// digest. Only commits that the user authored are indexed.
+type IndexedCommit struct {
+	UserId     int
+	RepoId     int    `datastore:",noindex"`
+	SHA        string `datastore:",noindex"`
+	PushDate   time.Time
+	CommitDate time.Time `datastore:",noindex"`
+	Title      string    `datastore:",noindex"`
+	Message    string    `datastore:",noindex"`
+	// Login of the identity that the commit was indexed as.
+	Identity string `datastore:",noindex"`
+}
+
+// sort.Interface implementation for sorting IndexedCommits, oldest first.
+type ByPushDate []IndexedCommit
+
+func (a ByPushDate) Len() int           { return len(a) }
+func (a ByPushDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByPushDate) Less(i, j int) bool { return a[i].PushDate.Before(a[j].PushDate) }
+
+func newIndexedCommit(userId int, repo *Repo, commit *github.RepositoryCommit, identity string) IndexedCommit {
+	title, message := splitCommitMessage(*commit.Commit.Message)
+	return IndexedCommit{
+		UserId:     userId,
+		RepoId:     *repo.ID,
+		SHA:        *commit.SHA,
+		PushDate:   commit.Commit.Committer.Date.UTC(),
+		CommitDate: commit.Commit.Author.Date.UTC(),
+		Title:      title,
+		Message:    message,
+		Identity:   identity,
+	}
+}
+
+func (commit *IndexedCommit) digestCommit(repo *Repo, location *time.Location) DigestCommit {
+	return DigestCommit{
+		SHA:        commit.SHA,
+		DisplaySHA: commit.SHA[:7],
+		URL:        commitURL(repo, commit.SHA),
+		Title:      commit.Title,
+		Message:    commit.Message,
+		PushDate:   commit.PushDate.In(location),
+		CommitDate: commit.CommitDate.In(location),
+		Identity:   commit.Identity,
+	}
+}
+
+// CommitIndexState records how far a repository's commits have been indexed
+// for a user. All of their commits that were pushed before IndexedUntil are
+// in the index.
+type CommitIndexState struct {
+	UserId       int
+	RepoId       int       `datastore:",noindex"`
+	IndexedUntil time.Time `datastore:",noindex"`
+}
+
+type CommitIndexConfig struct {
+	// Digests are fetched entirely live if the index is disabled.
+	Disabled bool
+	// Defaults to DefaultCommitIndexLiveWindowDays.
+	LiveWindowDays int
+}
+
+// cutoff returns the time before which commits are indexed.
+func (config CommitIndexConfig) cutoff(now time.Time) time.Time {
+	liveWindowDays := config.LiveWindowDays
+	if liveWindowDays <= 0 {
+		liveWindowDays = DefaultCommitIndexLiveWindowDays
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -liveWindowDays)
+}
+
+// isCommitIndexDue returns whether the account's commit index should be
+// updated by the cron run at dispatchTime. Indexes are updated once a day,
+// with accounts spread out over the day to even out GitHub API usage.
+func isCommitIndexDue(account *Account, dispatchTime time.Time) bool {
+	if githubConfig.CommitIndex.Disabled {
+		return false
+	}
+	return (account.GitHubUserId+CommitIndexBaseHour)%24 == dispatchTime.UTC().Hour()
+}
+
+var indexCommitsFunc = newDelayedFunc("indexCommits", indexCommits)
+
+// indexCommits adds the commits that the account's user made since the last
+// time it ran (up to the live window) to their index. The first run indexes
+// their whole history.
+func indexCommits(c Context, githubUserId int) error {
+	account, err := getAccount(c, githubUserId)
+	if err != nil {
+		c.Errorf("Could not load account %d: %s. Presumed deleted, aborting indexing commits", githubUserId, err.Error())
+		return nil
+	}
+
+	oauthTransport := githubOAuthTransport(c)
+	oauthTransport.Token = &account.OAuthToken
+	githubClient := newGitHubClient(oauthTransport.Client())
+
+	user, _, err := githubClient.Users.Get("")
+	if err != nil {
+		c.Errorf("Could not look up user %d: %s", githubUserId, err.Error())
+		return err
+	}
+	repos, err := getRepos(c, githubClient, account, user)
+	if err != nil {
+		c.Errorf("Could not look up repos for %d: %s", githubUserId, err.Error())
+		return err
+	}
+	repoIds := make([]int, len(repos.AllRepos))
+	for i := range repos.AllRepos {
+		repoIds[i] = *repos.AllRepos[i].ID
+	}
+	states, err := storage.GetCommitIndexStates(c, account.GitHubUserId, repoIds)
+	if err != nil {
+		c.Errorf("Could not look up commit index states for %d: %s", githubUserId, err.Error())
+		return err
+	}
+
+	cutoff := githubConfig.CommitIndex.cutoff(time.Now())
+	pool := newGitHubWorkerPool(githubConfig.FetchParallelism)
+	for i, repo := range repos.AllRepos {
+		state := states[i]
+		if state == nil {
+			state = &CommitIndexState{UserId: account.GitHubUserId, RepoId: *repo.ID}
+		}
+		if !state.IndexedUntil.Before(cutoff) {
+			continue
+		}
+		// Repositories that haven't been pushed to since they were last
+		// indexed can't have any new commits.
+		if repo.PushedAt == nil || repo.PushedAt.Before(state.IndexedUntil) {
+			state.IndexedUntil = cutoff
+			err := storage.PutCommitIndexState(c, state)
+			if err != nil {
+				c.Errorf("Could not save commit index state for %s: %s", *repo.FullName, err.Error())
+			}
+			continue
+		}
+		repo := repo
+		pool.Go(func() {
+			// Repositories that several linked identities have access to are
+			// indexed as each of them.
+			indexedCommits := make([]IndexedCommit, 0)
+			seenSHAs := make(map[string]bool)
+			failed := false
+			for _, provider := range repo.providers {
+				commits, err := provider.ListCommits(pool, repo, state.IndexedUntil, cutoff)
+				if errorResponse, ok := err.(*github.ErrorResponse); ok && errorResponse.Response.StatusCode == 409 {
+					// GitHub returns with a 409 when a repository is empty.
+					commits, err = nil, nil
+				}
+				if err != nil {
+					// The other providers' commits are still indexed, but the
+					// state isn't updated, so that the next run tries again.
+					c.Errorf("Could not index commits for %s on %s: %s", *repo.FullName, provider.Name(), err.Error())
+					failed = true
+					continue
+				}
+				identity := ""
+				if user, err := provider.GetUser(); err == nil && user.Login != nil {
+					identity = *user.Login
+				}
+				for i := range commits {
+					if !seenSHAs[*commits[i].SHA] {
+						seenSHAs[*commits[i].SHA] = true
+						indexedCommits = append(indexedCommits, newIndexedCommit(account.GitHubUserId, repo, &commits[i], identity))
+					}
+				}
+			}
+			err := storage.PutIndexedCommits(c, indexedCommits)
+			if err == nil && !failed {
+				state.IndexedUntil = cutoff
+				err = storage.PutCommitIndexState(c, state)
+			}
+			if err != nil {
+				c.Errorf("Could not save commit index for %s: %s", *repo.FullName, err.Error())
+				return
+			}
+			c.Infof("Indexed %d commits for %s", len(indexedCommits), *repo.FullName)
+		})
+	}
+	pool.Wait()
+	return nil
+}
+
+// fetchIndexed fills in the commits of the digest's intervals that are
+// entirely covered by the commit index, and removes the corresponding
+// repositories from the intervals, so that fetch only needs to look up the
+// rest from GitHub.
+func (digest *Digest) fetchIndexed(c Context, account *Account) error {
+	if githubConfig.CommitIndex.Disabled {
+		return nil
+	}
+	repoIds := make([]int, 0)
+	seenRepoIds := make(map[int]bool)
+	for _, intervalDigest := range digest.IntervalDigests {
+		for _, repo := range intervalDigest.repos {
+			if !seenRepoIds[*repo.ID] {
+				seenRepoIds[*repo.ID] = true
+				repoIds = append(repoIds, *repo.ID)
+			}
+		}
+	}
+	states, err := storage.GetCommitIndexStates(c, account.GitHubUserId, repoIds)
+	if err != nil {
+		return err
+	}
+	indexedUntil := make(map[int]time.Time)
+	for i := range states {
+		if states[i] != nil {
+			indexedUntil[repoIds[i]] = states[i].IndexedUntil
+		}
+	}
+
+	for _, intervalDigest := range digest.IntervalDigests {
+		liveRepos := make([]*Repo, 0)
+		indexedRepos := make(map[int]*Repo)
+		for _, repo := range intervalDigest.repos {
+			if until, ok := indexedUntil[*repo.ID]; ok && !until.Before(intervalDigest.EndTime) {
+				indexedRepos[*repo.ID] = repo
+			} else {
+				liveRepos = append(liveRepos, repo)
+			}
+		}
+		if len(indexedRepos) == 0 {
+			continue
+		}
+		commits, err := storage.GetIndexedCommits(c, account.GitHubUserId,
+			intervalDigest.StartTime.UTC(), intervalDigest.EndTime.UTC())
+		if err != nil {
+			return err
+		}
+		sort.Sort(ByPushDate(commits))
+		repoDigests := make(map[int]*RepoDigest)
+		for i := range commits {
+			repo, ok := indexedRepos[commits[i].RepoId]
+			if !ok {
+				continue
+			}
+			repoDigest, ok := repoDigests[commits[i].RepoId]
+			if !ok {
+				repoDigest = &RepoDigest{repo, make([]DigestCommit, 0)}
+				repoDigests[commits[i].RepoId] = repoDigest
+				intervalDigest.RepoDigests = append(intervalDigest.RepoDigests, repoDigest)
+			}
+			digestCommit := commits[i].digestCommit(repo, digest.TimezoneLocation)
+			if !digest.showIdentities {
+				digestCommit.Identity = ""
+			}
+			repoDigest.Commits = append(repoDigest.Commits, digestCommit)
+			digest.CommitCount++
+		}
+		intervalDigest.repos = liveRepos
+	}
+	return nil
+}
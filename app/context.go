@@ -0,0 +1,11 @@
+package retrogit
+
+// Context is the subset of appengine.Context that is needed outside of
+// App Engine-specific code (mostly logging). appengine.Context values satisfy
+// it, which lets storage and other backends be swapped out.
+type Context interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
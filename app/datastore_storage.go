@@ -0,0 +1,516 @@
+//go:build appengine
+// +build appengine
+
+package retrogit
+
+import (
+	"fmt"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+func newStorage(config StorageConfig) (Storage, error) {
+	switch config.Backend {
+	case "", "datastore":
+		return &DatastoreStorage{}, nil
+	}
+	return nil, fmt.Errorf("Storage backend %s is not available on App Engine", config.Backend)
+}
+
+// Stores accounts, vintages, team subscriptions, commit indexes, webhook
+// delivery logs, API tokens and archived digests in the App Engine datastore.
+// Contexts passed to it must be appengine.Context values.
+type DatastoreStorage struct{}
+
+func (s *DatastoreStorage) accountKey(c appengine.Context, githubUserId int) *datastore.Key {
+	return datastore.NewKey(c, "Account", "", int64(githubUserId), nil)
+}
+
+func (s *DatastoreStorage) vintageKey(c appengine.Context, userId int, repoId int) *datastore.Key {
+	return datastore.NewKey(c, "RepoVintage", vintageKey(userId, repoId), 0, nil)
+}
+
+func (s *DatastoreStorage) teamSubscriptionKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "TeamSubscription", "", id, nil)
+}
+
+func (s *DatastoreStorage) indexedCommitKey(c appengine.Context, commit *IndexedCommit) *datastore.Key {
+	return datastore.NewKey(c, "IndexedCommit", indexedCommitKey(commit.UserId, commit.RepoId, commit.SHA), 0, nil)
+}
+
+func (s *DatastoreStorage) commitIndexStateKey(c appengine.Context, userId int, repoId int) *datastore.Key {
+	return datastore.NewKey(c, "CommitIndexState", commitIndexStateKey(userId, repoId), 0, nil)
+}
+
+func (s *DatastoreStorage) apiTokenKey(c appengine.Context, hash string) *datastore.Key {
+	return datastore.NewKey(c, "APIToken", hash, 0, nil)
+}
+
+func (s *DatastoreStorage) archivedDigestKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "ArchivedDigest", "", id, nil)
+}
+
+// Contents have the same ID as their digest.
+func (s *DatastoreStorage) archivedDigestContentKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "ArchivedDigestContent", "", id, nil)
+}
+
+// Webhook deliveries and payloads are in their user's entity group, so that
+// their queries are strongly consistent (e.g. when trimming the delivery log
+// right after adding to it).
+func (s *DatastoreStorage) webhookPayloadKey(c appengine.Context, githubUserId int, deliveryId string) *datastore.Key {
+	return datastore.NewKey(c, "WebhookPayload", deliveryId, 0, s.accountKey(c, githubUserId))
+}
+
+func (s *DatastoreStorage) GetAccount(c Context, githubUserId int) (*Account, error) {
+	ac := c.(appengine.Context)
+	account := new(Account)
+	err := datastore.Get(ac, s.accountKey(ac, githubUserId), account)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *DatastoreStorage) GetAllAccounts(c Context) ([]Account, error) {
+	q := datastore.NewQuery("Account")
+	var accounts []Account
+	_, err := q.GetAll(c.(appengine.Context), &accounts)
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (s *DatastoreStorage) PutAccount(c Context, account *Account) error {
+	ac := c.(appengine.Context)
+	_, err := datastore.Put(ac, s.accountKey(ac, account.GitHubUserId), account)
+	return err
+}
+
+func (s *DatastoreStorage) DeleteAccount(c Context, githubUserId int) error {
+	ac := c.(appengine.Context)
+	return datastore.Delete(ac, s.accountKey(ac, githubUserId))
+}
+
+func (s *DatastoreStorage) GetVintages(c Context, userId int, repoIds []int) ([]*RepoVintage, error) {
+	ac := c.(appengine.Context)
+	keys := make([]*datastore.Key, len(repoIds))
+	for i := range repoIds {
+		keys[i] = s.vintageKey(ac, userId, repoIds[i])
+	}
+	vintages := make([]*RepoVintage, len(repoIds))
+	for i := range vintages {
+		vintages[i] = new(RepoVintage)
+	}
+	err := datastore.GetMulti(ac, keys, vintages)
+	if err != nil {
+		if errs, ok := err.(appengine.MultiError); ok {
+			for i, err := range errs {
+				if err == datastore.ErrNoSuchEntity {
+					vintages[i] = nil
+				} else if err != nil {
+					c.Errorf("%d/%d vintage fetch error: %s", i, repoIds[i], err.Error())
+					return nil, err
+				}
+			}
+		} else {
+			return nil, err
+		}
+	}
+	return vintages, nil
+}
+
+func (s *DatastoreStorage) PutVintage(c Context, vintage *RepoVintage) error {
+	ac := c.(appengine.Context)
+	_, err := datastore.Put(ac, s.vintageKey(ac, vintage.UserId, vintage.RepoId), vintage)
+	return err
+}
+
+func (s *DatastoreStorage) DeleteVintages(c Context, userId int) error {
+	ac := c.(appengine.Context)
+	// UserId isn't indexed, but key names start with it (see vintageKey), and
+	// "." sorts right after "-".
+	keys, err := datastore.NewQuery("RepoVintage").
+		Filter("__key__ >=", datastore.NewKey(ac, "RepoVintage", fmt.Sprintf("%d-", userId), 0, nil)).
+		Filter("__key__ <", datastore.NewKey(ac, "RepoVintage", fmt.Sprintf("%d.", userId), 0, nil)).
+		KeysOnly().
+		GetAll(ac, nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += datastoreBatchSize {
+		end := start + datastoreBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err = datastore.DeleteMulti(ac, keys[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DatastoreStorage) GetTeamSubscription(c Context, id int64) (*TeamSubscription, error) {
+	ac := c.(appengine.Context)
+	subscription := new(TeamSubscription)
+	err := datastore.Get(ac, s.teamSubscriptionKey(ac, id), subscription)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrTeamSubscriptionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	subscription.Id = id
+	return subscription, nil
+}
+
+func (s *DatastoreStorage) GetTeamSubscriptionsForOwner(c Context, ownerGitHubUserId int) ([]TeamSubscription, error) {
+	q := datastore.NewQuery("TeamSubscription").Filter("OwnerGitHubUserId =", ownerGitHubUserId)
+	return s.getTeamSubscriptions(c.(appengine.Context), q)
+}
+
+func (s *DatastoreStorage) GetAllTeamSubscriptions(c Context) ([]TeamSubscription, error) {
+	return s.getTeamSubscriptions(c.(appengine.Context), datastore.NewQuery("TeamSubscription"))
+}
+
+func (s *DatastoreStorage) getTeamSubscriptions(c appengine.Context, q *datastore.Query) ([]TeamSubscription, error) {
+	var subscriptions []TeamSubscription
+	keys, err := q.GetAll(c, &subscriptions)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		subscriptions[i].Id = keys[i].IntID()
+	}
+	return subscriptions, nil
+}
+
+func (s *DatastoreStorage) PutTeamSubscription(c Context, subscription *TeamSubscription) error {
+	ac := c.(appengine.Context)
+	var key *datastore.Key
+	if subscription.Id == 0 {
+		key = datastore.NewIncompleteKey(ac, "TeamSubscription", nil)
+	} else {
+		key = s.teamSubscriptionKey(ac, subscription.Id)
+	}
+	key, err := datastore.Put(ac, key, subscription)
+	if err != nil {
+		return err
+	}
+	subscription.Id = key.IntID()
+	return nil
+}
+
+func (s *DatastoreStorage) DeleteTeamSubscription(c Context, id int64) error {
+	ac := c.(appengine.Context)
+	return datastore.Delete(ac, s.teamSubscriptionKey(ac, id))
+}
+
+// The datastore limits how many entities can be written or deleted in one
+// call.
+const datastoreBatchSize = 500
+
+func (s *DatastoreStorage) GetIndexedCommits(c Context, userId int, startTime time.Time, endTime time.Time) ([]IndexedCommit, error) {
+	q := datastore.NewQuery("IndexedCommit").
+		Filter("UserId =", userId).
+		Filter("PushDate >=", startTime).
+		Filter("PushDate <", endTime)
+	var commits []IndexedCommit
+	_, err := q.GetAll(c.(appengine.Context), &commits)
+	if err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
+
+func (s *DatastoreStorage) PutIndexedCommits(c Context, commits []IndexedCommit) error {
+	ac := c.(appengine.Context)
+	for start := 0; start < len(commits); start += datastoreBatchSize {
+		end := start + datastoreBatchSize
+		if end > len(commits) {
+			end = len(commits)
+		}
+		batch := commits[start:end]
+		keys := make([]*datastore.Key, len(batch))
+		for i := range batch {
+			keys[i] = s.indexedCommitKey(ac, &batch[i])
+		}
+		_, err := datastore.PutMulti(ac, keys, batch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DatastoreStorage) GetCommitIndexStates(c Context, userId int, repoIds []int) ([]*CommitIndexState, error) {
+	ac := c.(appengine.Context)
+	keys := make([]*datastore.Key, len(repoIds))
+	for i := range repoIds {
+		keys[i] = s.commitIndexStateKey(ac, userId, repoIds[i])
+	}
+	states := make([]*CommitIndexState, len(repoIds))
+	for i := range states {
+		states[i] = new(CommitIndexState)
+	}
+	err := datastore.GetMulti(ac, keys, states)
+	if err != nil {
+		if errs, ok := err.(appengine.MultiError); ok {
+			for i, err := range errs {
+				if err == datastore.ErrNoSuchEntity {
+					states[i] = nil
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+func (s *DatastoreStorage) PutCommitIndexState(c Context, state *CommitIndexState) error {
+	ac := c.(appengine.Context)
+	_, err := datastore.Put(ac, s.commitIndexStateKey(ac, state.UserId, state.RepoId), state)
+	return err
+}
+
+func (s *DatastoreStorage) DeleteCommitIndex(c Context, userId int) error {
+	ac := c.(appengine.Context)
+	for _, kind := range []string{"IndexedCommit", "CommitIndexState"} {
+		keys, err := datastore.NewQuery(kind).Filter("UserId =", userId).KeysOnly().GetAll(ac, nil)
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(keys); start += datastoreBatchSize {
+			end := start + datastoreBatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			err = datastore.DeleteMulti(ac, keys[start:end])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *DatastoreStorage) PutWebhookDelivery(c Context, delivery *WebhookDelivery) error {
+	ac := c.(appengine.Context)
+	parentKey := s.accountKey(ac, delivery.GitHubUserId)
+	_, err := datastore.Put(ac, datastore.NewIncompleteKey(ac, "WebhookDelivery", parentKey), delivery)
+	if err != nil {
+		return err
+	}
+	oldKeys, err := s.webhookDeliveriesQuery(ac, delivery.GitHubUserId).
+		Offset(WebhookDeliveryLogSize).
+		KeysOnly().
+		GetAll(ac, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(ac, oldKeys)
+}
+
+func (s *DatastoreStorage) GetWebhookDeliveries(c Context, githubUserId int) ([]WebhookDelivery, error) {
+	ac := c.(appengine.Context)
+	var deliveries []WebhookDelivery
+	_, err := s.webhookDeliveriesQuery(ac, githubUserId).
+		Limit(WebhookDeliveryLogSize).
+		GetAll(ac, &deliveries)
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+type datastoreWebhookPayload struct {
+	Payload []byte `datastore:",noindex"`
+}
+
+func (s *DatastoreStorage) PutWebhookPayload(c Context, githubUserId int, deliveryId string, payload []byte) error {
+	ac := c.(appengine.Context)
+	_, err := datastore.Put(ac, s.webhookPayloadKey(ac, githubUserId, deliveryId),
+		&datastoreWebhookPayload{payload})
+	return err
+}
+
+func (s *DatastoreStorage) GetWebhookPayload(c Context, githubUserId int, deliveryId string) ([]byte, error) {
+	ac := c.(appengine.Context)
+	payload := new(datastoreWebhookPayload)
+	err := datastore.Get(ac, s.webhookPayloadKey(ac, githubUserId, deliveryId), payload)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrWebhookPayloadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return payload.Payload, nil
+}
+
+func (s *DatastoreStorage) DeleteWebhookPayload(c Context, githubUserId int, deliveryId string) error {
+	ac := c.(appengine.Context)
+	err := datastore.Delete(ac, s.webhookPayloadKey(ac, githubUserId, deliveryId))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+func (s *DatastoreStorage) DeleteWebhookDeliveries(c Context, githubUserId int) error {
+	ac := c.(appengine.Context)
+	for _, kind := range []string{"WebhookDelivery", "WebhookPayload"} {
+		keys, err := datastore.NewQuery(kind).
+			Ancestor(s.accountKey(ac, githubUserId)).
+			KeysOnly().
+			GetAll(ac, nil)
+		if err != nil {
+			return err
+		}
+		err = datastore.DeleteMulti(ac, keys)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DatastoreStorage) webhookDeliveriesQuery(c appengine.Context, githubUserId int) *datastore.Query {
+	return datastore.NewQuery("WebhookDelivery").
+		Ancestor(s.accountKey(c, githubUserId)).
+		Order("-Time")
+}
+
+func (s *DatastoreStorage) GetAPIToken(c Context, hash string) (*APIToken, error) {
+	ac := c.(appengine.Context)
+	token := new(APIToken)
+	err := datastore.Get(ac, s.apiTokenKey(ac, hash), token)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrAPITokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	token.Hash = hash
+	return token, nil
+}
+
+func (s *DatastoreStorage) GetAPITokens(c Context, githubUserId int) ([]APIToken, error) {
+	var tokens []APIToken
+	keys, err := datastore.NewQuery("APIToken").
+		Filter("GitHubUserId =", githubUserId).
+		GetAll(c.(appengine.Context), &tokens)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		tokens[i].Hash = keys[i].StringID()
+	}
+	return tokens, nil
+}
+
+func (s *DatastoreStorage) PutAPIToken(c Context, token *APIToken) error {
+	ac := c.(appengine.Context)
+	_, err := datastore.Put(ac, s.apiTokenKey(ac, token.Hash), token)
+	return err
+}
+
+func (s *DatastoreStorage) DeleteAPIToken(c Context, hash string) error {
+	ac := c.(appengine.Context)
+	return datastore.Delete(ac, s.apiTokenKey(ac, hash))
+}
+
+func (s *DatastoreStorage) DeleteAPITokens(c Context, githubUserId int) error {
+	ac := c.(appengine.Context)
+	keys, err := datastore.NewQuery("APIToken").
+		Filter("GitHubUserId =", githubUserId).
+		KeysOnly().
+		GetAll(ac, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(ac, keys)
+}
+
+func (s *DatastoreStorage) PutArchivedDigest(c Context, digest *ArchivedDigest, content *ArchivedDigestContent) error {
+	ac := c.(appengine.Context)
+	key, err := datastore.Put(ac, datastore.NewIncompleteKey(ac, "ArchivedDigest", nil), digest)
+	if err != nil {
+		return err
+	}
+	digest.Id = key.IntID()
+	_, err = datastore.Put(ac, s.archivedDigestContentKey(ac, digest.Id), content)
+	return err
+}
+
+func (s *DatastoreStorage) GetArchivedDigests(c Context, githubUserId int) ([]ArchivedDigest, error) {
+	var digests []ArchivedDigest
+	keys, err := datastore.NewQuery("ArchivedDigest").
+		Filter("GitHubUserId =", githubUserId).
+		Order("-SendTime").
+		Limit(DigestHistoryLimit).
+		GetAll(c.(appengine.Context), &digests)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		digests[i].Id = keys[i].IntID()
+	}
+	return digests, nil
+}
+
+func (s *DatastoreStorage) GetArchivedDigest(c Context, githubUserId int, id int64) (*ArchivedDigest, *ArchivedDigestContent, error) {
+	ac := c.(appengine.Context)
+	digest := new(ArchivedDigest)
+	content := new(ArchivedDigestContent)
+	err := datastore.GetMulti(ac,
+		[]*datastore.Key{s.archivedDigestKey(ac, id), s.archivedDigestContentKey(ac, id)},
+		[]interface{}{digest, content})
+	if errs, ok := err.(appengine.MultiError); ok &&
+		(errs[0] == datastore.ErrNoSuchEntity || errs[1] == datastore.ErrNoSuchEntity) {
+		return nil, nil, ErrArchivedDigestNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if digest.GitHubUserId != githubUserId {
+		return nil, nil, ErrArchivedDigestNotFound
+	}
+	digest.Id = id
+	return digest, content, nil
+}
+
+func (s *DatastoreStorage) DeleteArchivedDigests(c Context, githubUserId int, before time.Time) error {
+	ac := c.(appengine.Context)
+	keys, err := datastore.NewQuery("ArchivedDigest").
+		Filter("GitHubUserId =", githubUserId).
+		Filter("SendTime <", before).
+		KeysOnly().
+		GetAll(ac, nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += datastoreBatchSize / 2 {
+		end := start + datastoreBatchSize/2
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batchKeys := make([]*datastore.Key, 0, 2*(end-start))
+		for _, key := range keys[start:end] {
+			batchKeys = append(batchKeys, key, s.archivedDigestContentKey(ac, key.IntID()))
+		}
+		if err := datastore.DeleteMulti(ac, batchKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package retrogit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Chat messages are kept short, the rest of the digest can be seen via
+	// the link to it at the end.
+	MaxChatCommitsPerRepo = 10
+	// Longer webhook responses are only used in error messages, so they're
+	// truncated.
+	maxWebhookResponseBytes = 1024
+)
+
+// DeliveryChannel is somewhere other than email that digests can be sent to.
+type DeliveryChannel interface {
+	// Name is used in logs and error messages.
+	Name() string
+	Deliver(c Context, digest *Digest) error
+}
+
+// DeliveryChannels returns the chat channels that the account's digests are
+// sent to, in addition to (or, if the email address is disabled, instead of)
+// email.
+func (account *Account) DeliveryChannels() []DeliveryChannel {
+	channels := make([]DeliveryChannel, 0)
+	if account.SlackWebhookURL != "" {
+		channels = append(channels, &SlackChannel{account.SlackWebhookURL})
+	}
+	if account.TeamsWebhookURL != "" {
+		channels = append(channels, &TeamsChannel{account.TeamsWebhookURL})
+	}
+	if webhookChannel := account.webhookChannel(); webhookChannel != nil {
+		channels = append(channels, webhookChannel)
+	}
+	return channels
+}
+
+func (account *Account) webhookChannel() *WebhookChannel {
+	if account.WebhookURL == "" {
+		return nil
+	}
+	return &WebhookChannel{account.GitHubUserId, account.WebhookURL, account.WebhookSecret}
+}
+
+// validateWebhookURL checks that a user-provided webhook URL can be posted to
+// (see validatePublicURL).
+func validateWebhookURL(webhookURL string) error {
+	if webhookURL == "" {
+		return nil
+	}
+	return validatePublicURL("Webhook", webhookURL)
+}
+
+// postWebhookPayload sends payload as JSON to an incoming webhook.
+func postWebhookPayload(c Context, webhookURL string, payload interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{Transport: newWebhookTransport(c)}
+	response, err := httpClient.Post(webhookURL, "application/json", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	responseBytes, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxWebhookResponseBytes))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned %s: %s", response.Status, bytes.TrimSpace(responseBytes))
+	}
+	return nil
+}
+
+// digestSummary is the chat equivalent of the digest email's intro.
+func digestSummary(digest *Digest) string {
+	summary := fmt.Sprintf("RetroGit digest for %s: %d %s", *digest.User.Login, digest.CommitCount,
+		pluralize(digest.CommitCount, "commit", "commits"))
+	if digest.ActivityCount > 0 {
+		summary += fmt.Sprintf(" and %d other %s", digest.ActivityCount,
+			pluralize(digest.ActivityCount, "contribution", "contributions"))
+	}
+	return summary + " from years past."
+}
+
+func pluralize(count int, singular string, plural string) string {
+	if count == 1 {
+		return singular
+	}
+	return plural
+}
+
+// chatDisplayDate returns the date to show for a commit or other activity
+// in an interval, without the zero-width spaces that safeFormattedDate adds
+// (chat clients don't do date detection).
+func chatDisplayDate(intervalDigest *IntervalDigest, displayDate string, weeklyDisplayDate string) string {
+	date := displayDate
+	if intervalDigest.Weekly || intervalDigest.Monthly {
+		date = weeklyDisplayDate
+	}
+	return unsafeFormattedText(date)
+}
+
+// unsafeFormattedText undoes safeFormattedDate.
+func unsafeFormattedText(text string) string {
+	return strings.Replace(text, "\u200b", "", -1)
+}
+
+// chatActivitySection is a group of pull requests, issues or reviews, in the
+// form that chat channels render them.
+type chatActivitySection struct {
+	Title string
+	Items []chatActivityItem
+}
+
+type chatActivityItem struct {
+	Action string
+	Label  string
+	URL    string
+	Title  string
+	Date   string
+}
+
+func chatActivitySections(intervalDigest *IntervalDigest) []chatActivitySection {
+	sections := make([]chatActivitySection, 0)
+	for _, issuesSection := range []struct {
+		title  string
+		issues []DigestIssue
+	}{
+		{"Pull Requests", intervalDigest.PullRequests},
+		{"Issues", intervalDigest.Issues},
+	} {
+		if len(issuesSection.issues) == 0 {
+			continue
+		}
+		section := chatActivitySection{Title: issuesSection.title}
+		for _, issue := range issuesSection.issues {
+			section.Items = append(section.Items, chatActivityItem{
+				Action: issue.Action,
+				Label:  fmt.Sprintf("%s#%d", issue.RepoFullName, issue.Number),
+				URL:    issue.URL,
+				Title:  issue.Title,
+				Date:   chatDisplayDate(intervalDigest, issue.DisplayDate(), issue.WeeklyDisplayDate()),
+			})
+		}
+		sections = append(sections, section)
+	}
+	if len(intervalDigest.Reviews) > 0 {
+		section := chatActivitySection{Title: "Code Reviews"}
+		for _, review := range intervalDigest.Reviews {
+			section.Items = append(section.Items, chatActivityItem{
+				Action: review.Action,
+				Label:  fmt.Sprintf("%s#%d", review.RepoFullName, review.Number),
+				URL:    review.URL,
+				Title:  review.Title,
+				Date:   chatDisplayDate(intervalDigest, review.DisplayDate(), review.WeeklyDisplayDate()),
+			})
+		}
+		sections = append(sections, section)
+	}
+	return sections
+}
+
+func viewDigestURL() string {
+	url, err := router.Get("view-digest").URL()
+	if err != nil {
+		return baseUrl()
+	}
+	return baseUrl() + url.String()
+}
@@ -0,0 +1,430 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/go-github/github"
+)
+
+// webhookServer is a stand-in for Slack, Teams or a webhook receiver that
+// responds with the next of its status codes, and records the requests.
+type webhookServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mutex.Lock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, body)
+		status := s.statuses[0]
+		if len(s.statuses) > 1 {
+			s.statuses = s.statuses[1:]
+		}
+		s.mutex.Unlock()
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			w.Write([]byte("no_service"))
+		}
+	}))
+	return s
+}
+
+func (s *webhookServer) requestCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.bodies)
+}
+
+// useDevelopmentServer makes local (plain HTTP) stand-ins usable as webhooks,
+// and sets up the globals that delivery needs. The returned function undoes
+// it.
+func useDevelopmentServer(t *testing.T) (*fakeClock, func()) {
+	dir, err := ioutil.TempDir("", "retrogit-delivery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newBoltStorage(filepath.Join(dir, "retrogit.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	originalServerConfig, originalStorage, originalJobQueue := serverConfig, storage, jobQueue
+	clock := &fakeClock{time: time.Now()}
+	serverConfig.Development = true
+	serverConfig.BaseUrl = "http://localhost:8080"
+	storage = store
+	jobQueue = newJobQueue(store, clock.now)
+	if router == nil {
+		router = initRouter()
+	}
+	return clock, func() {
+		serverConfig, storage, jobQueue = originalServerConfig, originalStorage, originalJobQueue
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestDigest() *Digest {
+	userId, login := 1, "octocat"
+	repoId, repoFullName, repoURL := 2, "octocat/hello-world", "https://github.com/octocat/hello-world"
+	repo := &Repo{Repository: &github.Repository{ID: &repoId, FullName: &repoFullName, HTMLURL: &repoURL}}
+	pushDate := time.Date(2014, time.March, 4, 12, 0, 0, 0, time.UTC)
+	return &Digest{
+		User:             &github.User{ID: &userId, Login: &login},
+		TimezoneLocation: time.UTC,
+		CommitCount:      1,
+		IntervalDigests: []*IntervalDigest{{
+			yearDelta: -1,
+			StartTime: pushDate.Truncate(time.Hour * 24),
+			EndTime:   pushDate.Truncate(time.Hour * 24).Add(time.Hour * 24),
+			RepoDigests: []*RepoDigest{{
+				Repo: repo,
+				Commits: []DigestCommit{{
+					SHA:        "0123456789abcdef0123456789abcdef01234567",
+					DisplaySHA: "0123456",
+					URL:        repoURL + "/commit/0123456789abcdef0123456789abcdef01234567",
+					Title:      "Fix *all* the <bugs>",
+					PushDate:   pushDate,
+					CommitDate: pushDate,
+				}},
+			}},
+		}},
+	}
+}
+
+func TestSlackChannelDeliver(t *testing.T) {
+	_, cleanup := useDevelopmentServer(t)
+	defer cleanup()
+	server := newWebhookServer(http.StatusOK)
+	defer server.Close()
+
+	err := (&SlackChannel{server.URL}).Deliver(&logContext{}, newTestDigest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.requestCount() != 1 {
+		t.Fatalf("Expected 1 request, got %d", server.requestCount())
+	}
+	if contentType := server.requests[0].Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Unexpected content type %s", contentType)
+	}
+	var message slackMessage
+	err = json.Unmarshal(server.bodies[0], &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(message.Text, "1 commit from years past") {
+		t.Errorf("Unexpected notification text %q", message.Text)
+	}
+	if repoBlock := message.Blocks[3]; repoBlock.Text == nil || !strings.Contains(repoBlock.Text.Text, "Fix *all* the &lt;bugs&gt;") {
+		t.Errorf("Commit title was not escaped in %v", repoBlock)
+	}
+	if lastBlock := message.Blocks[len(message.Blocks)-1]; !strings.Contains(lastBlock.Elements[0].Text, "<http://localhost:8080/digest/view|") {
+		t.Errorf("Last block doesn't link to the digest: %v", lastBlock)
+	}
+}
+
+func TestSlackChannelDeliverError(t *testing.T) {
+	_, cleanup := useDevelopmentServer(t)
+	defer cleanup()
+	server := newWebhookServer(http.StatusNotFound)
+	defer server.Close()
+
+	err := (&SlackChannel{server.URL}).Deliver(&logContext{}, newTestDigest())
+	if err == nil || !strings.Contains(err.Error(), "no_service") {
+		t.Errorf("Expected an error with the response body, got %v", err)
+	}
+}
+
+func TestTeamsChannelDeliver(t *testing.T) {
+	_, cleanup := useDevelopmentServer(t)
+	defer cleanup()
+	server := newWebhookServer(http.StatusOK)
+	defer server.Close()
+
+	err := (&TeamsChannel{server.URL}).Deliver(&logContext{}, newTestDigest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.requestCount() != 1 {
+		t.Fatalf("Expected 1 request, got %d", server.requestCount())
+	}
+	var message teamsMessage
+	err = json.Unmarshal(server.bodies[0], &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(message.Attachments) != 1 || message.Attachments[0].ContentType != "application/vnd.microsoft.card.adaptive" {
+		t.Fatalf("Unexpected attachments %v", message.Attachments)
+	}
+	card := message.Attachments[0].Content
+	if card.Type != "AdaptiveCard" || card.Version != AdaptiveCardVersion {
+		t.Errorf("Unexpected card type %s and version %s", card.Type, card.Version)
+	}
+	if !strings.Contains(string(server.bodies[0]), `Fix \\*all\\* the`) {
+		t.Errorf("Commit title was not escaped in %s", server.bodies[0])
+	}
+	if len(card.Actions) != 1 || card.Actions[0].URL != "http://localhost:8080/digest/view" {
+		t.Errorf("Unexpected actions %v", card.Actions)
+	}
+}
+
+func TestWebhookChannelDeliverIsSigned(t *testing.T) {
+	_, cleanup := useDevelopmentServer(t)
+	defer cleanup()
+	server := newWebhookServer(http.StatusOK)
+	defer server.Close()
+
+	channel := &WebhookChannel{GitHubUserId: 1, URL: server.URL, Secret: "secret"}
+	err := channel.Deliver(&logContext{}, newTestDigest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.requestCount() != 1 {
+		t.Fatalf("Expected 1 request, got %d", server.requestCount())
+	}
+	request := server.requests[0]
+	if signature := request.Header.Get(WebhookSignatureHeader); signature != signWebhookPayload("secret", server.bodies[0]) {
+		t.Errorf("Unexpected signature %s", signature)
+	}
+	if event := request.Header.Get(WebhookEventHeader); event != "digest" {
+		t.Errorf("Unexpected event %s", event)
+	}
+	var digestJSON DigestJSON
+	err = json.Unmarshal(server.bodies[0], &digestJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digestJSON.CommitCount != 1 || digestJSON.User.Login != "octocat" {
+		t.Errorf("Unexpected payload %s", server.bodies[0])
+	}
+
+	deliveries, err := storage.GetWebhookDeliveries(&logContext{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || !deliveries[0].Succeeded() ||
+		deliveries[0].Id != request.Header.Get(WebhookDeliveryHeader) {
+		t.Errorf("Unexpected delivery log %v", deliveries)
+	}
+}
+
+func TestWebhookChannelDeliverRetries(t *testing.T) {
+	clock, cleanup := useDevelopmentServer(t)
+	defer cleanup()
+	server := newWebhookServer(http.StatusInternalServerError, http.StatusOK)
+	defer server.Close()
+	c := &logContext{}
+
+	account := &Account{GitHubUserId: 1, WebhookURL: server.URL, WebhookSecret: "secret"}
+	err := account.Put(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Failures are retried, instead of being returned.
+	err = account.webhookChannel().Deliver(c, newTestDigest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.requestCount() != 1 {
+		t.Fatalf("Expected 1 request, got %d", server.requestCount())
+	}
+
+	deliveryId := server.requests[0].Header.Get(WebhookDeliveryHeader)
+	if payload, err := storage.GetWebhookPayload(c, 1, deliveryId); err != nil || string(payload) != string(server.bodies[0]) {
+		t.Errorf("Payload was not kept for the retry: %v", err)
+	}
+
+	clock.advance(InitialWebhookRetryDelay - time.Second)
+	jobQueue.RunPending(c)
+	if server.requestCount() != 1 {
+		t.Fatalf("Retried before the delay, got %d requests", server.requestCount())
+	}
+	clock.advance(time.Second)
+	jobQueue.RunPending(c)
+	if server.requestCount() != 2 {
+		t.Fatalf("Expected a retry, got %d requests", server.requestCount())
+	}
+	if string(server.bodies[1]) != string(server.bodies[0]) {
+		t.Errorf("Retried payload %s differs from the original %s", server.bodies[1], server.bodies[0])
+	}
+	if server.requests[1].Header.Get(WebhookDeliveryHeader) != deliveryId {
+		t.Errorf("Retry has a different delivery ID")
+	}
+	if _, err := storage.GetWebhookPayload(c, 1, deliveryId); err != ErrWebhookPayloadNotFound {
+		t.Errorf("Payload was not deleted after the delivery succeeded: %v", err)
+	}
+
+	deliveries, err := storage.GetWebhookDeliveries(c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("Expected 2 logged deliveries, got %v", deliveries)
+	}
+	for _, delivery := range deliveries {
+		if delivery.Attempt == 1 && (delivery.Succeeded() || delivery.StatusCode != http.StatusInternalServerError) {
+			t.Errorf("First attempt should have failed: %v", delivery)
+		} else if delivery.Attempt == 2 && !delivery.Succeeded() {
+			t.Errorf("Second attempt should have succeeded: %v", delivery)
+		}
+	}
+}
+
+// recordingMailer is a Mailer that keeps the messages that it's asked to send.
+type recordingMailer struct {
+	mutex    sync.Mutex
+	messages []*MailMessage
+}
+
+func (m *recordingMailer) Send(c Context, message *MailMessage) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+func TestDeliverDigestDoesNotRetryChannelErrors(t *testing.T) {
+	_, cleanup := useDevelopmentServer(t)
+	defer cleanup()
+	server := newWebhookServer(http.StatusInternalServerError)
+	defer server.Close()
+	originalMailer, originalTemplates, originalTextTemplates := mailer, templates, textTemplates
+	defer func() { mailer, templates, textTemplates = originalMailer, originalTemplates, originalTextTemplates }()
+	testMailer := &recordingMailer{}
+	mailer = testMailer
+	templates = loadTemplates()
+	textTemplates = loadTextTemplates()
+	c := &logContext{}
+
+	account := &Account{
+		GitHubUserId:      1,
+		SlackWebhookURL:   server.URL,
+		DigestArchiveDays: DefaultDigestArchiveDays,
+	}
+	// Returning the Slack error would make the task queue send the digest
+	// (including the email) again.
+	err := deliverDigest(c, account, "octocat@example.com", true, account.DeliveryChannels(), newTestDigest())
+	if err != nil {
+		t.Fatalf("Channel error was returned: %s", err.Error())
+	}
+	if len(testMailer.messages) != 1 {
+		t.Errorf("Expected 1 email, got %d", len(testMailer.messages))
+	}
+	if server.requestCount() != 1 {
+		t.Errorf("Expected 1 Slack request, got %d", server.requestCount())
+	}
+
+	archivedDigests, err := storage.GetArchivedDigests(c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archivedDigests) != 1 {
+		t.Fatalf("Expected 1 archived digest, got %d", len(archivedDigests))
+	}
+	archivedDigest := archivedDigests[0]
+	if len(archivedDigest.DeliveredTo) != 1 || archivedDigest.DeliveredTo[0] != "email" {
+		t.Errorf("Unexpected destinations %v", archivedDigest.DeliveredTo)
+	}
+	if !strings.Contains(archivedDigest.Error, "no_service") {
+		t.Errorf("Slack error was not archived: %q", archivedDigest.Error)
+	}
+}
+
+func TestWebhookURLsMustBePublic(t *testing.T) {
+	_, cleanup := useDevelopmentServer(t)
+	defer cleanup()
+	server := newWebhookServer(http.StatusOK)
+	defer server.Close()
+	serverConfig.Development = false
+
+	for _, webhookURL := range []string{
+		"http://hooks.example.com/",
+		"https://127.0.0.1/",
+		"https://10.1.2.3:8443/",
+		"https://169.254.169.254/latest/meta-data/",
+		"https://[::1]/",
+		"https://[::ffff:192.168.0.1]/",
+	} {
+		if validateWebhookURL(webhookURL) == nil {
+			t.Errorf("%s was allowed", webhookURL)
+		}
+	}
+	if validateWebhookURL("https://8.8.8.8/") != nil {
+		t.Errorf("Public address was not allowed")
+	}
+
+	// Connections are checked too, in case the URL was saved before (or its
+	// host resolves differently now).
+	err := (&SlackChannel{server.URL}).Deliver(&logContext{}, newTestDigest())
+	if err == nil {
+		t.Error("Webhook on a loopback address was posted to")
+	}
+	if server.requestCount() != 0 {
+		t.Errorf("Expected no requests, got %d", server.requestCount())
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for address, expected := range map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"0.0.0.0":         false,
+		"127.0.0.1":       false,
+		"172.20.0.1":      false,
+		"192.168.1.1":     false,
+		"100.64.0.1":      false,
+		"169.254.169.254": false,
+		"::":              false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+	} {
+		if isPublicIP(net.ParseIP(address)) != expected {
+			t.Errorf("isPublicIP(%s) != %v", address, expected)
+		}
+	}
+}
+
+func TestSlackSectionBlockTruncation(t *testing.T) {
+	// A single long line of multi-byte characters, which can't be cut at a
+	// newline.
+	text := strings.Repeat("é", maxSlackSectionTextSize)
+	block := slackSectionBlock(text)
+	if len(block.Text.Text) > maxSlackSectionTextSize {
+		t.Errorf("Text is %d bytes long", len(block.Text.Text))
+	}
+	if !utf8.ValidString(block.Text.Text) {
+		t.Errorf("Text was cut in the middle of a character")
+	}
+	if !strings.HasSuffix(block.Text.Text, "é…") {
+		t.Errorf("Text doesn't end with an ellipsis")
+	}
+
+	// Lines are kept whole if possible.
+	line := strings.Repeat("x", 99) + "\n"
+	block = slackSectionBlock(strings.Repeat(line, maxSlackSectionTextSize/len(line)+1))
+	if !strings.HasSuffix(block.Text.Text, "x\n…") {
+		t.Errorf("Text was not cut at a newline")
+	}
+}
@@ -2,13 +2,12 @@ package retrogit
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
 	"time"
 
-	"appengine"
-
 	"github.com/google/go-github/github"
 )
 
@@ -18,17 +17,29 @@ const (
 	DigestDisplayDateFormat      = "January 2, 2006"
 	DigestDisplayShortDateFormat = "January 2"
 	DigestDisplayDayOfWeekFormat = "Monday"
+	DigestDisplayMonthFormat     = "January 2006"
 )
 
 type DigestCommit struct {
+	SHA        string
 	DisplaySHA string
 	URL        string
 	Title      string
 	Message    string
 	PushDate   time.Time
 	CommitDate time.Time
+	// Login of the identity that the commit was made as, only set if the
+	// account has linked identities.
+	Identity string
 }
 
+// sort.Interface implementation for sorting DigestCommits, oldest first.
+type DigestCommitsByPushDate []DigestCommit
+
+func (a DigestCommitsByPushDate) Len() int           { return len(a) }
+func (a DigestCommitsByPushDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a DigestCommitsByPushDate) Less(i, j int) bool { return a[i].PushDate.Before(a[j].PushDate) }
+
 func safeFormattedDate(date string) string {
 	// Insert zero-width spaces every few characters so that Apple Data
 	// Detectors and Gmail's calendar event dection don't pick up on these
@@ -49,15 +60,11 @@ func safeFormattedDate(date string) string {
 }
 
 func newDigestCommit(commit *github.RepositoryCommit, repo *Repo, location *time.Location) DigestCommit {
-	messagePieces := strings.SplitN(*commit.Commit.Message, "\n", 2)
-	title := messagePieces[0]
-	message := ""
-	if len(messagePieces) == 2 {
-		message = messagePieces[1]
-	}
+	title, message := splitCommitMessage(*commit.Commit.Message)
 	return DigestCommit{
+		SHA:        *commit.SHA,
 		DisplaySHA: (*commit.SHA)[:7],
-		URL:        fmt.Sprintf("https://github.com/%s/commit/%s", *repo.FullName, *commit.SHA),
+		URL:        commitURL(repo, *commit.SHA),
 		Title:      title,
 		Message:    message,
 		PushDate:   commit.Commit.Committer.Date.In(location),
@@ -65,6 +72,20 @@ func newDigestCommit(commit *github.RepositoryCommit, repo *Repo, location *time
 	}
 }
 
+// splitCommitMessage returns the first line of a commit message (its title)
+// and the rest of it.
+func splitCommitMessage(commitMessage string) (string, string) {
+	messagePieces := strings.SplitN(commitMessage, "\n", 2)
+	if len(messagePieces) == 2 {
+		return messagePieces[0], messagePieces[1]
+	}
+	return messagePieces[0], ""
+}
+
+func commitURL(repo *Repo, sha string) string {
+	return repo.provider().CommitURL(repo, sha)
+}
+
 func (commit DigestCommit) DisplayDate() string {
 	// Prefer the date the commit was pushed, since that's what GitHub filters
 	// and sorts by.
@@ -88,6 +109,19 @@ type RepoDigest struct {
 	Commits []DigestCommit
 }
 
+// addCommit adds the commit to the digest, unless it's already there (e.g.
+// because it was also made as another linked identity). It returns whether the
+// commit was added.
+func (repoDigest *RepoDigest) addCommit(commit DigestCommit) bool {
+	for i := range repoDigest.Commits {
+		if repoDigest.Commits[i].SHA == commit.SHA {
+			return false
+		}
+	}
+	repoDigest.Commits = append(repoDigest.Commits, commit)
+	return true
+}
+
 // sort.Interface implementation for sorting RepoDigests.
 type ByRepoFullName []*RepoDigest
 
@@ -100,8 +134,13 @@ type IntervalDigest struct {
 	StartTime   time.Time
 	EndTime     time.Time
 	Weekly      bool
+	Monthly     bool
 	RepoDigests []*RepoDigest
-	repos       []*Repo
+	// Only filled in if the account has opted into them.
+	PullRequests []DigestIssue
+	Issues       []DigestIssue
+	Reviews      []DigestReview
+	repos        []*Repo
 }
 
 func (digest *IntervalDigest) Empty() bool {
@@ -110,14 +149,30 @@ func (digest *IntervalDigest) Empty() bool {
 			return false
 		}
 	}
-	return true
+	return len(digest.PullRequests) == 0 && len(digest.Issues) == 0 && len(digest.Reviews) == 0
+}
+
+// providerRepos returns the repositories of the interval that still need to
+// be fetched from provider.
+func (digest *IntervalDigest) providerRepos(provider Provider) []*Repo {
+	repos := make([]*Repo, 0)
+	for _, repo := range digest.repos {
+		if repo.hasProvider(provider) {
+			repos = append(repos, repo)
+		}
+	}
+	return repos
 }
 
 func (digest *IntervalDigest) Header() string {
-	if digest.yearDelta == -1 {
+	return intervalHeader(digest.yearDelta)
+}
+
+func intervalHeader(yearDelta int) string {
+	if yearDelta == -1 {
 		return "1 Year Ago"
 	}
-	return fmt.Sprintf("%d Years Ago", -digest.yearDelta)
+	return fmt.Sprintf("%d Years Ago", -yearDelta)
 }
 
 func (digest *IntervalDigest) Description() string {
@@ -125,6 +180,13 @@ func (digest *IntervalDigest) Description() string {
 	for i := range digest.RepoDigests {
 		commitCount += len(digest.RepoDigests[i].Commits)
 	}
+	return describeInterval("You", digest.StartTime, digest.EndTime, digest.Weekly, digest.Monthly,
+		commitCount, len(digest.RepoDigests))
+}
+
+// describeInterval summarizes the activity in a digest interval. subject is
+// who the commits were made by (e.g. "You").
+func describeInterval(subject string, startTime time.Time, endTime time.Time, weekly bool, monthly bool, commitCount int, repoCount int) string {
 	var formattedCommitCount string
 	if commitCount == 0 {
 		formattedCommitCount = "no commits"
@@ -133,30 +195,41 @@ func (digest *IntervalDigest) Description() string {
 	} else {
 		formattedCommitCount = fmt.Sprintf("%d commits", commitCount)
 	}
-	repoCount := len(digest.RepoDigests)
 	var formattedRepoCount string
-	if repoCount == 1 {
+	if repoCount == 0 {
+		formattedRepoCount = "any repositories"
+	} else if repoCount == 1 {
 		formattedRepoCount = "1 repository"
 	} else {
 		formattedRepoCount = fmt.Sprintf("%d repositories", repoCount)
 	}
 
-	if !digest.Weekly {
-		return fmt.Sprintf("%s was a %s. You had %s in %s that day.",
-			safeFormattedDate(digest.StartTime.Format(DigestDisplayDateFormat)),
-			safeFormattedDate(digest.StartTime.Format(DigestDisplayDayOfWeekFormat)),
+	if monthly {
+		return fmt.Sprintf("%s had %s in %s in %s.",
+			subject,
+			formattedCommitCount,
+			formattedRepoCount,
+			safeFormattedDate(startTime.Format(DigestDisplayMonthFormat)))
+	}
+
+	if !weekly {
+		return fmt.Sprintf("%s was a %s. %s had %s in %s that day.",
+			safeFormattedDate(startTime.Format(DigestDisplayDateFormat)),
+			safeFormattedDate(startTime.Format(DigestDisplayDayOfWeekFormat)),
+			subject,
 			formattedCommitCount,
 			formattedRepoCount)
 	}
 
-	formattedEndTime := digest.EndTime.Format(DigestDisplayDateFormat)
+	formattedEndTime := endTime.Format(DigestDisplayDateFormat)
 	var formattedStartTime string
-	if digest.StartTime.Year() == digest.EndTime.Year() {
-		formattedStartTime = digest.StartTime.Format(DigestDisplayShortDateFormat)
+	if startTime.Year() == endTime.Year() {
+		formattedStartTime = startTime.Format(DigestDisplayShortDateFormat)
 	} else {
-		formattedStartTime = digest.StartTime.Format(DigestDisplayDateFormat)
+		formattedStartTime = startTime.Format(DigestDisplayDateFormat)
 	}
-	return fmt.Sprintf("You had %s in %s the week of %s to %s.",
+	return fmt.Sprintf("%s had %s in %s the week of %s to %s.",
+		subject,
 		formattedCommitCount,
 		formattedRepoCount,
 		safeFormattedDate(formattedStartTime),
@@ -168,11 +241,35 @@ type Digest struct {
 	TimezoneLocation *time.Location
 	IntervalDigests  []*IntervalDigest
 	CommitCount      int
-	RepoErrors       map[string]error
+	// Number of pull requests, issues and reviews.
+	ActivityCount  int
+	RepoErrors     map[string]error
+	RepoErrorURLs  map[string]string
+	ActivityErrors map[string]error
+	// Whether commits are labeled with the identity they were made as.
+	showIdentities bool
 }
 
-func newDigest(c appengine.Context, githubClient *github.Client, account *Account) (*Digest, error) {
-	user, _, err := githubClient.Users.Get("")
+// ErrDigestDateTooEarly is returned by newDigestForDate for dates before the
+// account's oldest repository.
+var ErrDigestDateTooEarly = errors.New("Digest date is before the oldest repository")
+
+func newDigest(c Context, githubClient *github.Client, account *Account) (*Digest, error) {
+	return newDigestForDate(c, githubClient, account, time.Now(), account.Frequency)
+}
+
+// newDigestForDate returns the digest with the given frequency that would be
+// sent on date's day (in the account's timezone), i.e. the one for that day
+// (or the week starting on it, or its month) in previous years. githubClient
+// may be nil, for digests of only the account's local repositories.
+func newDigestForDate(c Context, githubClient *github.Client, account *Account, date time.Time, frequency string) (*Digest, error) {
+	providers := account.Providers(c, githubClient, nil)
+	if len(providers) == 0 {
+		return nil, errors.New("No sources of repositories")
+	}
+	// The digest is for the user of the first provider, i.e. GitHub's unless
+	// it's offline.
+	user, err := providers[0].GetUser()
 	if err != nil {
 		return nil, err
 	}
@@ -183,18 +280,16 @@ func newDigest(c appengine.Context, githubClient *github.Client, account *Accoun
 	}
 
 	oldestDigestTime := repos.OldestVintage.In(account.TimezoneLocation)
+	if date.Before(startOfDay(oldestDigestTime)) {
+		return nil, ErrDigestDateTooEarly
+	}
 	intervalDigests := make([]*IntervalDigest, 0)
-	now := time.Now().In(account.TimezoneLocation)
+	now := date.In(account.TimezoneLocation)
 	for yearDelta := -1; ; yearDelta-- {
-		digestStartTime := time.Date(now.Year()+yearDelta, now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-		if digestStartTime.Before(oldestDigestTime) {
+		digestStartTime, digestEndTime := digestIntervalTimes(now, frequency, yearDelta)
+		if !digestEndTime.After(oldestDigestTime) {
 			break
 		}
-		daysInDigest := 1
-		if account.Frequency == "weekly" {
-			daysInDigest = 7
-		}
-		digestEndTime := digestStartTime.AddDate(0, 0, daysInDigest)
 
 		// Only look at repos that may have activity in the digest interval.
 		var intervalRepos []*Repo
@@ -211,7 +306,8 @@ func newDigest(c appengine.Context, githubClient *github.Client, account *Accoun
 			RepoDigests: make([]*RepoDigest, 0, len(intervalRepos)),
 			StartTime:   digestStartTime,
 			EndTime:     digestEndTime,
-			Weekly:      account.Frequency == "weekly",
+			Weekly:      frequency == "weekly",
+			Monthly:     frequency == "monthly",
 		})
 	}
 
@@ -221,74 +317,101 @@ func newDigest(c appengine.Context, githubClient *github.Client, account *Accoun
 		IntervalDigests:  intervalDigests,
 		CommitCount:      0,
 		RepoErrors:       make(map[string]error),
+		RepoErrorURLs:    make(map[string]string),
+		ActivityErrors:   make(map[string]error),
+		showIdentities:   len(account.LinkedIdentities) > 0,
 	}
 
-	digest.fetch(githubClient)
+	// Done first, since fetch drops empty intervals.
+	if githubClient != nil {
+		digest.fetchActivity(githubClient, account, repos)
+	}
+	err = digest.fetchIndexed(c, account)
+	if err != nil {
+		// Everything that wasn't read from the index is fetched live instead.
+		c.Errorf("Error reading commit index: %s", err.Error())
+	}
+	digest.fetch()
 	for repoFullName, err := range digest.RepoErrors {
 		c.Errorf("Error fetching %s: %s", repoFullName, err.Error())
 	}
+	for section, err := range digest.ActivityErrors {
+		c.Errorf("Error fetching %s: %s", section, err.Error())
+	}
 	return digest, nil
 }
 
-func (digest *Digest) fetch(githubClient *github.Client) {
-	type RepoDigestResponse struct {
-		intervalDigest *IntervalDigest
-		repo           *Repo
-		repoDigest     *RepoDigest
-		err            error
+// digestIntervalTimes returns the start and end of the interval that's
+// yearDelta years before now, for the given digest frequency.
+func digestIntervalTimes(now time.Time, frequency string, yearDelta int) (time.Time, time.Time) {
+	if frequency == "monthly" {
+		// Monthly digests cover the whole calendar month, regardless of which
+		// day of it they're sent on.
+		startTime := time.Date(now.Year()+yearDelta, now.Month(), 1, 0, 0, 0, 0, now.Location())
+		return startTime, startTime.AddDate(0, 1, 0)
+	}
+	startTime := time.Date(now.Year()+yearDelta, now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	daysInDigest := 1
+	if frequency == "weekly" {
+		daysInDigest = 7
 	}
-	fetchCount := 0
-	ch := make(chan *RepoDigestResponse)
+	return startTime, startTime.AddDate(0, 0, daysInDigest)
+}
+
+// fetch looks up the commits of the repositories that weren't read from the
+// commit index, from each of their providers. Repositories with several
+// providers (i.e. that linked identities share) get one RepoDigest with all of
+// their commits.
+func (digest *Digest) fetch() {
+	providers := make([]Provider, 0)
+	seenProviders := make(map[Provider]bool)
 	for _, intervalDigest := range digest.IntervalDigests {
 		for _, repo := range intervalDigest.repos {
-			go func(intervalDigest *IntervalDigest, repo *Repo) {
-				commits := make([]github.RepositoryCommit, 0)
-				page := 1
-				for {
-					pageCommits, response, err := githubClient.Repositories.ListCommits(
-						*repo.Owner.Login,
-						*repo.Name,
-						&github.CommitsListOptions{
-							ListOptions: github.ListOptions{
-								Page:    page,
-								PerPage: 100,
-							},
-							Author: *digest.User.Login,
-							Since:  intervalDigest.StartTime.UTC(),
-							Until:  intervalDigest.EndTime.UTC(),
-						})
-					if err != nil {
-						ch <- &RepoDigestResponse{intervalDigest, repo, nil, err}
-						return
-					}
-					commits = append(commits, pageCommits...)
-					if response.NextPage == 0 {
-						break
-					}
-					page = response.NextPage
+			for _, provider := range repo.providers {
+				if !seenProviders[provider] {
+					seenProviders[provider] = true
+					providers = append(providers, provider)
 				}
-				digestCommits := make([]DigestCommit, len(commits))
-				for i := range commits {
-					digestCommits[len(commits)-i-1] = newDigestCommit(&commits[i], repo, digest.TimezoneLocation)
-				}
-				ch <- &RepoDigestResponse{intervalDigest, repo, &RepoDigest{repo, digestCommits}, nil}
-			}(intervalDigest, repo)
-			fetchCount++
+			}
 		}
 	}
-	for i := 0; i < fetchCount; i++ {
-		select {
-		case r := <-ch:
-			if r.err != nil {
-				digest.RepoErrors[*r.repo.FullName] = r.err
-				continue
-			}
-			if len(r.repoDigest.Commits) > 0 {
-				r.intervalDigest.RepoDigests = append(r.intervalDigest.RepoDigests, r.repoDigest)
-				digest.CommitCount += len(r.repoDigest.Commits)
+	results := make([]*IntervalRepoCommits, 0)
+	for _, provider := range providers {
+		results = append(results, commitFetcher.FetchCommits(provider, digest)...)
+	}
+	repoDigests := make(map[*IntervalDigest]map[*Repo]*RepoDigest)
+	for _, r := range results {
+		if r.err != nil {
+			digest.RepoErrors[*r.repo.FullName] = r.err
+			digest.RepoErrorURLs[*r.repo.FullName] = *r.repo.HTMLURL
+			continue
+		}
+		if len(r.commits) == 0 {
+			continue
+		}
+		if repoDigests[r.intervalDigest] == nil {
+			repoDigests[r.intervalDigest] = make(map[*Repo]*RepoDigest)
+		}
+		repoDigest, ok := repoDigests[r.intervalDigest][r.repo]
+		if !ok {
+			repoDigest = &RepoDigest{r.repo, make([]DigestCommit, 0, len(r.commits))}
+			repoDigests[r.intervalDigest][r.repo] = repoDigest
+			r.intervalDigest.RepoDigests = append(r.intervalDigest.RepoDigests, repoDigest)
+		}
+		identity := digest.identity(r.provider)
+		for i := len(r.commits) - 1; i >= 0; i-- {
+			commit := newDigestCommit(&r.commits[i], r.repo, digest.TimezoneLocation)
+			commit.Identity = identity
+			if repoDigest.addCommit(commit) {
+				digest.CommitCount++
 			}
 		}
 	}
+	for _, intervalRepoDigests := range repoDigests {
+		for _, repoDigest := range intervalRepoDigests {
+			sort.Stable(DigestCommitsByPushDate(repoDigest.Commits))
+		}
+	}
 	nonEmptyIntervalDigests := make([]*IntervalDigest, 0, len(digest.IntervalDigests))
 	for _, intervalDigest := range digest.IntervalDigests {
 		if !intervalDigest.Empty() {
@@ -299,6 +422,55 @@ func (digest *Digest) fetch(githubClient *github.Client) {
 	digest.IntervalDigests = nonEmptyIntervalDigests
 }
 
+// listIntervalCommits returns all of the commits pushed to repo between
+// startTime and endTime, newest first, by all users. Requests are made via
+// pool, so that they respect rate limits.
+func listIntervalCommits(githubClient *github.Client, pool *GitHubWorkerPool, repo *Repo, startTime time.Time, endTime time.Time) ([]github.RepositoryCommit, error) {
+	commits := make([]github.RepositoryCommit, 0)
+	page := 1
+	for {
+		var pageCommits []github.RepositoryCommit
+		var response *github.Response
+		err := pool.Call(func() (*github.Response, error) {
+			var err error
+			pageCommits, response, err = githubClient.Repositories.ListCommits(
+				*repo.Owner.Login,
+				*repo.Name,
+				&github.CommitsListOptions{
+					ListOptions: github.ListOptions{
+						Page:    page,
+						PerPage: 100,
+					},
+					Since: startTime.UTC(),
+					Until: endTime.UTC(),
+				})
+			return response, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, pageCommits...)
+		if response.NextPage == 0 {
+			break
+		}
+		page = response.NextPage
+	}
+	return commits, nil
+}
+
+// identity returns the login that commits read via provider are labeled with,
+// or an empty string if they shouldn't be.
+func (digest *Digest) identity(provider Provider) string {
+	if !digest.showIdentities || provider == nil {
+		return ""
+	}
+	user, err := provider.GetUser()
+	if err != nil || user.Login == nil {
+		return ""
+	}
+	return *user.Login
+}
+
 func (digest *Digest) Empty() bool {
 	return len(digest.IntervalDigests) == 0
 }
@@ -310,11 +482,25 @@ func (digest *Digest) Redact() {
 			*repoDigest.Repo.FullName = "redacted/redacted"
 			for i := range repoDigest.Commits {
 				commit := &repoDigest.Commits[i]
+				commit.SHA = "0000000000000000000000000000000000000000"
 				commit.DisplaySHA = "0000000"
 				commit.URL = "https://redacted"
 				commit.Title = "Redacted"
 				commit.Message = "Redacted redacted redacted"
 			}
 		}
+		for _, issues := range [][]DigestIssue{intervalDigest.PullRequests, intervalDigest.Issues} {
+			for i := range issues {
+				issues[i].RepoFullName = "redacted/redacted"
+				issues[i].URL = "https://redacted"
+				issues[i].Title = "Redacted"
+			}
+		}
+		for i := range intervalDigest.Reviews {
+			review := &intervalDigest.Reviews[i]
+			review.RepoFullName = "redacted/redacted"
+			review.URL = "https://redacted"
+			review.Title = "Redacted"
+		}
 	}
 }
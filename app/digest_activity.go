@@ -0,0 +1,356 @@
+package retrogit
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	// GitHub's search API accepts ISO 8601 timestamps in qualifier ranges.
+	SearchDateFormat = "2006-01-02T15:04:05Z"
+	// Searches are made one at a time, since the search API has a much lower
+	// rate limit (30 requests a minute) than the rest of the API.
+	SearchParallelism = 1
+)
+
+// DigestIssue is an issue or pull request that the user opened or closed
+// during a digest interval.
+type DigestIssue struct {
+	RepoFullName string
+	Number       int
+	Title        string
+	URL          string
+	// "opened", "merged" or "closed".
+	Action string
+	Date   time.Time
+}
+
+func newDigestIssue(issue *github.Issue, action string, date time.Time, location *time.Location) DigestIssue {
+	return DigestIssue{
+		RepoFullName: issueRepoFullName(issue),
+		Number:       *issue.Number,
+		Title:        *issue.Title,
+		URL:          *issue.HTMLURL,
+		Action:       action,
+		Date:         date.In(location),
+	}
+}
+
+func (issue DigestIssue) DisplayDate() string {
+	return safeFormattedDate(issue.Date.Format(CommitDisplayDateFormat))
+}
+
+func (issue DigestIssue) WeeklyDisplayDate() string {
+	return safeFormattedDate(issue.Date.Format(CommitDisplayDateFullFormat))
+}
+
+// sort.Interface implementation for sorting DigestIssues chronologically.
+type DigestIssuesByDate []DigestIssue
+
+func (a DigestIssuesByDate) Len() int           { return len(a) }
+func (a DigestIssuesByDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a DigestIssuesByDate) Less(i, j int) bool { return a[i].Date.Before(a[j].Date) }
+
+// DigestReview is a review that the user submitted on someone else's pull
+// request during a digest interval. If there were several, only the last one
+// is kept.
+type DigestReview struct {
+	RepoFullName string
+	Number       int
+	Title        string
+	URL          string
+	// "approved", "requested changes on" or "commented on".
+	Action string
+	Date   time.Time
+}
+
+func (review DigestReview) DisplayDate() string {
+	return safeFormattedDate(review.Date.Format(CommitDisplayDateFormat))
+}
+
+func (review DigestReview) WeeklyDisplayDate() string {
+	return safeFormattedDate(review.Date.Format(CommitDisplayDateFullFormat))
+}
+
+// sort.Interface implementation for sorting DigestReviews chronologically.
+type DigestReviewsByDate []DigestReview
+
+func (a DigestReviewsByDate) Len() int           { return len(a) }
+func (a DigestReviewsByDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a DigestReviewsByDate) Less(i, j int) bool { return a[i].Date.Before(a[j].Date) }
+
+// Subset of the pull request review API response. The version of go-github
+// that we use predates reviews, so they're fetched via a raw request.
+type pullRequestReview struct {
+	User        *github.User `json:"user,omitempty"`
+	State       *string      `json:"state,omitempty"`
+	SubmittedAt *time.Time   `json:"submitted_at,omitempty"`
+}
+
+var reviewStateActions = map[string]string{
+	"APPROVED":          "approved",
+	"CHANGES_REQUESTED": "requested changes on",
+	"COMMENTED":         "commented on",
+}
+
+type activitySearch struct {
+	section string
+	query   string
+	action  string
+	// Whether the issue's closing time (instead of its creation time) is when
+	// the action happened.
+	closed bool
+}
+
+// fetchActivity fills in the pull requests, issues and reviews of each interval
+// (depending on which ones the account wants). Only activity in repositories
+// that are included in the digest is kept, so intervals from before any of
+// them existed are skipped. Searches go through their own pool, so that they
+// respect the search API's rate limit.
+func (digest *Digest) fetchActivity(githubClient *github.Client, account *Account, repos *Repos) {
+	if !account.IncludePullRequests && !account.IncludeIssues && !account.IncludeReviews {
+		return
+	}
+	includedRepos := make([]*Repo, 0)
+	includedRepoFullNames := make(map[string]bool)
+	for _, repo := range repos.AllRepos {
+		if repo.IncludeInDigest {
+			includedRepos = append(includedRepos, repo)
+			includedRepoFullNames[*repo.FullName] = true
+		}
+	}
+	login := *digest.User.Login
+
+	searchPool := newGitHubWorkerPool(SearchParallelism)
+	pool := newGitHubWorkerPool(githubConfig.FetchParallelism)
+	var errorsMutex sync.Mutex
+	recordError := func(section string, err error) {
+		errorsMutex.Lock()
+		digest.ActivityErrors[section] = err
+		errorsMutex.Unlock()
+	}
+	for _, intervalDigest := range digest.IntervalDigests {
+		if !hasRepoBefore(includedRepos, intervalDigest.EndTime) {
+			continue
+		}
+		intervalDigest := intervalDigest
+		searchPool.Go(func() {
+			interval := searchDateRange(intervalDigest.StartTime, intervalDigest.EndTime)
+			searches := make([]activitySearch, 0, 4)
+			if account.IncludePullRequests {
+				searches = append(searches,
+					activitySearch{"pull requests", fmt.Sprintf("type:pr author:%s created:%s", login, interval), "opened", false},
+					activitySearch{"pull requests", fmt.Sprintf("type:pr author:%s merged:%s", login, interval), "merged", true})
+			}
+			if account.IncludeIssues {
+				searches = append(searches,
+					activitySearch{"issues", fmt.Sprintf("type:issue author:%s created:%s", login, interval), "opened", false},
+					activitySearch{"issues", fmt.Sprintf("type:issue author:%s closed:%s", login, interval), "closed", true})
+			}
+			for _, search := range searches {
+				issues, err := searchIssues(githubClient, searchPool, search.query)
+				if err != nil {
+					recordError(search.section, err)
+					continue
+				}
+				for i := range issues {
+					issue := &issues[i]
+					if !includedRepoFullNames[issueRepoFullName(issue)] {
+						continue
+					}
+					date := *issue.CreatedAt
+					if search.closed {
+						if issue.ClosedAt == nil {
+							continue
+						}
+						date = *issue.ClosedAt
+					}
+					digestIssue := newDigestIssue(issue, search.action, date, digest.TimezoneLocation)
+					if issue.PullRequestLinks != nil {
+						intervalDigest.PullRequests = append(intervalDigest.PullRequests, digestIssue)
+					} else {
+						intervalDigest.Issues = append(intervalDigest.Issues, digestIssue)
+					}
+				}
+			}
+			sort.Sort(DigestIssuesByDate(intervalDigest.PullRequests))
+			sort.Sort(DigestIssuesByDate(intervalDigest.Issues))
+
+			if account.IncludeReviews {
+				reviews, err := digest.fetchReviews(githubClient, searchPool, pool, intervalDigest, includedRepoFullNames)
+				if err != nil {
+					recordError("reviews", err)
+				}
+				intervalDigest.Reviews = reviews
+			}
+		})
+	}
+	searchPool.Wait()
+
+	for _, intervalDigest := range digest.IntervalDigests {
+		digest.ActivityCount += len(intervalDigest.PullRequests) +
+			len(intervalDigest.Issues) + len(intervalDigest.Reviews)
+	}
+}
+
+// hasRepoBefore returns whether any of the repositories existed before
+// endTime.
+func hasRepoBefore(repos []*Repo, endTime time.Time) bool {
+	for _, repo := range repos {
+		if repo.Vintage.Before(endTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchReviews finds the reviews that the user submitted during the interval.
+// The search is made via searchPool, and the reviews of its results via pool.
+func (digest *Digest) fetchReviews(githubClient *github.Client, searchPool *GitHubWorkerPool, pool *GitHubWorkerPool, intervalDigest *IntervalDigest, includedRepoFullNames map[string]bool) ([]DigestReview, error) {
+	login := *digest.User.Login
+	// A review submitted during the interval means that the pull request was
+	// created before the interval ended, and last updated after it started.
+	// Search can't filter by when reviews were submitted, so the candidates'
+	// reviews are then checked one by one.
+	query := fmt.Sprintf("type:pr reviewed-by:%s -author:%s created:<%s updated:>=%s",
+		login,
+		login,
+		intervalDigest.EndTime.UTC().Format(SearchDateFormat),
+		intervalDigest.StartTime.UTC().Format(SearchDateFormat))
+	pullRequests, err := searchIssues(githubClient, searchPool, query)
+	if err != nil {
+		return nil, err
+	}
+	reviews := make([]DigestReview, 0)
+	for i := range pullRequests {
+		pullRequest := &pullRequests[i]
+		repoFullName := issueRepoFullName(pullRequest)
+		if !includedRepoFullNames[repoFullName] {
+			continue
+		}
+		pullRequestReviews, err := listPullRequestReviews(githubClient, pool, repoFullName, *pullRequest.Number)
+		if err != nil {
+			return nil, err
+		}
+		var lastReview *pullRequestReview
+		for j := range pullRequestReviews {
+			review := &pullRequestReviews[j]
+			if review.User == nil || review.User.Login == nil || *review.User.Login != login ||
+				review.State == nil || review.SubmittedAt == nil {
+				continue
+			}
+			if _, ok := reviewStateActions[*review.State]; !ok {
+				continue
+			}
+			if review.SubmittedAt.Before(intervalDigest.StartTime) ||
+				!review.SubmittedAt.Before(intervalDigest.EndTime) {
+				continue
+			}
+			if lastReview == nil || review.SubmittedAt.After(*lastReview.SubmittedAt) {
+				lastReview = review
+			}
+		}
+		if lastReview == nil {
+			continue
+		}
+		reviews = append(reviews, DigestReview{
+			RepoFullName: repoFullName,
+			Number:       *pullRequest.Number,
+			Title:        *pullRequest.Title,
+			URL:          *pullRequest.HTMLURL,
+			Action:       reviewStateActions[*lastReview.State],
+			Date:         lastReview.SubmittedAt.In(digest.TimezoneLocation),
+		})
+	}
+	sort.Sort(DigestReviewsByDate(reviews))
+	return reviews, nil
+}
+
+func listPullRequestReviews(githubClient *github.Client, pool *GitHubWorkerPool, repoFullName string, number int) ([]pullRequestReview, error) {
+	reviews := make([]pullRequestReview, 0)
+	page := 1
+	for {
+		var pageReviews []pullRequestReview
+		var response *github.Response
+		err := pool.Call(func() (*github.Response, error) {
+			req, err := githubClient.NewRequest(
+				"GET",
+				fmt.Sprintf("repos/%s/pulls/%d/reviews?per_page=100&page=%d", repoFullName, number, page),
+				nil)
+			if err != nil {
+				return nil, err
+			}
+			response, err = githubClient.Do(req, &pageReviews)
+			return response, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, pageReviews...)
+		if response.NextPage == 0 {
+			break
+		}
+		page = response.NextPage
+	}
+	return reviews, nil
+}
+
+func searchDateRange(startTime time.Time, endTime time.Time) string {
+	// Ranges are inclusive, so stop just short of the end time.
+	return fmt.Sprintf("%s..%s",
+		startTime.UTC().Format(SearchDateFormat),
+		endTime.Add(-time.Second).UTC().Format(SearchDateFormat))
+}
+
+func searchIssues(githubClient *github.Client, pool *GitHubWorkerPool, query string) ([]github.Issue, error) {
+	issues := make([]github.Issue, 0)
+	page := 1
+	for {
+		var result *github.IssuesSearchResult
+		var response *github.Response
+		err := pool.Call(func() (*github.Response, error) {
+			var err error
+			result, response, err = githubClient.Search.Issues(
+				query,
+				&github.SearchOptions{
+					ListOptions: github.ListOptions{
+						Page:    page,
+						PerPage: 100,
+					},
+				})
+			return response, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, result.Issues...)
+		if response.NextPage == 0 {
+			break
+		}
+		page = response.NextPage
+	}
+	return issues, nil
+}
+
+// issueRepoFullName extracts the owner/name of the repository that an issue
+// belongs to from its URL, since search results don't include the repository.
+func issueRepoFullName(issue *github.Issue) string {
+	if issue.HTMLURL == nil {
+		return ""
+	}
+	issueUrl, err := url.Parse(*issue.HTMLURL)
+	if err != nil {
+		return ""
+	}
+	pathPieces := strings.SplitN(strings.TrimPrefix(issueUrl.Path, "/"), "/", 3)
+	if len(pathPieces) < 2 {
+		return ""
+	}
+	return pathPieces[0] + "/" + pathPieces[1]
+}
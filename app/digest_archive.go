@@ -0,0 +1,237 @@
+package retrogit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Accounts that were created before the retention could be chosen don't
+	// have it set, and get this.
+	DefaultDigestArchiveDays = 90
+	// DigestArchiveDays value for keeping sent digests indefinitely (0 means
+	// that they're not kept at all).
+	DigestArchiveForever = -1
+	// How many sent digests are listed on the history page.
+	DigestHistoryLimit = 400
+)
+
+// ArchivedDigest records a digest that was sent. Its rendered content is
+// stored separately (as ArchivedDigestContent), so that the history can be
+// listed without loading it.
+type ArchivedDigest struct {
+	Id           int64 `datastore:"-"`
+	GitHubUserId int
+	SendTime     time.Time
+	Frequency    string `datastore:",noindex"`
+	CommitCount  int    `datastore:",noindex"`
+	// Number of pull requests, issues and reviews.
+	ActivityCount int `datastore:",noindex"`
+	// Names of the destinations (email and DeliveryChannels) that the digest
+	// was delivered to.
+	DeliveredTo []string `datastore:",noindex"`
+	// The first delivery error, if any.
+	Error string `datastore:",noindex"`
+}
+
+// ArchivedDigestContent is the digest as it was sent, both as the HTML email
+// and as DigestJSON. Both are gzipped, since digests can be large.
+type ArchivedDigestContent struct {
+	HTML []byte `datastore:",noindex"`
+	JSON []byte `datastore:",noindex"`
+}
+
+func (digest *ArchivedDigest) Succeeded() bool {
+	return digest.Error == ""
+}
+
+func (digest *ArchivedDigest) DisplaySendTime(location *time.Location) string {
+	return digest.SendTime.In(location).Format("Monday January 2, 2006 3:04pm")
+}
+
+func (digest *ArchivedDigest) DisplayDeliveredTo() string {
+	if len(digest.DeliveredTo) == 0 {
+		return "nowhere"
+	}
+	return strings.Join(digest.DeliveredTo, ", ")
+}
+
+// DigestArchiveCutoff returns the send time before which the account's
+// archived digests should be deleted, or the zero time if they should all be
+// kept.
+func (account *Account) DigestArchiveCutoff(now time.Time) time.Time {
+	if account.DigestArchiveDays == DigestArchiveForever {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, -account.DigestArchiveDays)
+}
+
+// archiveDigest stores a digest that was just sent, along with the outcome of
+// its delivery, and removes the ones that are past the account's retention
+// period. Errors are only logged, since they shouldn't cause the digest to be
+// sent again.
+func archiveDigest(c Context, account *Account, digest *Digest, deliveredTo []string, deliveryErr error) {
+	if account.DigestArchiveDays == 0 {
+		return
+	}
+	now := time.Now()
+	archivedDigest := &ArchivedDigest{
+		GitHubUserId:  account.GitHubUserId,
+		SendTime:      now,
+		Frequency:     account.Frequency,
+		CommitCount:   digest.CommitCount,
+		ActivityCount: digest.ActivityCount,
+		DeliveredTo:   deliveredTo,
+	}
+	if deliveryErr != nil {
+		archivedDigest.Error = deliveryErr.Error()
+	}
+	content, err := newArchivedDigestContent(digest)
+	if err != nil {
+		c.Errorf("  Could not render digest for archiving: %s", err.Error())
+		return
+	}
+	err = storage.PutArchivedDigest(c, archivedDigest, content)
+	if err != nil {
+		c.Errorf("  Could not archive digest: %s", err.Error())
+		return
+	}
+	if cutoff := account.DigestArchiveCutoff(now); !cutoff.IsZero() {
+		err = storage.DeleteArchivedDigests(c, account.GitHubUserId, cutoff)
+		if err != nil {
+			c.Errorf("  Could not delete old archived digests: %s", err.Error())
+		}
+	}
+}
+
+func newArchivedDigestContent(digest *Digest) (*ArchivedDigestContent, error) {
+	var digestHtml bytes.Buffer
+	data := map[string]interface{}{
+		"Digest": digest,
+	}
+	if err := templates["digest-email"].Execute(&digestHtml, data); err != nil {
+		return nil, err
+	}
+	digestJSON, err := json.Marshal(newDigestJSON(digest))
+	if err != nil {
+		return nil, err
+	}
+	content := &ArchivedDigestContent{}
+	content.HTML, err = gzipBytes(digestHtml.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	content.JSON, err = gzipBytes(digestJSON)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func digestArchiveDaysOptions() []map[string]interface{} {
+	options := make([]map[string]interface{}, 0)
+	for _, option := range []struct {
+		days  int
+		label string
+	}{
+		{0, "Don't keep them"},
+		{30, "30 days"},
+		{90, "90 days"},
+		{365, "1 year"},
+		{DigestArchiveForever, "Forever"},
+	} {
+		options = append(options, map[string]interface{}{
+			"Days":  option.days,
+			"Label": option.label,
+		})
+	}
+	return options
+}
+
+func (account *Account) DisplayDigestArchiveDays() string {
+	for _, option := range digestArchiveDaysOptions() {
+		if option["Days"] == account.DigestArchiveDays {
+			return option["Label"].(string)
+		}
+	}
+	return strconv.Itoa(account.DigestArchiveDays) + " days"
+}
+
+func digestHistoryHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	c := newContext(r)
+	archivedDigests, err := storage.GetArchivedDigests(c, state.Account.GitHubUserId)
+	if err != nil {
+		return InternalError(err, "Could not look up digest history")
+	}
+	var data = map[string]interface{}{
+		"Account":         state.Account,
+		"ArchivedDigests": archivedDigests,
+	}
+	return templates["digest-history"].Render(w, data, state)
+}
+
+// viewArchivedDigestHandler shows a sent digest as it was emailed, or (with a
+// format=json parameter) in its structured form.
+func viewArchivedDigestHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return BadRequest(err, "Malformed id value")
+	}
+	c := newContext(r)
+	archivedDigest, content, err := storage.GetArchivedDigest(c, state.Account.GitHubUserId, id)
+	if err == ErrArchivedDigestNotFound {
+		return BadRequest(err, "id does not point to a sent digest")
+	}
+	if err != nil {
+		return InternalError(err, "Could not look up sent digest")
+	}
+
+	if r.FormValue("format") == "json" {
+		digestJSON, err := gunzipBytes(content.JSON)
+		if err != nil {
+			return InternalError(err, "Could not read sent digest")
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(digestJSON)
+		return nil
+	}
+	digestHtml, err := gunzipBytes(content.HTML)
+	if err != nil {
+		return InternalError(err, "Could not read sent digest")
+	}
+	var data = map[string]interface{}{
+		"Account":        state.Account,
+		"ArchivedDigest": archivedDigest,
+		// Rendered by the digest-email template, so it's already escaped.
+		"DigestHTML": template.HTML(digestHtml),
+	}
+	return templates["archived-digest-page"].Render(w, data, state)
+}
@@ -0,0 +1,149 @@
+package retrogit
+
+import (
+	"time"
+)
+
+// DigestJSON is the structured form of a Digest that is sent to webhooks.
+// Field names follow the conventions of GitHub's API.
+type DigestJSON struct {
+	User            *DigestUserJSON       `json:"user"`
+	Timezone        string                `json:"timezone"`
+	CommitCount     int                   `json:"commit_count"`
+	ActivityCount   int                   `json:"activity_count"`
+	IntervalDigests []*IntervalDigestJSON `json:"interval_digests"`
+	RepoErrors      map[string]string     `json:"repo_errors"`
+	ActivityErrors  map[string]string     `json:"activity_errors"`
+}
+
+type DigestUserJSON struct {
+	Id    int    `json:"id"`
+	Login string `json:"login"`
+}
+
+type IntervalDigestJSON struct {
+	Header       string               `json:"header"`
+	Description  string               `json:"description"`
+	StartTime    time.Time            `json:"start_time"`
+	EndTime      time.Time            `json:"end_time"`
+	Frequency    string               `json:"frequency"`
+	RepoDigests  []*RepoDigestJSON    `json:"repo_digests"`
+	PullRequests []DigestActivityJSON `json:"pull_requests"`
+	Issues       []DigestActivityJSON `json:"issues"`
+	Reviews      []DigestActivityJSON `json:"reviews"`
+}
+
+type RepoDigestJSON struct {
+	Id       int                `json:"id"`
+	FullName string             `json:"full_name"`
+	URL      string             `json:"html_url"`
+	Private  bool               `json:"private"`
+	Commits  []DigestCommitJSON `json:"commits"`
+}
+
+type DigestCommitJSON struct {
+	SHA        string    `json:"sha"`
+	URL        string    `json:"html_url"`
+	Title      string    `json:"title"`
+	Message    string    `json:"message"`
+	PushDate   time.Time `json:"push_date"`
+	CommitDate time.Time `json:"commit_date"`
+	Identity   string    `json:"identity,omitempty"`
+}
+
+type DigestActivityJSON struct {
+	RepoFullName string    `json:"repo_full_name"`
+	Number       int       `json:"number"`
+	Title        string    `json:"title"`
+	URL          string    `json:"html_url"`
+	Action       string    `json:"action"`
+	Date         time.Time `json:"date"`
+}
+
+func newDigestJSON(digest *Digest) *DigestJSON {
+	digestJSON := &DigestJSON{
+		User: &DigestUserJSON{
+			Id:    *digest.User.ID,
+			Login: *digest.User.Login,
+		},
+		Timezone:        digest.TimezoneLocation.String(),
+		CommitCount:     digest.CommitCount,
+		ActivityCount:   digest.ActivityCount,
+		IntervalDigests: make([]*IntervalDigestJSON, len(digest.IntervalDigests)),
+		RepoErrors:      make(map[string]string),
+		ActivityErrors:  make(map[string]string),
+	}
+	for repoFullName, err := range digest.RepoErrors {
+		digestJSON.RepoErrors[repoFullName] = err.Error()
+	}
+	for section, err := range digest.ActivityErrors {
+		digestJSON.ActivityErrors[section] = err.Error()
+	}
+	for i, intervalDigest := range digest.IntervalDigests {
+		frequency := "daily"
+		if intervalDigest.Weekly {
+			frequency = "weekly"
+		} else if intervalDigest.Monthly {
+			frequency = "monthly"
+		}
+		intervalDigestJSON := &IntervalDigestJSON{
+			Header:       intervalDigest.Header(),
+			Description:  unsafeFormattedText(intervalDigest.Description()),
+			StartTime:    intervalDigest.StartTime,
+			EndTime:      intervalDigest.EndTime,
+			Frequency:    frequency,
+			RepoDigests:  make([]*RepoDigestJSON, len(intervalDigest.RepoDigests)),
+			PullRequests: newDigestIssuesJSON(intervalDigest.PullRequests),
+			Issues:       newDigestIssuesJSON(intervalDigest.Issues),
+			Reviews:      make([]DigestActivityJSON, len(intervalDigest.Reviews)),
+		}
+		for j, repoDigest := range intervalDigest.RepoDigests {
+			repoDigestJSON := &RepoDigestJSON{
+				Id:       *repoDigest.Repo.ID,
+				FullName: *repoDigest.Repo.FullName,
+				URL:      *repoDigest.Repo.HTMLURL,
+				Private:  repoDigest.Repo.Private != nil && *repoDigest.Repo.Private,
+				Commits:  make([]DigestCommitJSON, len(repoDigest.Commits)),
+			}
+			for k, commit := range repoDigest.Commits {
+				repoDigestJSON.Commits[k] = DigestCommitJSON{
+					SHA:        commit.SHA,
+					URL:        commit.URL,
+					Title:      commit.Title,
+					Message:    commit.Message,
+					PushDate:   commit.PushDate,
+					CommitDate: commit.CommitDate,
+					Identity:   commit.Identity,
+				}
+			}
+			intervalDigestJSON.RepoDigests[j] = repoDigestJSON
+		}
+		for j, review := range intervalDigest.Reviews {
+			intervalDigestJSON.Reviews[j] = DigestActivityJSON{
+				RepoFullName: review.RepoFullName,
+				Number:       review.Number,
+				Title:        review.Title,
+				URL:          review.URL,
+				Action:       review.Action,
+				Date:         review.Date,
+			}
+		}
+		digestJSON.IntervalDigests[i] = intervalDigestJSON
+	}
+	return digestJSON
+}
+
+func newDigestIssuesJSON(issues []DigestIssue) []DigestActivityJSON {
+	issuesJSON := make([]DigestActivityJSON, len(issues))
+	for i, issue := range issues {
+		issuesJSON[i] = DigestActivityJSON{
+			RepoFullName: issue.RepoFullName,
+			Number:       issue.Number,
+			Title:        issue.Title,
+			URL:          issue.URL,
+			Action:       issue.Action,
+			Date:         issue.Date,
+		}
+	}
+	return issuesJSON
+}
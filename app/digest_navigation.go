@@ -0,0 +1,203 @@
+package retrogit
+
+import (
+	"net/http"
+	"time"
+)
+
+// Format of the date parameter of the digest page and API.
+const DigestDateParameterFormat = "2006-01-02"
+
+var DigestFrequencies = []string{"daily", "weekly", "monthly"}
+
+// parseDigestParameters reads the optional date and frequency parameters that
+// pick which digest to show. They default to today (in the account's
+// timezone) and the account's frequency. Future dates are rejected, since
+// their digests would have an interval for every year since the account's
+// oldest repository (dates before that are rejected by newDigestForDate).
+func parseDigestParameters(r *http.Request, account *Account) (time.Time, string, *AppError) {
+	now := time.Now().In(account.TimezoneLocation)
+	date := now
+	if dateParameter := r.FormValue("date"); dateParameter != "" {
+		var err error
+		date, err = time.ParseInLocation(DigestDateParameterFormat, dateParameter, account.TimezoneLocation)
+		if err != nil {
+			return time.Time{}, "", BadRequest(err, "Malformed date value")
+		}
+		if date.After(now) {
+			return time.Time{}, "", BadRequest(nil, "Date is in the future")
+		}
+	}
+	frequency := account.Frequency
+	if frequencyParameter := r.FormValue("frequency"); frequencyParameter != "" {
+		frequency = ""
+		for _, digestFrequency := range DigestFrequencies {
+			if frequencyParameter == digestFrequency {
+				frequency = digestFrequency
+			}
+		}
+		if frequency == "" {
+			return time.Time{}, "", BadRequest(nil, "Malformed frequency value")
+		}
+	}
+	return date, frequency, nil
+}
+
+// DigestNavigation is the calendar on the digest page, for picking the date
+// whose digest is shown.
+type DigestNavigation struct {
+	// Midnight on the day whose digest is shown.
+	Date      time.Time
+	Frequency string
+	Today     time.Time
+}
+
+type DigestCalendarDay struct {
+	Day int
+	URL string
+	// Whether the day is in the month being shown (calendars start and end
+	// with the days of the adjacent weeks).
+	InMonth bool
+	// Whether the day is covered by the digest being shown.
+	InDigest bool
+	IsToday  bool
+}
+
+func newDigestNavigation(date time.Time, frequency string) *DigestNavigation {
+	now := time.Now().In(date.Location())
+	return &DigestNavigation{
+		Date:      startOfDay(date),
+		Frequency: frequency,
+		Today:     startOfDay(now),
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// url returns the digest page URL for the date, or the empty string if the
+// date is in the future (see parseDigestParameters).
+func (navigation *DigestNavigation) url(date time.Time, frequency string) string {
+	if date.After(navigation.Today) {
+		return ""
+	}
+	url, err := router.Get("view-digest").URL()
+	if err != nil {
+		return ""
+	}
+	query := url.Query()
+	query.Set("date", date.Format(DigestDateParameterFormat))
+	query.Set("frequency", frequency)
+	url.RawQuery = query.Encode()
+	return url.String()
+}
+
+func (navigation *DigestNavigation) DateParameter() string {
+	return navigation.Date.Format(DigestDateParameterFormat)
+}
+
+func (navigation *DigestNavigation) DisplayDate() string {
+	if navigation.Frequency == "monthly" {
+		return navigation.Date.Format(DigestDisplayMonthFormat)
+	}
+	if navigation.Frequency == "weekly" {
+		return "Week of " + navigation.Date.Format(DigestDisplayDateFormat)
+	}
+	return navigation.Date.Format(DigestDisplayDateFormat)
+}
+
+func (navigation *DigestNavigation) TodayParameter() string {
+	return navigation.Today.Format(DigestDateParameterFormat)
+}
+
+func (navigation *DigestNavigation) IsToday() bool {
+	return navigation.Date.Equal(navigation.Today)
+}
+
+func (navigation *DigestNavigation) TodayURL() string {
+	return navigation.url(navigation.Today, navigation.Frequency)
+}
+
+// step returns the date of the previous (direction -1) or next (direction 1)
+// digest with the same frequency.
+func (navigation *DigestNavigation) step(direction int) time.Time {
+	switch navigation.Frequency {
+	case "weekly":
+		return navigation.Date.AddDate(0, 0, 7*direction)
+	case "monthly":
+		return addMonths(navigation.Date, direction)
+	}
+	return navigation.Date.AddDate(0, 0, direction)
+}
+
+func (navigation *DigestNavigation) PreviousURL() string {
+	return navigation.url(navigation.step(-1), navigation.Frequency)
+}
+
+func (navigation *DigestNavigation) NextURL() string {
+	return navigation.url(navigation.step(1), navigation.Frequency)
+}
+
+func (navigation *DigestNavigation) StepLabel() string {
+	switch navigation.Frequency {
+	case "weekly":
+		return "week"
+	case "monthly":
+		return "month"
+	}
+	return "day"
+}
+
+func (navigation *DigestNavigation) MonthLabel() string {
+	return navigation.Date.Format(DigestDisplayMonthFormat)
+}
+
+func (navigation *DigestNavigation) PreviousMonthURL() string {
+	return navigation.url(addMonths(navigation.Date, -1), navigation.Frequency)
+}
+
+func (navigation *DigestNavigation) NextMonthURL() string {
+	date := addMonths(navigation.Date, 1)
+	// The rest of the current month can still be navigated to.
+	if date.After(navigation.Today) && date.Month() == navigation.Today.Month() && date.Year() == navigation.Today.Year() {
+		date = navigation.Today
+	}
+	return navigation.url(date, navigation.Frequency)
+}
+
+// addMonths is like AddDate(0, months, 0), except that it uses the last day of
+// the month if the target month is shorter, instead of overflowing into the
+// next one (e.g. January 31 + 1 month is February 28, not March 3).
+func addMonths(t time.Time, months int) time.Time {
+	monthStart := time.Date(t.Year(), t.Month()+time.Month(months), 1, 0, 0, 0, 0, t.Location())
+	day := t.Day()
+	if lastDay := monthStart.AddDate(0, 1, -1).Day(); day > lastDay {
+		day = lastDay
+	}
+	return time.Date(monthStart.Year(), monthStart.Month(), day, 0, 0, 0, 0, t.Location())
+}
+
+// Weeks returns the days of the calendar for the month of the shown date, in
+// rows that start on Sunday.
+func (navigation *DigestNavigation) Weeks() [][]DigestCalendarDay {
+	digestStart, digestEnd := digestIntervalTimes(navigation.Date, navigation.Frequency, 0)
+	monthStart := time.Date(navigation.Date.Year(), navigation.Date.Month(), 1, 0, 0, 0, 0, navigation.Date.Location())
+	day := monthStart.AddDate(0, 0, -int(monthStart.Weekday()))
+	weeks := make([][]DigestCalendarDay, 0, 6)
+	for day.Before(monthStart.AddDate(0, 1, 0)) {
+		week := make([]DigestCalendarDay, 7)
+		for i := range week {
+			week[i] = DigestCalendarDay{
+				Day:      day.Day(),
+				URL:      navigation.url(day, navigation.Frequency),
+				InMonth:  day.Month() == monthStart.Month(),
+				InDigest: !day.Before(digestStart) && day.Before(digestEnd),
+				IsToday:  day.Equal(navigation.Today),
+			}
+			day = day.AddDate(0, 0, 1)
+		}
+		weeks = append(weeks, week)
+	}
+	return weeks
+}
@@ -0,0 +1,173 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.google.com/p/goauth2/oauth"
+	"github.com/google/go-github/github"
+)
+
+var DigestOutputFormats = []string{"html", "text", "json"}
+
+type DigestOptions struct {
+	// GitHub personal access token that the digest is fetched with. Optional
+	// if there are LocalRepositoryGlobs, in which case the digest is generated
+	// offline.
+	Token string
+	// Paths of local repositories to include (see LocalGitProvider), and the
+	// author emails of the user's commits in them.
+	LocalRepositoryGlobs []string
+	AuthorEmails         []string
+	// Defaults to the same one as accounts that haven't set theirs.
+	TimezoneName string
+	// One of DigestFrequencies, defaults to daily.
+	Frequency string
+	// Day whose digest is generated (in DigestDateParameterFormat), defaults
+	// to today in the timezone.
+	Date string
+	// One of DigestOutputFormats, defaults to html.
+	Format              string
+	ExcludedRepoIds     []int
+	IncludePullRequests bool
+	IncludeIssues       bool
+	IncludeReviews      bool
+}
+
+// WriteDigest generates the digest for a GitHub token and/or local
+// repositories without needing an account or a running server, and writes it
+// to w as the HTML or plain text email, or as the JSON webhook payload. Like
+// ListenAndServe, it must be called with the app directory as the working
+// directory.
+func WriteDigest(w io.Writer, options DigestOptions) error {
+	if options.Token == "" && len(options.LocalRepositoryGlobs) == 0 {
+		return fmt.Errorf("A GitHub token or local repositories are required")
+	}
+	for _, glob := range options.LocalRepositoryGlobs {
+		err := validateLocalRepositoryGlob(glob)
+		if err != nil {
+			return err
+		}
+	}
+	if len(options.LocalRepositoryGlobs) > 0 && len(options.AuthorEmails) == 0 {
+		return fmt.Errorf("Author emails are required for local repositories")
+	}
+	format := options.Format
+	if format == "" {
+		format = "html"
+	}
+	isKnownFormat := false
+	for _, outputFormat := range DigestOutputFormats {
+		isKnownFormat = isKnownFormat || format == outputFormat
+	}
+	if !isKnownFormat {
+		return fmt.Errorf("Unknown output format %s", format)
+	}
+
+	account := &Account{
+		TimezoneName:         options.TimezoneName,
+		Frequency:            options.Frequency,
+		ExcludedRepoIds:      options.ExcludedRepoIds,
+		IncludePullRequests:  options.IncludePullRequests,
+		IncludeIssues:        options.IncludeIssues,
+		IncludeReviews:       options.IncludeReviews,
+		LocalRepositoryGlobs: options.LocalRepositoryGlobs,
+		LocalAuthorEmails:    options.AuthorEmails,
+	}
+	err := initAccountSettings(account)
+	if err != nil {
+		return err
+	}
+	isKnownFrequency := false
+	for _, frequency := range DigestFrequencies {
+		isKnownFrequency = isKnownFrequency || account.Frequency == frequency
+	}
+	if !isKnownFrequency {
+		return fmt.Errorf("Unknown frequency %s", account.Frequency)
+	}
+	date := time.Now().In(account.TimezoneLocation)
+	if options.Date != "" {
+		date, err = time.ParseInLocation(DigestDateParameterFormat, options.Date, account.TimezoneLocation)
+		if err != nil {
+			return fmt.Errorf("Malformed date %s: %s", options.Date, err.Error())
+		}
+	}
+
+	cleanup, err := initDigestTool()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if len(options.LocalRepositoryGlobs) > 0 {
+		// Whoever runs the tool can already read any repository that they
+		// point it at.
+		serverConfig.LocalRepositoryRoots = []string{string(filepath.Separator)}
+	}
+
+	c := &logContext{}
+	var githubClient *github.Client
+	if options.Token != "" {
+		githubClient = newGitHubClient((&oauth.Transport{
+			Token:     &oauth.Token{AccessToken: options.Token},
+			Transport: newGitHubTransport(c),
+		}).Client())
+	}
+	digest, err := newDigestForDate(c, githubClient, account, date, account.Frequency)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"Digest": digest,
+	}
+	switch format {
+	case "text":
+		return textTemplates["digest-email"].Execute(w, data)
+	case "json":
+		digestBytes, err := json.MarshalIndent(newDigestJSON(digest), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(digestBytes, '\n'))
+		return err
+	}
+	return templates["digest-email"].Execute(w, data)
+}
+
+// initDigestTool sets up the parts of the app that generating a digest needs.
+// Nothing is persisted: storage is a temporary database (so repositories
+// don't have vintages yet, and their creation dates are used instead) whose
+// job queue is never started, and the commit index isn't used.
+func initDigestTool() (cleanup func(), err error) {
+	serverConfig = initServerConfig()
+	router = initRouter()
+	templates = loadTemplates()
+	textTemplates = loadTextTemplates()
+	githubConfig, commitFetcher, responseCache = initGitHubConfig()
+	githubConfig.CommitIndex.Disabled = true
+
+	storageDirectory, err := ioutil.TempDir("", "retrogit-digest")
+	if err != nil {
+		return nil, err
+	}
+	boltStorage, err := newBoltStorage(filepath.Join(storageDirectory, "retrogit.db"))
+	if err != nil {
+		os.RemoveAll(storageDirectory)
+		return nil, err
+	}
+	storage = boltStorage
+	jobQueue = newJobQueue(boltStorage, time.Now)
+	return func() {
+		boltStorage.Close()
+		os.RemoveAll(storageDirectory)
+	}, nil
+}
@@ -0,0 +1,161 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stores responses as files in a directory, so that they survive restarts.
+// Once the total size goes over the limit, the least recently written (or
+// read) responses are removed.
+type DiskResponseCache struct {
+	directory     string
+	maxBytes      int64
+	maxEntryBytes int
+
+	mutex sync.Mutex
+	// Tracked in memory (starting with what's already on disk) so that the
+	// directory only needs to be scanned when evicting.
+	bytes int64
+}
+
+func newDiskResponseCache(config ResponseCacheConfig) (*DiskResponseCache, error) {
+	if config.Directory == "" {
+		return nil, fmt.Errorf("No directory specified for the disk response cache")
+	}
+	err := os.MkdirAll(config.Directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+	cache := &DiskResponseCache{
+		directory:     config.Directory,
+		maxBytes:      config.maxBytes(),
+		maxEntryBytes: config.maxEntryBytes(),
+	}
+	files, err := cache.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		cache.bytes += file.Size()
+	}
+	return cache, nil
+}
+
+func (cache *DiskResponseCache) path(key string) string {
+	// Keys are of the form "<prefix>:<hash>", and colons aren't allowed in
+	// file names everywhere.
+	return filepath.Join(cache.directory, strings.Replace(key, ":", "-", -1))
+}
+
+func (cache *DiskResponseCache) Get(c Context, key string) ([]byte, bool, error) {
+	path := cache.path(key)
+	value, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	// Bump the modification time so that eviction is least recently used.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return value, true, nil
+}
+
+func (cache *DiskResponseCache) Put(c Context, key string, value []byte) error {
+	if len(value) > cache.maxEntryBytes {
+		return nil
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	path := cache.path(key)
+	if info, err := os.Stat(path); err == nil {
+		cache.bytes -= info.Size()
+	}
+	// Written to a temporary file first so that concurrent readers never see
+	// a partial response.
+	tempFile, err := ioutil.TempFile(cache.directory, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(value)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	cache.bytes += int64(len(value))
+	if cache.bytes > cache.maxBytes {
+		return cache.evict()
+	}
+	return nil
+}
+
+// sort.Interface implementation for sorting os.FileInfos, oldest first.
+type ByModTime []os.FileInfo
+
+func (a ByModTime) Len() int           { return len(a) }
+func (a ByModTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByModTime) Less(i, j int) bool { return a[i].ModTime().Before(a[j].ModTime()) }
+
+func (cache *DiskResponseCache) evict() error {
+	files, err := cache.files()
+	if err != nil {
+		return err
+	}
+	sort.Sort(ByModTime(files))
+	cache.bytes = 0
+	for _, file := range files {
+		cache.bytes += file.Size()
+	}
+	for _, file := range files {
+		if cache.bytes <= cache.maxBytes {
+			break
+		}
+		err := os.Remove(filepath.Join(cache.directory, file.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		cache.bytes -= file.Size()
+	}
+	return nil
+}
+
+func (cache *DiskResponseCache) files() ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(cache.directory)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".tmp-") {
+			files = append(files, info)
+		}
+	}
+	return files, nil
+}
+
+func (cache *DiskResponseCache) Size() (int, int64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	files, err := cache.files()
+	if err != nil {
+		return 0, cache.bytes
+	}
+	return len(files), cache.bytes
+}
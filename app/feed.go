@@ -0,0 +1,206 @@
+package retrogit
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	AtomNamespace = "http://www.w3.org/2005/Atom"
+	// Feed readers poll frequently, but digests only change once a day (or
+	// less often).
+	FeedMaxAge = time.Hour
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Summary string      `xml:"summary"`
+	Links   []atomLink  `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// FeedURL returns the URL of the account's digest feed, or the empty string if
+// it doesn't have one. The URL includes the feed token, so it should only be
+// shown to the account's owner.
+func (account *Account) FeedURL() string {
+	if account.FeedToken == "" {
+		return ""
+	}
+	url, err := router.Get("digest-feed").URL(
+		"user_id", strconv.Itoa(account.GitHubUserId),
+		"token", account.FeedToken)
+	if err != nil {
+		return ""
+	}
+	return baseUrl() + url.String()
+}
+
+func newFeedToken() (string, error) {
+	return randomHex(20)
+}
+
+func digestFeedHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	vars := mux.Vars(r)
+	userId, err := strconv.Atoi(vars["user_id"])
+	if err != nil {
+		return BadRequest(err, "Malformed user ID")
+	}
+	c := newContext(r)
+	account, err := getAccount(c, userId)
+	// Unknown users and wrong (or revoked) tokens are treated the same, so
+	// that the feed URL doesn't reveal which users exist.
+	if err != nil || account.FeedToken == "" ||
+		subtle.ConstantTimeCompare([]byte(account.FeedToken), []byte(vars["token"])) != 1 {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	// Feed readers may poll far more often than the Cache-Control header
+	// asks them to, so the feed is only generated once per day (digests don't
+	// change more often than that).
+	cacheKey := digestFeedCacheKey(account, time.Now().In(account.TimezoneLocation))
+	feedBytes, ok, err := responseCache.Get(c, cacheKey)
+	if err != nil {
+		c.Warningf("Could not read cached feed for %d: %s", account.GitHubUserId, err.Error())
+	}
+	if !ok {
+		oauthTransport := githubOAuthTransport(c)
+		oauthTransport.Token = &account.OAuthToken
+		githubClient := newGitHubClient(oauthTransport.Client())
+		digest, err := newDigest(c, githubClient, account)
+		if err != nil {
+			return GitHubFetchError(err, "digest")
+		}
+
+		feed, err := newAtomFeed(account, digest)
+		if err != nil {
+			return InternalError(err, "Could not render feed")
+		}
+		feedBytes, err = xml.MarshalIndent(feed, "", "  ")
+		if err != nil {
+			return InternalError(err, "Could not serialize feed")
+		}
+		err = responseCache.Put(c, cacheKey, feedBytes)
+		if err != nil {
+			c.Warningf("Could not cache feed for %d: %s", account.GitHubUserId, err.Error())
+		}
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(FeedMaxAge.Seconds())))
+	w.Header().Del("Expires")
+	w.Write([]byte(xml.Header))
+	w.Write(feedBytes)
+	return nil
+}
+
+// digestFeedCacheKey returns the key that the account's feed is cached under
+// on now's day. It also depends on the settings that are part of the feed, so
+// that changing them takes effect right away. The key is hashed, since it
+// contains the feed token.
+func digestFeedCacheKey(account *Account, now time.Time) string {
+	keyHash := md5.New()
+	fmt.Fprintf(keyHash, "%d:%s:%s:%s:%s", account.GitHubUserId, account.FeedToken,
+		now.Format("2006-01-02"), account.TimezoneName, account.Frequency)
+	return fmt.Sprintf("DigestFeed:%x", keyHash.Sum(nil))
+}
+
+// newAtomFeed returns a feed with an entry for each interval in the digest.
+// Entries are rendered with the same template as the digest emails, since
+// feed readers also ignore stylesheets.
+func newAtomFeed(account *Account, digest *Digest) (*atomFeed, error) {
+	feedURL := account.FeedURL()
+	profileURL := githubURL(*digest.User.Login)
+	now := time.Now().In(digest.TimezoneLocation)
+	feed := &atomFeed{
+		XMLNS:   AtomNamespace,
+		Id:      feedURL,
+		Title:   fmt.Sprintf("RetroGit digest for %s", *digest.User.Login),
+		Updated: now.Format(time.RFC3339),
+		Author:  atomAuthor{Name: *digest.User.Login, URI: profileURL},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: feedURL},
+			{Rel: "alternate", Type: "text/html", Href: viewDigestURL()},
+		},
+		Entries: make([]atomEntry, 0, len(digest.IntervalDigests)),
+	}
+	// The feed only changes when a new interval starts (intervals are newest
+	// first).
+	if len(digest.IntervalDigests) > 0 {
+		feed.Updated = feedEntryTime(digest.IntervalDigests[0]).Format(time.RFC3339)
+	}
+	for _, intervalDigest := range digest.IntervalDigests {
+		var content bytes.Buffer
+		err := templates["digest-email"].ExecuteTemplate(&content, "interval-digest", intervalDigest)
+		if err != nil {
+			return nil, err
+		}
+		entryTime := feedEntryTime(intervalDigest)
+		feed.Entries = append(feed.Entries, atomEntry{
+			// Intervals are identified by their start, so that feed readers
+			// see a new entry each day (or week or month).
+			Id:      fmt.Sprintf("%s#%s", feedURL, intervalDigest.StartTime.Format("2006-01-02")),
+			Title:   feedEntryTitle(intervalDigest),
+			Updated: entryTime.Format(time.RFC3339),
+			Summary: unsafeFormattedText(intervalDigest.Description()),
+			Links:   []atomLink{{Rel: "alternate", Type: "text/html", Href: viewDigestURL()}},
+			Content: atomContent{Type: "html", Body: content.String()},
+		})
+	}
+	return feed, nil
+}
+
+// feedEntryTime returns when the interval became part of the digest, i.e.
+// its start, moved forward to the current year.
+func feedEntryTime(intervalDigest *IntervalDigest) time.Time {
+	return intervalDigest.StartTime.AddDate(-intervalDigest.yearDelta, 0, 0)
+}
+
+func feedEntryTitle(intervalDigest *IntervalDigest) string {
+	if intervalDigest.Monthly {
+		return fmt.Sprintf("%s: %s", intervalDigest.Header(),
+			intervalDigest.StartTime.Format(DigestDisplayMonthFormat))
+	}
+	if intervalDigest.Weekly {
+		return fmt.Sprintf("%s: Week of %s", intervalDigest.Header(),
+			intervalDigest.StartTime.Format(DigestDisplayDateFormat))
+	}
+	return fmt.Sprintf("%s: %s", intervalDigest.Header(),
+		intervalDigest.StartTime.Format(DigestDisplayDateFormat))
+}
@@ -0,0 +1,57 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Writes each message as a .eml file in a directory instead of sending it,
+// for testing and local development.
+type FileMailer struct {
+	directory string
+	counter   uint64
+}
+
+func newFileMailer(directory string) (*FileMailer, error) {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileMailer{directory: directory}, nil
+}
+
+func (m *FileMailer) Send(c Context, message *MailMessage) error {
+	messageBytes, err := formatMailMessage(message)
+	if err != nil {
+		return err
+	}
+	fileName := fmt.Sprintf("%d-%d.eml", time.Now().UnixNano(), atomic.AddUint64(&m.counter, 1))
+	// Write to a temporary file first, so that anything watching the
+	// directory never sees partially written messages.
+	tempFile, err := ioutil.TempFile(m.directory, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(messageBytes)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	path := filepath.Join(m.directory, fileName)
+	err = os.Rename(tempFile.Name(), path)
+	if err != nil {
+		return err
+	}
+	c.Infof("Wrote \"%s\" message to %v to %s", message.Subject, message.To, path)
+	return nil
+}
@@ -0,0 +1,189 @@
+package retrogit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	DefaultFetchParallelism = 10
+	// Rate limit pauses that would be longer than this fail the request
+	// instead, since the token's hourly limit resetting is too long to wait
+	// for while generating a digest.
+	MaxRateLimitWait = time.Minute * 10
+	// How many times requests that hit a rate limit are retried.
+	MaxRateLimitRetries = 3
+	// Used if GitHub doesn't say how long to wait for.
+	DefaultSecondaryRateLimitWait = time.Minute
+
+	// Not defined by net/http in the Go version that we build with.
+	statusTooManyRequests = 429
+)
+
+// GitHubWorkerPool runs GitHub API requests that are made with the same token,
+// with a bounded number of them in flight at once. It tracks the token's rate
+// limit (from the X-RateLimit-* response headers) and pauses all requests
+// until it resets if it runs out. Requests that hit secondary rate limits are
+// retried after the delay that GitHub asks for. GitLab's rate limits (429s and
+// RateLimit-* headers) are handled the same way.
+type GitHubWorkerPool struct {
+	workers chan bool
+	wg      sync.WaitGroup
+	// Overridable so that pausing can be exercised deterministically.
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mutex sync.Mutex
+	// -1 if not known yet.
+	remaining  int
+	resetTime  time.Time
+	pauseUntil time.Time
+}
+
+func newGitHubWorkerPool(parallelism int) *GitHubWorkerPool {
+	if parallelism <= 0 {
+		parallelism = DefaultFetchParallelism
+	}
+	return &GitHubWorkerPool{
+		workers:   make(chan bool, parallelism),
+		now:       time.Now,
+		sleep:     time.Sleep,
+		remaining: -1,
+	}
+}
+
+// Go runs fn in the pool once a worker is available.
+func (p *GitHubWorkerPool) Go(fn func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.workers <- true
+		defer func() { <-p.workers }()
+		fn()
+	}()
+}
+
+// Wait blocks until all of the functions passed to Go have returned.
+func (p *GitHubWorkerPool) Wait() {
+	p.wg.Wait()
+}
+
+// Call makes a GitHub API request (via call), first waiting for the rate limit
+// to reset if necessary.
+func (p *GitHubWorkerPool) Call(call func() (*github.Response, error)) error {
+	for attempt := 0; ; attempt++ {
+		err := p.waitForRateLimit()
+		if err != nil {
+			return err
+		}
+		response, err := call()
+		var httpResponse *http.Response
+		if response != nil {
+			httpResponse = response.Response
+		}
+		errorMessage := ""
+		if errorResponse, ok := err.(*github.ErrorResponse); ok {
+			errorMessage = errorResponse.Message
+			if httpResponse == nil {
+				httpResponse = errorResponse.Response
+			}
+		}
+		_, isRateLimitedError := err.(*RateLimitedError)
+		if isRateLimitedError {
+			errorMessage = err.Error()
+		}
+		isRateLimited := p.update(httpResponse, errorMessage, isRateLimitedError)
+		if err == nil || !isRateLimited || attempt >= MaxRateLimitRetries {
+			return err
+		}
+	}
+}
+
+func (p *GitHubWorkerPool) waitForRateLimit() error {
+	p.mutex.Lock()
+	wakeTime := p.pauseUntil
+	if p.remaining == 0 && p.resetTime.After(wakeTime) {
+		wakeTime = p.resetTime
+	}
+	p.mutex.Unlock()
+
+	wait := wakeTime.Sub(p.now())
+	if wait <= 0 {
+		return nil
+	}
+	if wait > MaxRateLimitWait {
+		return fmt.Errorf("GitHub rate limit exceeded until %s", wakeTime.Format(time.RFC3339))
+	}
+	p.sleep(wait)
+
+	p.mutex.Lock()
+	if p.remaining == 0 && !p.resetTime.After(p.now()) {
+		// The limit has been reset, the next response will say by how much.
+		p.remaining = -1
+	}
+	p.mutex.Unlock()
+	return nil
+}
+
+// update records the rate limit state from response, and returns whether it
+// was rejected because of a rate limit. isRateLimitedError is true if the
+// call already determined that (see RateLimitedError).
+func (p *GitHubWorkerPool) update(response *http.Response, errorMessage string, isRateLimitedError bool) bool {
+	if response == nil {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if remaining, err := strconv.Atoi(rateLimitHeader(response, "Remaining")); err == nil {
+		p.remaining = remaining
+	}
+	if reset, err := strconv.ParseInt(rateLimitHeader(response, "Reset"), 10, 64); err == nil {
+		p.resetTime = time.Unix(reset, 0)
+	}
+
+	if !isRateLimitedError && response.StatusCode != http.StatusForbidden && response.StatusCode != statusTooManyRequests {
+		return false
+	}
+	if retryAfter, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+		p.pauseUntil = p.now().Add(time.Duration(retryAfter) * time.Second)
+		return true
+	}
+	if p.remaining == 0 {
+		return true
+	}
+	errorMessage = strings.ToLower(errorMessage)
+	if isRateLimitedError || response.StatusCode == statusTooManyRequests ||
+		strings.Contains(errorMessage, "secondary rate limit") || strings.Contains(errorMessage, "abuse") {
+		p.pauseUntil = p.now().Add(DefaultSecondaryRateLimitWait)
+		return true
+	}
+	// Other 403s are permission errors.
+	return false
+}
+
+// RateLimitedError can be returned by the functions passed to
+// GitHubWorkerPool.Call for responses that were rejected by a rate limit
+// without a 403 or 429 status (e.g. GitHub's GraphQL API uses a 200 with a
+// RATE_LIMITED error), so that they're retried too.
+type RateLimitedError struct {
+	Message string
+}
+
+func (e *RateLimitedError) Error() string {
+	return e.Message
+}
+
+// rateLimitHeader returns GitHub's X-RateLimit-<name> header, or GitLab's
+// RateLimit-<name> one.
+func rateLimitHeader(response *http.Response, name string) string {
+	if value := response.Header.Get("X-RateLimit-" + name); value != "" {
+		return value
+	}
+	return response.Header.Get("RateLimit-" + name)
+}
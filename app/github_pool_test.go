@@ -0,0 +1,289 @@
+package retrogit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// rateLimitedServer is a stand-in for the GitHub API that responds to each
+// request with the next of its responses, and records the requests' bodies and
+// headers.
+type rateLimitedServer struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	responses []func(w http.ResponseWriter)
+	bodies    []string
+	headers   []http.Header
+}
+
+func newRateLimitedServer(responses ...func(w http.ResponseWriter)) *rateLimitedServer {
+	s := &rateLimitedServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mutex.Lock()
+		s.bodies = append(s.bodies, string(body))
+		s.headers = append(s.headers, r.Header)
+		respond := s.responses[0]
+		if len(s.responses) > 1 {
+			s.responses = s.responses[1:]
+		}
+		s.mutex.Unlock()
+		respond(w)
+	}))
+	return s
+}
+
+func (s *rateLimitedServer) requestCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.bodies)
+}
+
+func rateLimitResponse(resetTime time.Time) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(resetTime.Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message": "API rate limit exceeded"}`)
+	}
+}
+
+func jsonResponse(status int, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}
+}
+
+// newTestGitHubWorkerPool returns a pool whose clock only moves when it
+// sleeps, and the durations that it slept for.
+func newTestGitHubWorkerPool() (*GitHubWorkerPool, *[]time.Duration) {
+	pool := newGitHubWorkerPool(1)
+	now := time.Unix(1425470400, 0)
+	sleeps := make([]time.Duration, 0)
+	pool.now = func() time.Time { return now }
+	pool.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+	}
+	return pool, &sleeps
+}
+
+// nonRewindingTransport reads request bodies without rewinding them (like
+// older versions of net/http did), so that a request that is sent again goes
+// out with an empty body.
+type nonRewindingTransport struct{}
+
+func (t *nonRewindingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+	}
+	outReq, err := http.NewRequest(req.Method, req.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	outReq.Header = req.Header
+	return http.DefaultTransport.RoundTrip(outReq)
+}
+
+func newTestGitHubClient(server *httptest.Server) *github.Client {
+	githubClient := github.NewClient(&http.Client{Transport: &nonRewindingTransport{}})
+	githubClient.BaseURL, _ = url.Parse(server.URL + "/")
+	return githubClient
+}
+
+func callTestGitHubAPI(githubClient *github.Client, pool *GitHubWorkerPool) error {
+	return pool.Call(func() (*github.Response, error) {
+		req, err := githubClient.NewRequest("GET", "user", nil)
+		if err != nil {
+			return nil, err
+		}
+		return githubClient.Do(req, nil)
+	})
+}
+
+func queryTestGraphQLUserId(githubClient *github.Client, pool *GitHubWorkerPool) (string, error) {
+	var data struct {
+		User struct {
+			Id string `json:"id"`
+		} `json:"user"`
+	}
+	_, err := graphQLQuery(githubClient, pool,
+		"query($login: String!) { user(login: $login) { id } }",
+		map[string]interface{}{"login": "octocat"},
+		&data)
+	return data.User.Id, err
+}
+
+func TestGraphQLQueryRetriesRateLimitedRequestWithBody(t *testing.T) {
+	pool, sleeps := newTestGitHubWorkerPool()
+	server := newRateLimitedServer(
+		rateLimitResponse(pool.now().Add(time.Second*30)),
+		jsonResponse(http.StatusOK, `{"data": {"user": {"id": "MDQ6VXNlcjE="}}}`))
+	defer server.Close()
+	originalGraphQLURL := githubConfig.GraphQLURL
+	githubConfig.GraphQLURL = server.URL + "/graphql"
+	defer func() { githubConfig.GraphQLURL = originalGraphQLURL }()
+
+	userId, err := queryTestGraphQLUserId(newTestGitHubClient(server.Server), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userId != "MDQ6VXNlcjE=" {
+		t.Errorf("Unexpected user ID %s", userId)
+	}
+	if len(server.bodies) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(server.bodies))
+	}
+	if server.bodies[0] == "" || server.bodies[1] != server.bodies[0] {
+		t.Errorf("Retried request body %q differs from the original %q", server.bodies[1], server.bodies[0])
+	}
+	if len(*sleeps) != 1 || (*sleeps)[0] != time.Second*30 {
+		t.Errorf("Expected to wait for the rate limit reset, waited for %v", *sleeps)
+	}
+}
+
+func TestGraphQLQueryRetriesRateLimitedError(t *testing.T) {
+	pool, sleeps := newTestGitHubWorkerPool()
+	server := newRateLimitedServer(
+		func(w http.ResponseWriter) {
+			// GitHub's GraphQL API reports running out of the primary rate
+			// limit with a 200.
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(pool.now().Add(time.Second*40).Unix(), 10))
+			fmt.Fprint(w, `{"errors": [{"type": "RATE_LIMITED", "message": "API rate limit exceeded"}]}`)
+		},
+		jsonResponse(http.StatusOK, `{"data": {"user": {"id": "MDQ6VXNlcjE="}}}`))
+	defer server.Close()
+	originalGraphQLURL := githubConfig.GraphQLURL
+	githubConfig.GraphQLURL = server.URL + "/graphql"
+	defer func() { githubConfig.GraphQLURL = originalGraphQLURL }()
+
+	userId, err := queryTestGraphQLUserId(newTestGitHubClient(server.Server), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userId != "MDQ6VXNlcjE=" {
+		t.Errorf("Unexpected user ID %s", userId)
+	}
+	if server.requestCount() != 2 {
+		t.Errorf("Expected 2 requests, got %d", server.requestCount())
+	}
+	if len(*sleeps) != 1 || (*sleeps)[0] != time.Second*40 {
+		t.Errorf("Expected to wait for the rate limit reset, waited for %v", *sleeps)
+	}
+}
+
+func TestGitHubWorkerPoolRetriesAfterRetryAfter(t *testing.T) {
+	pool, sleeps := newTestGitHubWorkerPool()
+	server := newRateLimitedServer(
+		func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "You have exceeded a secondary rate limit"}`)
+		},
+		jsonResponse(http.StatusOK, `{}`))
+	defer server.Close()
+
+	err := callTestGitHubAPI(newTestGitHubClient(server.Server), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.requestCount() != 2 {
+		t.Errorf("Expected 2 requests, got %d", server.requestCount())
+	}
+	if len(*sleeps) != 1 || (*sleeps)[0] != time.Second*5 {
+		t.Errorf("Expected to wait for 5 seconds, waited for %v", *sleeps)
+	}
+}
+
+func TestGitHubWorkerPoolFailsIfResetIsTooFar(t *testing.T) {
+	pool, sleeps := newTestGitHubWorkerPool()
+	server := newRateLimitedServer(rateLimitResponse(pool.now().Add(MaxRateLimitWait * 2)))
+	defer server.Close()
+
+	err := callTestGitHubAPI(newTestGitHubClient(server.Server), pool)
+	if err == nil {
+		t.Fatal("Expected a rate limit error")
+	}
+	if server.requestCount() != 1 {
+		t.Errorf("Expected 1 request, got %d", server.requestCount())
+	}
+	if len(*sleeps) != 0 {
+		t.Errorf("Expected not to wait, waited for %v", *sleeps)
+	}
+}
+
+func TestGitHubWorkerPoolDoesNotRetryPermissionErrors(t *testing.T) {
+	pool, sleeps := newTestGitHubWorkerPool()
+	server := newRateLimitedServer(jsonResponse(http.StatusForbidden, `{"message": "Resource not accessible"}`))
+	defer server.Close()
+
+	err := callTestGitHubAPI(newTestGitHubClient(server.Server), pool)
+	if err == nil {
+		t.Fatal("Expected a permission error")
+	}
+	if server.requestCount() != 1 || len(*sleeps) != 0 {
+		t.Errorf("Expected a single request without waiting, got %d requests and waited for %v",
+			server.requestCount(), *sleeps)
+	}
+}
+
+func TestGitHubWorkerPoolGivesUpAfterMaxRetries(t *testing.T) {
+	pool, _ := newTestGitHubWorkerPool()
+	server := newRateLimitedServer(func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(statusTooManyRequests)
+	})
+	defer server.Close()
+
+	err := callTestGitHubAPI(newTestGitHubClient(server.Server), pool)
+	if err == nil {
+		t.Fatal("Expected a rate limit error")
+	}
+	if server.requestCount() != MaxRateLimitRetries+1 {
+		t.Errorf("Expected %d requests, got %d", MaxRateLimitRetries+1, server.requestCount())
+	}
+}
+
+func TestGitLabProviderRetriesRateLimitedRequest(t *testing.T) {
+	pool, sleeps := newTestGitHubWorkerPool()
+	server := newRateLimitedServer(
+		func(w http.ResponseWriter) {
+			w.Header().Set("RateLimit-Remaining", "0")
+			w.Header().Set("RateLimit-Reset", strconv.FormatInt(pool.now().Add(time.Second*20).Unix(), 10))
+			w.WriteHeader(statusTooManyRequests)
+			fmt.Fprint(w, `{"message": "Retry later"}`)
+		},
+		jsonResponse(http.StatusOK, `{"id": 1, "username": "octocat", "name": "Octo Cat"}`))
+	defer server.Close()
+	provider := &GitLabProvider{url: server.URL + "/", client: http.DefaultClient, pool: pool}
+
+	user, err := provider.GetUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *user.Login != "octocat" {
+		t.Errorf("Unexpected user %s", *user.Login)
+	}
+	if server.requestCount() != 2 {
+		t.Errorf("Expected 2 requests, got %d", server.requestCount())
+	}
+	if len(*sleeps) != 1 || (*sleeps)[0] != time.Second*20 {
+		t.Errorf("Expected to wait for the rate limit reset, waited for %v", *sleeps)
+	}
+}
@@ -0,0 +1,277 @@
+package retrogit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// GitHubProvider is the Provider for the account's (and the configured
+// instance's, see GitHubConfig.BaseURL) GitHub user.
+type GitHubProvider struct {
+	client *github.Client
+	// Other emails and names that the user's commits may have (see
+	// Account.AuthorAliases).
+	aliases []string
+
+	userMutex sync.Mutex
+	user      *github.User
+
+	matcherMutex sync.Mutex
+	matcher      *AuthorMatcher
+}
+
+// newGitHubProvider returns a provider that makes requests with client. user
+// is looked up when first needed if it's nil.
+func newGitHubProvider(client *github.Client, user *github.User) *GitHubProvider {
+	return &GitHubProvider{client: client, user: user}
+}
+
+func (p *GitHubProvider) Name() string {
+	return "GitHub"
+}
+
+func (p *GitHubProvider) GetUser() (*github.User, error) {
+	p.userMutex.Lock()
+	defer p.userMutex.Unlock()
+	if p.user == nil {
+		user, _, err := p.client.Users.Get("")
+		if err != nil {
+			return nil, err
+		}
+		p.user = user
+	}
+	return p.user, nil
+}
+
+func (p *GitHubProvider) GetEmails() ([]github.UserEmail, error) {
+	emails, _, err := p.client.Users.ListEmails(nil)
+	return emails, err
+}
+
+func (p *GitHubProvider) ListRepos() ([]github.Repository, error) {
+	repos := make([]github.Repository, 0)
+	page := 1
+	for {
+		pageRepos, response, err := p.client.Repositories.List(
+			// The username parameter must be left blank so that we can get all
+			// of the repositories the user has access to, not just ones that
+			// they own.
+			"",
+			&github.RepositoryListOptions{
+				ListOptions: github.ListOptions{
+					Page:    page,
+					PerPage: 100,
+				},
+			})
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, pageRepos...)
+		if response.NextPage == 0 {
+			break
+		}
+		page = response.NextPage
+	}
+	return repos, nil
+}
+
+func (p *GitHubProvider) ListOrgs() ([]github.Organization, error) {
+	orgs, _, err := p.client.Organizations.List(
+		"",
+		&github.ListOptions{
+			// Don't bother with pagination for the organization list, the user
+			// is unlikely to have that many.
+			PerPage: 100,
+		})
+	if err != nil {
+		return nil, err
+	}
+	// The organization list doesn't include their pages' URLs.
+	for i := range orgs {
+		if orgs[i].HTMLURL == nil {
+			htmlURL := githubURL(*orgs[i].Login)
+			orgs[i].HTMLURL = &htmlURL
+		}
+	}
+	return orgs, nil
+}
+
+func (p *GitHubProvider) ListOrgRepos(org *github.Organization) ([]github.Repository, error) {
+	repos := make([]github.Repository, 0)
+	page := 1
+	for {
+		pageRepos, response, err := p.client.Repositories.ListByOrg(
+			*org.Login,
+			&github.RepositoryListByOrgOptions{
+				Type: "member",
+				ListOptions: github.ListOptions{
+					Page:    page,
+					PerPage: 100,
+				},
+			})
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, pageRepos...)
+		if response.NextPage == 0 {
+			break
+		}
+		page = response.NextPage
+	}
+	return repos, nil
+}
+
+// ListCommits returns the commits that GitHub attributes to the user, that
+// credit them in a Co-authored-by trailer, or that are authored as one of
+// their aliases. GitHub can't filter by trailers or author names, so all of the
+// repository's commits are listed.
+func (p *GitHubProvider) ListCommits(pool *GitHubWorkerPool, repo *Repo, startTime time.Time, endTime time.Time) ([]github.RepositoryCommit, error) {
+	matcher, err := p.authorMatcher()
+	if err != nil {
+		return nil, err
+	}
+	commits, err := listIntervalCommits(p.client, pool, repo, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	return matcher.filter(commits), nil
+}
+
+// authorMatcher matches the user's login, their verified and noreply GitHub
+// emails (which co-authors are credited with) and their aliases.
+func (p *GitHubProvider) authorMatcher() (*AuthorMatcher, error) {
+	p.matcherMutex.Lock()
+	defer p.matcherMutex.Unlock()
+	if p.matcher != nil {
+		return p.matcher, nil
+	}
+	user, err := p.GetUser()
+	if err != nil {
+		return nil, err
+	}
+	emails, err := p.GetEmails()
+	if err != nil {
+		return nil, err
+	}
+	matcher := newAuthorMatcher()
+	matcher.addLogin(*user.Login)
+	for _, email := range emails {
+		if email.Verified != nil && *email.Verified {
+			matcher.addEmail(*email.Email)
+		}
+	}
+	for _, email := range githubNoreplyEmails(user) {
+		matcher.addEmail(email)
+	}
+	matcher.addAliases(p.aliases)
+	p.matcher = matcher
+	return matcher, nil
+}
+
+func (p *GitHubProvider) GetVintage(repoOwnerLogin string, repoName string) (time.Time, error) {
+	user, err := p.GetUser()
+	if err != nil {
+		return time.Time{}, err
+	}
+	repo, response, err := p.client.Repositories.Get(repoOwnerLogin, repoName)
+	if response != nil && (response.StatusCode == 403 || response.StatusCode == 404) {
+		return time.Time{}, ErrRepoNotAccessible
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	// Cheap check to see if there are commits before the creation time.
+	vintage := repo.CreatedAt.UTC()
+	beforeCreationTime := repo.CreatedAt.UTC().AddDate(0, 0, -1)
+	commits, response, err := p.client.Repositories.ListCommits(
+		repoOwnerLogin,
+		repoName,
+		&github.CommitsListOptions{
+			ListOptions: github.ListOptions{PerPage: 1},
+			Author:      *user.Login,
+			Until:       beforeCreationTime,
+		})
+	if response != nil && response.StatusCode == 409 {
+		// GitHub returns with a 409 when a repository is empty.
+		commits = make([]github.RepositoryCommit, 0)
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	// If there are, then we use the contributor stats API to figure out when
+	// the user's first commit in the repository was.
+	if len(commits) > 0 {
+		stats, response, err := p.client.Repositories.ListContributorsStats(repoOwnerLogin, repoName)
+		if response != nil && response.StatusCode == 202 {
+			return time.Time{}, ErrVintageNotReady
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, stat := range stats {
+			if *stat.Author.ID == *user.ID {
+				for i := range stat.Weeks {
+					weekTimestamp := stat.Weeks[i].Week.UTC()
+					if weekTimestamp.Before(vintage) {
+						vintage = weekTimestamp
+					}
+				}
+				break
+			}
+		}
+	}
+
+	// GitHub doesn't know about the user's alias emails, so their commits
+	// are looked up separately. Names can't be searched for.
+	for _, alias := range p.aliases {
+		if !isEmailAuthorAlias(alias) {
+			continue
+		}
+		aliasVintage, err := p.oldestCommitDate(repoOwnerLogin, repoName, alias, vintage)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if aliasVintage.Before(vintage) {
+			vintage = aliasVintage
+		}
+	}
+	return vintage, nil
+}
+
+// oldestCommitDate returns the date of author's oldest commit before
+// beforeTime, or beforeTime if there isn't one. Commits are listed newest
+// first, so with one per page the last page has the oldest.
+func (p *GitHubProvider) oldestCommitDate(repoOwnerLogin string, repoName string, author string, beforeTime time.Time) (time.Time, error) {
+	options := &github.CommitsListOptions{
+		ListOptions: github.ListOptions{PerPage: 1},
+		Author:      author,
+		Until:       beforeTime,
+	}
+	commits, response, err := p.client.Repositories.ListCommits(repoOwnerLogin, repoName, options)
+	if response != nil && response.StatusCode == 409 {
+		return beforeTime, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	if response.LastPage > 1 {
+		options.ListOptions.Page = response.LastPage
+		commits, _, err = p.client.Repositories.ListCommits(repoOwnerLogin, repoName, options)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	if len(commits) == 0 {
+		return beforeTime, nil
+	}
+	return commits[0].Commit.Author.Date.UTC(), nil
+}
+
+func (p *GitHubProvider) CommitURL(repo *Repo, sha string) string {
+	return githubURL(*repo.FullName + "/commit/" + sha)
+}
+
+func (p *GitHubProvider) OwnsRepoId(repoId int) bool {
+	return repoId > 0
+}
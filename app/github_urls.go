@@ -0,0 +1,113 @@
+package retrogit
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	DefaultGitHubBaseURL    = "https://github.com/"
+	DefaultGitHubAPIURL     = "https://api.github.com/"
+	DefaultGitHubUploadURL  = "https://uploads.github.com/"
+	DefaultGitHubGraphQLURL = "https://api.github.com/graphql"
+)
+
+// initURLs fills in the endpoints that weren't configured. They're derived
+// from BaseURL, so that pointing it at a GitHub Enterprise Server instance is
+// enough to use that instead of github.com.
+func (config *GitHubConfig) initURLs() error {
+	if config.BaseURL == "" {
+		config.BaseURL = DefaultGitHubBaseURL
+	}
+	config.BaseURL = withTrailingSlash(config.BaseURL)
+	if config.BaseURL == DefaultGitHubBaseURL {
+		if config.APIURL == "" {
+			config.APIURL = DefaultGitHubAPIURL
+		}
+		if config.UploadURL == "" {
+			config.UploadURL = DefaultGitHubUploadURL
+		}
+		if config.GraphQLURL == "" {
+			config.GraphQLURL = DefaultGitHubGraphQLURL
+		}
+	} else {
+		// The layout of GitHub Enterprise Server's endpoints.
+		if config.APIURL == "" {
+			config.APIURL = config.BaseURL + "api/v3/"
+		}
+		if config.UploadURL == "" {
+			config.UploadURL = config.BaseURL + "api/uploads/"
+		}
+		if config.GraphQLURL == "" {
+			config.GraphQLURL = config.BaseURL + "api/graphql"
+		}
+	}
+	config.APIURL = withTrailingSlash(config.APIURL)
+	config.UploadURL = withTrailingSlash(config.UploadURL)
+	if config.OAuthAuthURL == "" {
+		config.OAuthAuthURL = config.BaseURL + "login/oauth/authorize"
+	}
+	if config.OAuthTokenURL == "" {
+		config.OAuthTokenURL = config.BaseURL + "login/oauth/access_token"
+	}
+
+	for _, configURL := range []struct {
+		name  string
+		value string
+	}{
+		{"BaseURL", config.BaseURL},
+		{"APIURL", config.APIURL},
+		{"UploadURL", config.UploadURL},
+		{"GraphQLURL", config.GraphQLURL},
+		{"OAuthAuthURL", config.OAuthAuthURL},
+		{"OAuthTokenURL", config.OAuthTokenURL},
+	} {
+		parsedURL, err := url.Parse(configURL.value)
+		if err != nil {
+			return fmt.Errorf("Malformed %s %s: %s", configURL.name, configURL.value, err.Error())
+		}
+		if !parsedURL.IsAbs() {
+			return fmt.Errorf("%s %s is not an absolute URL", configURL.name, configURL.value)
+		}
+	}
+	return nil
+}
+
+func withTrailingSlash(s string) string {
+	if strings.HasSuffix(s, "/") {
+		return s
+	}
+	return s + "/"
+}
+
+// newGitHubClient returns an API client for the configured GitHub instance.
+func newGitHubClient(httpClient *http.Client) *github.Client {
+	githubClient := github.NewClient(httpClient)
+	// Both were validated by initURLs.
+	githubClient.BaseURL, _ = url.Parse(githubConfig.APIURL)
+	githubClient.UploadURL, _ = url.Parse(githubConfig.UploadURL)
+	return githubClient
+}
+
+// githubURL returns the URL of a page on the configured GitHub instance, with
+// path (e.g. "mihaip/retrogit") relative to its root.
+func githubURL(path string) string {
+	return githubConfig.BaseURL + strings.TrimPrefix(path, "/")
+}
+
+// githubNoreplyEmails returns the addresses that GitHub commits as on the
+// user's behalf (e.g. for web edits) if they keep their email private, in the
+// current ("<id>+<login>@") and legacy ("<login>@") formats.
+func githubNoreplyEmails(user *github.User) []string {
+	// Validated by initURLs.
+	baseURL, _ := url.Parse(githubConfig.BaseURL)
+	domain := "users.noreply." + urlHostname(baseURL)
+	return []string{
+		fmt.Sprintf("%d+%s@%s", *user.ID, *user.Login, domain),
+		fmt.Sprintf("%s@%s", *user.Login, domain),
+	}
+}
@@ -0,0 +1,502 @@
+package retrogit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	DefaultGitLabURL = "https://gitlab.com/"
+	GitLabDateFormat = "2006-01-02T15:04:05Z"
+)
+
+// GitLabProvider is the Provider for a GitLab (gitlab.com or self-managed)
+// user, authenticated with a personal access token that has the read_api
+// scope. Projects are GitHub repositories, and groups are organizations. IDs
+// are negated, so that they don't collide with GitHub's.
+type GitLabProvider struct {
+	// Root of the instance, with a trailing slash.
+	url    string
+	token  string
+	client *http.Client
+	// Tracks the instance's rate limit, separately from GitHub's (requests
+	// are still made in the callers' pools, which bound their parallelism).
+	pool *GitHubWorkerPool
+	// Other emails and names that the user's commits may have (see
+	// Account.AuthorAliases).
+	aliases []string
+
+	mutex sync.Mutex
+	user  *github.User
+	// The public email from the user's profile, which may not be in the list
+	// of their emails.
+	primaryEmail string
+	emails       []github.UserEmail
+	projects     []gitLabProject
+}
+
+func newGitLabProvider(c Context, instanceURL string, token string) *GitLabProvider {
+	if instanceURL == "" {
+		instanceURL = DefaultGitLabURL
+	}
+	return &GitLabProvider{
+		url:    withTrailingSlash(instanceURL),
+		token:  token,
+		client: &http.Client{Transport: newGitLabTransport(c)},
+		pool:   newGitHubWorkerPool(1),
+	}
+}
+
+// validateGitLabURL checks that an instance URL (which the access token is
+// sent to) is usable. An empty one means DefaultGitLabURL.
+func validateGitLabURL(instanceURL string) error {
+	if instanceURL == "" {
+		return nil
+	}
+	return validatePublicURL("GitLab", instanceURL)
+}
+
+type gitLabUser struct {
+	Id        int    `json:"id"`
+	Username  string `json:"username"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
+	WebURL    string `json:"web_url"`
+}
+
+func (user *gitLabUser) githubUser() *github.User {
+	id := -user.Id
+	return &github.User{
+		ID:        &id,
+		Login:     &user.Username,
+		Name:      &user.Name,
+		AvatarURL: &user.AvatarURL,
+		HTMLURL:   &user.WebURL,
+	}
+}
+
+type gitLabNamespace struct {
+	Id        int    `json:"id"`
+	Kind      string `json:"kind"`
+	FullPath  string `json:"full_path"`
+	AvatarURL string `json:"avatar_url"`
+	WebURL    string `json:"web_url"`
+}
+
+type gitLabProject struct {
+	Id                int              `json:"id"`
+	Path              string           `json:"path"`
+	PathWithNamespace string           `json:"path_with_namespace"`
+	WebURL            string           `json:"web_url"`
+	Visibility        string           `json:"visibility"`
+	CreatedAt         time.Time        `json:"created_at"`
+	LastActivityAt    time.Time        `json:"last_activity_at"`
+	Namespace         gitLabNamespace  `json:"namespace"`
+	Owner             *gitLabUser      `json:"owner"`
+	ForkedFromProject *json.RawMessage `json:"forked_from_project"`
+}
+
+func (project *gitLabProject) githubRepository() github.Repository {
+	id := -project.Id
+	fork := project.ForkedFromProject != nil
+	private := project.Visibility != "public"
+	// Owner.Login and Name make up FullName, like they do on GitHub.
+	owner := &github.User{Login: &project.Namespace.FullPath}
+	if project.Owner != nil {
+		owner = project.Owner.githubUser()
+		owner.Login = &project.Namespace.FullPath
+	} else {
+		ownerId := -project.Namespace.Id
+		owner.ID = &ownerId
+		owner.AvatarURL = &project.Namespace.AvatarURL
+		owner.HTMLURL = &project.Namespace.WebURL
+	}
+	return github.Repository{
+		ID:        &id,
+		Owner:     owner,
+		Name:      &project.Path,
+		FullName:  &project.PathWithNamespace,
+		HTMLURL:   &project.WebURL,
+		CreatedAt: &github.Timestamp{Time: project.CreatedAt},
+		// GitLab doesn't track pushes separately from other activity, which
+		// can only be more recent.
+		PushedAt: &github.Timestamp{Time: project.LastActivityAt},
+		Fork:     &fork,
+		Private:  &private,
+	}
+}
+
+type gitLabCommit struct {
+	Id             string    `json:"id"`
+	Message        string    `json:"message"`
+	AuthorName     string    `json:"author_name"`
+	AuthorEmail    string    `json:"author_email"`
+	AuthoredDate   time.Time `json:"authored_date"`
+	CommitterName  string    `json:"committer_name"`
+	CommitterEmail string    `json:"committer_email"`
+	CommittedDate  time.Time `json:"committed_date"`
+}
+
+// repositoryCommit converts the commit to GitHub's representation, so that
+// digests are the same regardless of where they came from.
+func (commit *gitLabCommit) repositoryCommit() github.RepositoryCommit {
+	return github.RepositoryCommit{
+		SHA: &commit.Id,
+		Commit: &github.Commit{
+			SHA:     &commit.Id,
+			Message: &commit.Message,
+			Author: &github.CommitAuthor{
+				Date:  &commit.AuthoredDate,
+				Name:  &commit.AuthorName,
+				Email: &commit.AuthorEmail,
+			},
+			Committer: &github.CommitAuthor{
+				Date:  &commit.CommittedDate,
+				Name:  &commit.CommitterName,
+				Email: &commit.CommitterEmail,
+			},
+		},
+	}
+}
+
+// GitLabError is returned for API responses with an error status.
+type GitLabError struct {
+	Response *http.Response
+	Message  string
+}
+
+func (e *GitLabError) Error() string {
+	return fmt.Sprintf("GitLab API error %d: %s", e.Response.StatusCode, e.Message)
+}
+
+// get makes an API request for path (relative to the API root), unmarshaling
+// the response into data. Requests that hit the rate limit are retried (see
+// GitHubWorkerPool, which also understands GitLab's 429s and RateLimit-*
+// headers).
+func (p *GitLabProvider) get(path string, query url.Values, data interface{}) (*github.Response, error) {
+	var response *github.Response
+	err := p.pool.Call(func() (*github.Response, error) {
+		var err error
+		response, err = p.request(path, query, data)
+		return response, err
+	})
+	return response, err
+}
+
+// request makes a single API request for get. The response is returned as a
+// github.Response (with NextPage filled in from GitLab's pagination headers),
+// so that it can be made via GitHubWorkerPool.
+func (p *GitLabProvider) request(path string, query url.Values, data interface{}) (*github.Response, error) {
+	requestURL := p.url + "api/v4/" + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	httpResponse, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	response := &github.Response{Response: httpResponse}
+	response.NextPage, _ = strconv.Atoi(httpResponse.Header.Get("X-Next-Page"))
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return response, err
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		var errorBody struct {
+			Message interface{} `json:"message"`
+			Error   string      `json:"error"`
+		}
+		message := httpResponse.Status
+		if json.Unmarshal(body, &errorBody) == nil {
+			if errorBody.Message != nil {
+				message = fmt.Sprintf("%v", errorBody.Message)
+			} else if errorBody.Error != "" {
+				message = errorBody.Error
+			}
+		}
+		return response, &GitLabError{httpResponse, message}
+	}
+	return response, json.Unmarshal(body, data)
+}
+
+// getAll requests all of the pages of path, calling appendPage with each one.
+func (p *GitLabProvider) getAll(path string, query url.Values, newPage func() interface{}, appendPage func(interface{})) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("per_page", "100")
+	page := 1
+	for {
+		query.Set("page", strconv.Itoa(page))
+		data := newPage()
+		response, err := p.get(path, query, data)
+		if err != nil {
+			return err
+		}
+		appendPage(data)
+		if response.NextPage == 0 {
+			return nil
+		}
+		page = response.NextPage
+	}
+}
+
+func (p *GitLabProvider) Name() string {
+	return "GitLab"
+}
+
+func (p *GitLabProvider) GetUser() (*github.User, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.user == nil {
+		var user gitLabUser
+		_, err := p.get("user", nil, &user)
+		if err != nil {
+			return nil, err
+		}
+		p.user = user.githubUser()
+		p.primaryEmail = user.Email
+	}
+	return p.user, nil
+}
+
+func (p *GitLabProvider) GetEmails() ([]github.UserEmail, error) {
+	if _, err := p.GetUser(); err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.emails != nil {
+		return p.emails, nil
+	}
+	var gitLabEmails []struct {
+		Email       string     `json:"email"`
+		ConfirmedAt *time.Time `json:"confirmed_at"`
+	}
+	_, err := p.get("user/emails", nil, &gitLabEmails)
+	if err != nil {
+		return nil, err
+	}
+	emails := make([]github.UserEmail, 0, len(gitLabEmails)+1)
+	if p.primaryEmail != "" {
+		primary, verified := true, true
+		emails = append(emails, github.UserEmail{Email: &p.primaryEmail, Primary: &primary, Verified: &verified})
+	}
+	for i := range gitLabEmails {
+		if gitLabEmails[i].Email == p.primaryEmail {
+			continue
+		}
+		primary, verified := false, gitLabEmails[i].ConfirmedAt != nil
+		emails = append(emails, github.UserEmail{Email: &gitLabEmails[i].Email, Primary: &primary, Verified: &verified})
+	}
+	p.emails = emails
+	return emails, nil
+}
+
+// listProjects returns all of the projects that the user is a member of, both
+// in user and group namespaces. They're only requested once, since ListRepos,
+// ListOrgs and ListOrgRepos are all derived from them.
+func (p *GitLabProvider) listProjects() ([]gitLabProject, error) {
+	p.mutex.Lock()
+	projects := p.projects
+	p.mutex.Unlock()
+	if projects != nil {
+		return projects, nil
+	}
+	projects = make([]gitLabProject, 0)
+	query := url.Values{}
+	query.Set("membership", "true")
+	query.Set("archived", "false")
+	err := p.getAll("projects", query,
+		func() interface{} { return &[]gitLabProject{} },
+		func(page interface{}) { projects = append(projects, *page.(*[]gitLabProject)...) })
+	if err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	p.projects = projects
+	p.mutex.Unlock()
+	return projects, nil
+}
+
+func (p *GitLabProvider) ListRepos() ([]github.Repository, error) {
+	projects, err := p.listProjects()
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]github.Repository, 0)
+	for i := range projects {
+		if projects[i].Namespace.Kind != "group" {
+			repos = append(repos, projects[i].githubRepository())
+		}
+	}
+	return repos, nil
+}
+
+func (p *GitLabProvider) ListOrgs() ([]github.Organization, error) {
+	projects, err := p.listProjects()
+	if err != nil {
+		return nil, err
+	}
+	orgs := make([]github.Organization, 0)
+	seenGroupIds := make(map[int]bool)
+	for i := range projects {
+		namespace := &projects[i].Namespace
+		if namespace.Kind != "group" || seenGroupIds[namespace.Id] {
+			continue
+		}
+		seenGroupIds[namespace.Id] = true
+		id := -namespace.Id
+		orgs = append(orgs, github.Organization{
+			ID:        &id,
+			Login:     &namespace.FullPath,
+			AvatarURL: &namespace.AvatarURL,
+			HTMLURL:   &namespace.WebURL,
+		})
+	}
+	return orgs, nil
+}
+
+func (p *GitLabProvider) ListOrgRepos(org *github.Organization) ([]github.Repository, error) {
+	projects, err := p.listProjects()
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]github.Repository, 0)
+	for i := range projects {
+		if projects[i].Namespace.Kind == "group" && -projects[i].Namespace.Id == *org.ID {
+			repos = append(repos, projects[i].githubRepository())
+		}
+	}
+	return repos, nil
+}
+
+// ListCommits returns the commits whose author email is one of the user's
+// verified ones (or whose author name is theirs), or one of their aliases,
+// since GitLab can only filter commits by author on recent versions. Commits
+// that credit them in a Co-authored-by trailer are included too.
+func (p *GitLabProvider) ListCommits(pool *GitHubWorkerPool, repo *Repo, startTime time.Time, endTime time.Time) ([]github.RepositoryCommit, error) {
+	matcher, err := p.authorMatcher()
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("since", startTime.UTC().Format(GitLabDateFormat))
+	query.Set("until", endTime.UTC().Format(GitLabDateFormat))
+	commits := make([]github.RepositoryCommit, 0)
+	err = p.getAll(fmt.Sprintf("projects/%d/repository/commits", -*repo.ID), query,
+		func() interface{} { return &[]gitLabCommit{} },
+		func(page interface{}) {
+			pageCommits := *page.(*[]gitLabCommit)
+			for i := range pageCommits {
+				commits = append(commits, pageCommits[i].repositoryCommit())
+			}
+		})
+	if errorResponse, ok := err.(*GitLabError); ok && errorResponse.Response.StatusCode == 404 {
+		// Empty repositories don't have any commits to list.
+		return commits, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return matcher.filter(commits), nil
+}
+
+func (p *GitLabProvider) authorMatcher() (*AuthorMatcher, error) {
+	user, err := p.GetUser()
+	if err != nil {
+		return nil, err
+	}
+	emails, err := p.GetEmails()
+	if err != nil {
+		return nil, err
+	}
+	matcher := newAuthorMatcher()
+	hasVerifiedEmail := false
+	for _, email := range emails {
+		if email.Verified != nil && *email.Verified {
+			matcher.addEmail(*email.Email)
+			hasVerifiedEmail = true
+		}
+	}
+	// Names aren't unique (and anyone can author commits with any name), so
+	// they're only a fallback for users whose emails can't be used.
+	if !hasVerifiedEmail {
+		matcher.addName(*user.Name)
+	}
+	matcher.addAliases(p.aliases)
+	return matcher, nil
+}
+
+// GetVintage returns the project's creation time, or the time of its first
+// commit if it was imported with older history. The latter can only be found
+// cheaply (by requesting the last page of commits) if the project has fewer
+// than 10,000 commits before its creation, since GitLab doesn't count more.
+func (p *GitLabProvider) GetVintage(repoOwnerLogin string, repoName string) (time.Time, error) {
+	projectPath := url.QueryEscape(repoOwnerLogin + "/" + repoName)
+	var project gitLabProject
+	_, err := p.get("projects/"+projectPath, nil, &project)
+	if errorResponse, ok := err.(*GitLabError); ok &&
+		(errorResponse.Response.StatusCode == 403 || errorResponse.Response.StatusCode == 404) {
+		return time.Time{}, ErrRepoNotAccessible
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	vintage := project.CreatedAt.UTC()
+	query := url.Values{}
+	query.Set("until", vintage.Format(GitLabDateFormat))
+	query.Set("per_page", "1")
+	var commits []gitLabCommit
+	response, err := p.get(fmt.Sprintf("projects/%d/repository/commits", project.Id), query, &commits)
+	if errorResponse, ok := err.(*GitLabError); ok && errorResponse.Response.StatusCode == 404 {
+		// Empty repository.
+		return vintage, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	if len(commits) == 0 {
+		return vintage, nil
+	}
+	lastPage, err := strconv.Atoi(response.Header.Get("X-Total-Pages"))
+	if err != nil {
+		// Too many to count, the creation time will have to do.
+		return vintage, nil
+	}
+	if lastPage > 1 {
+		query.Set("page", strconv.Itoa(lastPage))
+		_, err = p.get(fmt.Sprintf("projects/%d/repository/commits", project.Id), query, &commits)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	for _, commit := range commits {
+		if commit.CommittedDate.Before(vintage) {
+			vintage = commit.CommittedDate.UTC()
+		}
+	}
+	return vintage, nil
+}
+
+func (p *GitLabProvider) CommitURL(repo *Repo, sha string) string {
+	return *repo.HTMLURL + "/-/commit/" + sha
+}
+
+func (p *GitLabProvider) OwnsRepoId(repoId int) bool {
+	return repoId < 0 && repoId > -localGitRepoIdOffset
+}
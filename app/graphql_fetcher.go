@@ -0,0 +1,269 @@
+package retrogit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	// Each history returns up to 100 commits, so this keeps queries well
+	// under GraphQL's node limit.
+	GraphQLHistoriesPerQuery = 100
+	GraphQLDateFormat        = "2006-01-02T15:04:05Z"
+)
+
+// GraphQLCommitFetcher uses GitHub's GraphQL API to request the commit
+// histories of many (interval, repository) pairs in a single query, instead of
+// making at least one REST request per pair. Histories with more commits than
+// fit in one page are followed up on in subsequent queries. Histories aren't
+// filtered by author, since the user's commits are also the ones that credit
+// them in Co-authored-by trailers or are authored as one of their aliases (see
+// AuthorMatcher). Other providers' commits are fetched like RESTCommitFetcher
+// does.
+type GraphQLCommitFetcher struct{}
+
+type graphQLHistoryTarget struct {
+	intervalDigest *IntervalDigest
+	repo           *Repo
+	// Empty for the first page.
+	cursor  string
+	commits []github.RepositoryCommit
+	err     error
+}
+
+func (f *GraphQLCommitFetcher) FetchCommits(provider Provider, digest *Digest) []*IntervalRepoCommits {
+	githubProvider, ok := provider.(*GitHubProvider)
+	if !ok {
+		return (&RESTCommitFetcher{}).FetchCommits(provider, digest)
+	}
+	githubClient := githubProvider.client
+	targets := make([]*graphQLHistoryTarget, 0)
+	for _, intervalDigest := range digest.IntervalDigests {
+		for _, repo := range intervalDigest.providerRepos(provider) {
+			targets = append(targets, &graphQLHistoryTarget{
+				intervalDigest: intervalDigest,
+				repo:           repo,
+				commits:        make([]github.RepositoryCommit, 0),
+			})
+		}
+	}
+
+	pool := newGitHubWorkerPool(githubConfig.FetchParallelism)
+	matcher, err := githubProvider.authorMatcher()
+	if err != nil {
+		for _, target := range targets {
+			target.err = err
+		}
+	} else {
+		for start := 0; start < len(targets); start += GraphQLHistoriesPerQuery {
+			end := start + GraphQLHistoriesPerQuery
+			if end > len(targets) {
+				end = len(targets)
+			}
+			batch := targets[start:end]
+			pool.Go(func() {
+				fetchGraphQLHistories(githubClient, pool, batch)
+			})
+		}
+		pool.Wait()
+		for _, target := range targets {
+			target.commits = matcher.filter(target.commits)
+		}
+	}
+
+	results := make([]*IntervalRepoCommits, len(targets))
+	for i, target := range targets {
+		results[i] = &IntervalRepoCommits{target.intervalDigest, target.repo, provider, target.commits, target.err}
+	}
+	return results
+}
+
+// fetchGraphQLHistories fills in the commits of all of the targets, querying
+// again for the ones that have more pages until they're done.
+func fetchGraphQLHistories(githubClient *github.Client, pool *GitHubWorkerPool, targets []*graphQLHistoryTarget) {
+	pending := targets
+	for len(pending) > 0 {
+		var query bytes.Buffer
+		query.WriteString("query {\n")
+		for i, target := range pending {
+			fmt.Fprintf(&query, "t%d: repository(owner: %s, name: %s) {\n", i,
+				graphQLString(*target.repo.Owner.Login), graphQLString(*target.repo.Name))
+			fmt.Fprintf(&query, "defaultBranchRef { target { ... on Commit { history(first: 100, since: %s, until: %s",
+				graphQLString(target.intervalDigest.StartTime.UTC().Format(GraphQLDateFormat)),
+				graphQLString(target.intervalDigest.EndTime.UTC().Format(GraphQLDateFormat)))
+			if target.cursor != "" {
+				fmt.Fprintf(&query, ", after: %s", graphQLString(target.cursor))
+			}
+			query.WriteString(") { pageInfo { hasNextPage endCursor } nodes { oid message committedDate authoredDate author { name email user { login } } } } } } }\n}\n")
+		}
+		query.WriteString("}")
+
+		var data map[string]*graphQLRepositoryHistory
+		queryErrors, err := graphQLQuery(
+			githubClient, pool, query.String(), nil, &data)
+		if err != nil {
+			for _, target := range pending {
+				target.err = err
+			}
+			return
+		}
+		for _, queryError := range queryErrors {
+			if len(queryError.Path) == 0 {
+				for _, target := range pending {
+					target.err = queryError
+				}
+				return
+			}
+			var i int
+			if alias, ok := queryError.Path[0].(string); ok {
+				if _, err := fmt.Sscanf(alias, "t%d", &i); err == nil && i < len(pending) {
+					pending[i].err = queryError
+				}
+			}
+		}
+
+		nextPending := make([]*graphQLHistoryTarget, 0)
+		for i, target := range pending {
+			if target.err != nil {
+				continue
+			}
+			repository := data[fmt.Sprintf("t%d", i)]
+			// Empty repositories don't have a default branch.
+			if repository == nil || repository.DefaultBranchRef == nil ||
+				repository.DefaultBranchRef.Target.History == nil {
+				continue
+			}
+			history := repository.DefaultBranchRef.Target.History
+			for j := range history.Nodes {
+				target.commits = append(target.commits, history.Nodes[j].repositoryCommit())
+			}
+			if history.PageInfo.HasNextPage {
+				target.cursor = history.PageInfo.EndCursor
+				nextPending = append(nextPending, target)
+			}
+		}
+		pending = nextPending
+	}
+}
+
+type graphQLRepositoryHistory struct {
+	DefaultBranchRef *struct {
+		Target struct {
+			History *struct {
+				PageInfo struct {
+					HasNextPage bool   `json:"hasNextPage"`
+					EndCursor   string `json:"endCursor"`
+				} `json:"pageInfo"`
+				Nodes []graphQLCommit `json:"nodes"`
+			} `json:"history"`
+		} `json:"target"`
+	} `json:"defaultBranchRef"`
+}
+
+type graphQLCommit struct {
+	Oid           string    `json:"oid"`
+	Message       string    `json:"message"`
+	CommittedDate time.Time `json:"committedDate"`
+	AuthoredDate  time.Time `json:"authoredDate"`
+	Author        struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+		// The GitHub user that the commit is attributed to, if any.
+		User *struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"author"`
+}
+
+// repositoryCommit converts the commit to the REST API's representation, so
+// that digests are the same regardless of how they were fetched.
+func (commit *graphQLCommit) repositoryCommit() github.RepositoryCommit {
+	repositoryCommit := github.RepositoryCommit{
+		SHA: &commit.Oid,
+		Commit: &github.Commit{
+			SHA:     &commit.Oid,
+			Message: &commit.Message,
+			Author: &github.CommitAuthor{
+				Name:  &commit.Author.Name,
+				Email: &commit.Author.Email,
+				Date:  &commit.AuthoredDate,
+			},
+			Committer: &github.CommitAuthor{Date: &commit.CommittedDate},
+		},
+	}
+	if commit.Author.User != nil {
+		repositoryCommit.Author = &github.User{Login: &commit.Author.User.Login}
+	}
+	return repositoryCommit
+}
+
+type graphQLError struct {
+	// Only set for some errors, e.g. "NOT_FOUND" or "RATE_LIMITED".
+	Type    string        `json:"type"`
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path"`
+}
+
+func (e graphQLError) Error() string {
+	return e.Message
+}
+
+// graphQLQuery runs query against the GraphQL endpoint (via pool), unmarshaling
+// its result into data. Errors in the response (which may only affect part of
+// the result) are returned separately from request failures.
+func graphQLQuery(githubClient *github.Client, pool *GitHubWorkerPool, query string, variables map[string]interface{}, data interface{}) ([]graphQLError, error) {
+	request := struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables,omitempty"`
+	}{query, variables}
+	var response struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []graphQLError  `json:"errors"`
+	}
+	err := pool.Call(func() (*github.Response, error) {
+		// The request is made for each attempt, since its body can only be
+		// read once.
+		req, err := githubClient.NewRequest("POST", githubConfig.GraphQLURL, request)
+		if err != nil {
+			return nil, err
+		}
+		response.Data, response.Errors = nil, nil
+		githubResponse, err := githubClient.Do(req, &response)
+		if err == nil {
+			// Running out of the primary rate limit isn't reflected in the
+			// response status.
+			for _, queryError := range response.Errors {
+				if queryError.Type == "RATE_LIMITED" {
+					return githubResponse, &RateLimitedError{queryError.Message}
+				}
+			}
+		}
+		return githubResponse, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data) == 0 || string(response.Data) == "null" {
+		if len(response.Errors) > 0 {
+			return nil, response.Errors[0]
+		}
+		return nil, errors.New("Empty GraphQL response")
+	}
+	err = json.Unmarshal(response.Data, data)
+	if err != nil {
+		return nil, err
+	}
+	return response.Errors, nil
+}
+
+// graphQLString quotes s as a GraphQL string literal (JSON string syntax is
+// compatible).
+func graphQLString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
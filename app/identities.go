@@ -0,0 +1,169 @@
+package retrogit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"code.google.com/p/goauth2/oauth"
+	"github.com/google/go-github/github"
+	"github.com/gorilla/sessions"
+)
+
+// Session value with the OAuth state parameter of an identity being linked,
+// which tells githubOAuthCallbackHandler to link the user instead of signing
+// in as them.
+const linkIdentityStateKey = "link-identity-state"
+
+// LinkedIdentity is another GitHub user (e.g. a work account) whose
+// repositories and commits are merged into an account's digests.
+type LinkedIdentity struct {
+	GitHubUserId int
+	Login        string
+	AvatarURL    string
+	HTMLURL      string
+	OAuthToken   oauth.Token
+}
+
+func newLinkedIdentity(user *github.User, token *oauth.Token) LinkedIdentity {
+	identity := LinkedIdentity{
+		GitHubUserId: *user.ID,
+		Login:        *user.Login,
+		OAuthToken:   *token,
+	}
+	if user.AvatarURL != nil {
+		identity.AvatarURL = *user.AvatarURL
+	}
+	if user.HTMLURL != nil {
+		identity.HTMLURL = *user.HTMLURL
+	} else {
+		identity.HTMLURL = githubURL(*user.Login)
+	}
+	return identity
+}
+
+// githubUser returns the user as of when it was linked, so that providers
+// don't need to look it up again.
+func (identity *LinkedIdentity) githubUser() *github.User {
+	return &github.User{
+		ID:        &identity.GitHubUserId,
+		Login:     &identity.Login,
+		AvatarURL: &identity.AvatarURL,
+		HTMLURL:   &identity.HTMLURL,
+	}
+}
+
+func (identity *LinkedIdentity) githubClient(c Context) *github.Client {
+	oauthTransport := githubOAuthTransport(c)
+	oauthTransport.Token = &identity.OAuthToken
+	return newGitHubClient(oauthTransport.Client())
+}
+
+// linkIdentity adds the identity to the account, or updates it if it was
+// already linked (e.g. to replace a revoked token).
+func (account *Account) linkIdentity(identity LinkedIdentity) error {
+	if identity.GitHubUserId == account.GitHubUserId {
+		return errors.New("An account can't be linked to itself")
+	}
+	for i := range account.LinkedIdentities {
+		if account.LinkedIdentities[i].GitHubUserId == identity.GitHubUserId {
+			account.LinkedIdentities[i] = identity
+			return nil
+		}
+	}
+	account.LinkedIdentities = append(account.LinkedIdentities, identity)
+	return nil
+}
+
+func (account *Account) unlinkIdentity(githubUserId int) bool {
+	for i := range account.LinkedIdentities {
+		if account.LinkedIdentities[i].GitHubUserId == githubUserId {
+			account.LinkedIdentities = append(account.LinkedIdentities[:i], account.LinkedIdentities[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// linkIdentityHandler starts the OAuth flow for the identity to link. GitHub
+// authorizes whichever user is signed in there, so users have to switch to
+// the other one first.
+func linkIdentityHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	linkState, err := randomHex(20)
+	if err != nil {
+		return InternalError(err, "Could not generate OAuth state")
+	}
+	state.session.Values[linkIdentityStateKey] = linkState
+	state.saveSession()
+	return RedirectToUrl(githubOauthConfig.AuthCodeURL(linkState))
+}
+
+// linkIdentityCallback finishes linking user (whom token is for) to the
+// signed in account, if the OAuth flow was started by linkIdentityHandler. It
+// returns false otherwise, and the callback signs in as user instead.
+func linkIdentityCallback(w http.ResponseWriter, r *http.Request, session *sessions.Session, user *github.User, token *oauth.Token) (bool, *AppError) {
+	linkState, ok := session.Values[linkIdentityStateKey].(string)
+	if !ok || linkState == "" || r.FormValue("state") != linkState {
+		return false, nil
+	}
+	delete(session.Values, linkIdentityStateKey)
+	userId, ok := session.Values[sessionConfig.UserIdKey].(int)
+	if !ok {
+		session.Save(r, w)
+		return true, NotSignedIn(r)
+	}
+	c := newContext(r)
+	account, err := getAccount(c, userId)
+	if err != nil {
+		return true, InternalError(err, "Could not look up account")
+	}
+	err = account.linkIdentity(newLinkedIdentity(user, token))
+	if err != nil {
+		session.AddFlash(fmt.Sprintf("Could not link %s: %s. Sign in to the other account on GitHub first.", *user.Login, err.Error()))
+		session.Save(r, w)
+		return true, RedirectToRoute("settings")
+	}
+	err = account.Put(c)
+	if err != nil {
+		return true, InternalError(err, "Could not save account")
+	}
+	// Repositories that the identity shares with the account were indexed
+	// without its commits.
+	err = storage.DeleteCommitIndex(c, account.GitHubUserId)
+	if err != nil {
+		return true, InternalError(err, "Could not reset commit index")
+	}
+	if !githubConfig.CommitIndex.Disabled {
+		// Rebuilds it now, instead of waiting for the account's daily update.
+		indexCommitsFunc.Call(c, account.GitHubUserId)
+	}
+	session.AddFlash(fmt.Sprintf("Linked %s.", *user.Login))
+	session.Save(r, w)
+	return true, RedirectToRoute("settings")
+}
+
+func unlinkIdentityHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	c := newContext(r)
+	githubUserId, err := strconv.Atoi(r.FormValue("github_user_id"))
+	if err != nil {
+		return BadRequest(err, "Malformed github_user_id value")
+	}
+	if !state.Account.unlinkIdentity(githubUserId) {
+		return BadRequest(nil, "Identity is not linked")
+	}
+	err = state.Account.Put(c)
+	if err != nil {
+		return InternalError(err, "Could not save account")
+	}
+	// The index has the identity's commits too, so it's rebuilt without them.
+	err = storage.DeleteCommitIndex(c, state.Account.GitHubUserId)
+	if err != nil {
+		return InternalError(err, "Could not reset commit index")
+	}
+	if !githubConfig.CommitIndex.Disabled {
+		indexCommitsFunc.Call(c, state.Account.GitHubUserId)
+	}
+	state.AddFlash("Identity unlinked.")
+	return RedirectToRoute("settings")
+}
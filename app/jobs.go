@@ -0,0 +1,293 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Job is a persisted invocation of a function registered via registerJobFunc.
+// It stands in for App Engine's task queues when running standalone.
+type Job struct {
+	// Assigned by the JobStore if left empty.
+	Id   string
+	Name string
+	// JSON-encoded arguments, not including the leading Context.
+	Args      []json.RawMessage
+	RunAt     time.Time
+	Attempts  int
+	LastError string
+}
+
+type JobStore interface {
+	// AddJob stores a job, unless there is already one with the same Id.
+	AddJob(c Context, job *Job) error
+	// LeaseJobs returns up to limit jobs that are due at now, in RunAt order.
+	// The returned jobs have their attempt count incremented and their RunAt
+	// pushed back by leaseDuration, so that if they are neither updated nor
+	// deleted by then (e.g. because the process died), they are run again.
+	LeaseJobs(c Context, now time.Time, leaseDuration time.Duration, limit int) ([]*Job, error)
+	UpdateJob(c Context, job *Job) error
+	DeleteJob(c Context, id string) error
+}
+
+type jobFunc struct {
+	fn       reflect.Value
+	argTypes []reflect.Type
+}
+
+var contextType = reflect.TypeOf((*Context)(nil)).Elem()
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+var jobFuncs = make(map[string]*jobFunc)
+
+// registerJobFunc makes fn available for running via a JobQueue under the
+// given name. fn must take a Context as its first argument, and may return an
+// error (in which case the job is retried).
+func registerJobFunc(name string, fn interface{}) {
+	fnValue := reflect.ValueOf(fn)
+	fnType := fnValue.Type()
+	if fnType.Kind() != reflect.Func || fnType.NumIn() == 0 || fnType.In(0) != contextType {
+		log.Panicf("Job function %s must take a Context as its first argument", name)
+	}
+	if fnType.NumOut() > 1 || (fnType.NumOut() == 1 && fnType.Out(0) != errorType) {
+		log.Panicf("Job function %s may only return an error", name)
+	}
+	if _, ok := jobFuncs[name]; ok {
+		log.Panicf("Job function %s was registered twice", name)
+	}
+	argTypes := make([]reflect.Type, fnType.NumIn()-1)
+	for i := range argTypes {
+		argTypes[i] = fnType.In(i + 1)
+	}
+	jobFuncs[name] = &jobFunc{fnValue, argTypes}
+}
+
+// JobQueue runs jobs from a JobStore with at-least-once semantics, retrying
+// failures with exponential backoff. Jobs can also be periodic, in which case
+// the next occurrence is scheduled whenever one is done.
+type JobQueue struct {
+	store JobStore
+	// Overridable so that scheduling can be exercised deterministically.
+	now func() time.Time
+
+	// Number of jobs that are run concurrently.
+	Workers int
+	// Jobs that have failed this many times are dropped.
+	MaxAttempts   int
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	LeaseDuration time.Duration
+
+	periodicMutex sync.Mutex
+	periodicJobs  map[string]func(time.Time) time.Time
+}
+
+func newJobQueue(store JobStore, now func() time.Time) *JobQueue {
+	return &JobQueue{
+		store:         store,
+		now:           now,
+		Workers:       10,
+		MaxAttempts:   10,
+		MinBackoff:    time.Second * 10,
+		MaxBackoff:    time.Hour,
+		LeaseDuration: time.Minute * 10,
+		periodicJobs:  make(map[string]func(time.Time) time.Time),
+	}
+}
+
+// Add enqueues a call to the function registered under name, to be run after
+// delay.
+func (q *JobQueue) Add(c Context, name string, delay time.Duration, args ...interface{}) error {
+	job, err := newJob(name, args)
+	if err != nil {
+		return err
+	}
+	job.RunAt = q.now().Add(delay)
+	return q.store.AddJob(c, job)
+}
+
+func newJob(name string, args []interface{}) (*Job, error) {
+	jobFunc, ok := jobFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("No job function registered for %s", name)
+	}
+	if len(args) != len(jobFunc.argTypes) {
+		return nil, fmt.Errorf("Job function %s takes %d arguments, got %d",
+			name, len(jobFunc.argTypes), len(args))
+	}
+	job := &Job{
+		Name: name,
+		Args: make([]json.RawMessage, len(args)),
+	}
+	for i := range args {
+		argBytes, err := json.Marshal(args[i])
+		if err != nil {
+			return nil, err
+		}
+		job.Args[i] = argBytes
+	}
+	return job, nil
+}
+
+// AddPeriodic schedules the function registered under name (via
+// registerJobFunc) to be run at the times returned by next (which is given the
+// current time and should return the time of the following run). The function
+// is passed the time that the run was scheduled for. It's safe to call on every
+// startup, since runs are identified by their time.
+func (q *JobQueue) AddPeriodic(c Context, name string, next func(time.Time) time.Time) error {
+	q.periodicMutex.Lock()
+	q.periodicJobs[name] = next
+	q.periodicMutex.Unlock()
+	return q.schedulePeriodic(c, name)
+}
+
+func (q *JobQueue) schedulePeriodic(c Context, name string) error {
+	q.periodicMutex.Lock()
+	next := q.periodicJobs[name]
+	q.periodicMutex.Unlock()
+	runAt := next(q.now())
+	job, err := newJob(name, []interface{}{runAt})
+	if err != nil {
+		return err
+	}
+	job.RunAt = runAt
+	job.Id = fmt.Sprintf("%s@%s", name, job.RunAt.UTC().Format(time.RFC3339))
+	return q.store.AddJob(c, job)
+}
+
+// RunPending runs all jobs that are currently due and returns how many were
+// run. Jobs that become due while it's running (e.g. retries) are left for the
+// next call.
+func (q *JobQueue) RunPending(c Context) (int, error) {
+	now := q.now()
+	runCount := 0
+	for {
+		jobs, err := q.store.LeaseJobs(c, now, q.LeaseDuration, q.Workers)
+		if err != nil {
+			return runCount, err
+		}
+		if len(jobs) == 0 {
+			return runCount, nil
+		}
+		var wg sync.WaitGroup
+		wg.Add(len(jobs))
+		for _, job := range jobs {
+			go func(job *Job) {
+				defer wg.Done()
+				q.runJob(c, job)
+			}(job)
+		}
+		wg.Wait()
+		runCount += len(jobs)
+	}
+}
+
+func (q *JobQueue) runJob(c Context, job *Job) {
+	err := q.callJob(c, job)
+	if err == nil {
+		err = q.store.DeleteJob(c, job.Id)
+		if err != nil {
+			c.Errorf("Could not delete job %s: %s", job.Id, err.Error())
+		}
+		q.jobDone(c, job)
+		return
+	}
+
+	c.Errorf("Job %s (%s) failed on attempt %d: %s", job.Id, job.Name, job.Attempts, err.Error())
+	if job.Attempts >= q.MaxAttempts {
+		c.Errorf("  Giving up on job %s", job.Id)
+		err = q.store.DeleteJob(c, job.Id)
+		if err != nil {
+			c.Errorf("Could not delete job %s: %s", job.Id, err.Error())
+		}
+		q.jobDone(c, job)
+		return
+	}
+	job.RunAt = q.now().Add(q.backoff(job.Attempts))
+	job.LastError = err.Error()
+	err = q.store.UpdateJob(c, job)
+	if err != nil {
+		c.Errorf("Could not reschedule job %s: %s", job.Id, err.Error())
+	}
+}
+
+func (q *JobQueue) jobDone(c Context, job *Job) {
+	q.periodicMutex.Lock()
+	_, isPeriodic := q.periodicJobs[job.Name]
+	q.periodicMutex.Unlock()
+	if isPeriodic {
+		err := q.schedulePeriodic(c, job.Name)
+		if err != nil {
+			c.Errorf("Could not schedule next %s job: %s", job.Name, err.Error())
+		}
+	}
+}
+
+func (q *JobQueue) callJob(c Context, job *Job) (err error) {
+	defer func() {
+		if panicData := recover(); panicData != nil {
+			err = fmt.Errorf("Panic: %+v\n\n%s", panicData, stack(3))
+		}
+	}()
+	jobFunc, ok := jobFuncs[job.Name]
+	if !ok {
+		return fmt.Errorf("No job function registered for %s", job.Name)
+	}
+	if len(job.Args) != len(jobFunc.argTypes) {
+		return fmt.Errorf("Job has %d arguments, %s takes %d",
+			len(job.Args), job.Name, len(jobFunc.argTypes))
+	}
+	argValues := make([]reflect.Value, len(job.Args)+1)
+	argValues[0] = reflect.ValueOf(&c).Elem()
+	for i, argType := range jobFunc.argTypes {
+		argValue := reflect.New(argType)
+		err := json.Unmarshal(job.Args[i], argValue.Interface())
+		if err != nil {
+			return err
+		}
+		argValues[i+1] = argValue.Elem()
+	}
+	results := jobFunc.fn.Call(argValues)
+	if len(results) == 1 && !results[0].IsNil() {
+		return results[0].Interface().(error)
+	}
+	return nil
+}
+
+func (q *JobQueue) backoff(attempts int) time.Duration {
+	backoff := q.MinBackoff
+	for i := 1; i < attempts && backoff < q.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.MaxBackoff {
+		backoff = q.MaxBackoff
+	}
+	return backoff
+}
+
+// Start runs pending jobs every pollInterval, in the background.
+func (q *JobQueue) Start(c Context, pollInterval time.Duration) {
+	go func() {
+		for {
+			_, err := q.RunPending(c)
+			if err != nil {
+				c.Errorf("Could not run jobs: %s", err.Error())
+			}
+			time.Sleep(pollInterval)
+		}
+	}()
+}
+
+// sort.Interface implementation for sorting Jobs by when they're due.
+type JobsByRunAt []*Job
+
+func (a JobsByRunAt) Len() int           { return len(a) }
+func (a JobsByRunAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a JobsByRunAt) Less(i, j int) bool { return a[i].RunAt.Before(a[j].RunAt) }
@@ -0,0 +1,275 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a time source for JobQueue that only moves when advanced.
+type fakeClock struct {
+	mutex sync.Mutex
+	time  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.time
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.time = c.time.Add(d)
+}
+
+// jobRecorder keeps track of the calls that test job functions get.
+type jobRecorder struct {
+	mutex sync.Mutex
+	calls []string
+}
+
+func (r *jobRecorder) record(call string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *jobRecorder) takeCalls() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	calls := r.calls
+	r.calls = nil
+	return calls
+}
+
+var testJobRecorder jobRecorder
+
+// periodicRecorder keeps track of the times that the periodic test job was
+// scheduled for.
+type periodicRecorder struct {
+	mutex    sync.Mutex
+	runTimes []time.Time
+}
+
+func (r *periodicRecorder) record(runAt time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.runTimes = append(r.runTimes, runAt)
+}
+
+func (r *periodicRecorder) take() []time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	runTimes := r.runTimes
+	r.runTimes = nil
+	return runTimes
+}
+
+var testPeriodicRunTimes periodicRecorder
+
+// Number of times that the flaky test job still fails before it succeeds.
+var testJobFailures int
+
+func init() {
+	registerJobFunc("test-record", func(c Context, value string) {
+		testJobRecorder.record(value)
+	})
+	registerJobFunc("test-flaky", func(c Context, value string) error {
+		testJobRecorder.record(value)
+		if testJobFailures > 0 {
+			testJobFailures--
+			return errors.New("flaky")
+		}
+		return nil
+	})
+	registerJobFunc("test-periodic", func(c Context, runAt time.Time) {
+		testPeriodicRunTimes.record(runAt)
+	})
+}
+
+func newTestJobQueue(t *testing.T) (*JobQueue, *fakeClock, func()) {
+	dir, err := ioutil.TempDir("", "retrogit-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newBoltStorage(filepath.Join(dir, "jobs.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	clock := &fakeClock{time: time.Date(2015, time.March, 4, 12, 0, 0, 0, time.UTC)}
+	queue := newJobQueue(store, clock.now)
+	// A single worker makes the order that due jobs are run in observable.
+	queue.Workers = 1
+	testJobRecorder.takeCalls()
+	return queue, clock, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func runPendingJobs(t *testing.T, queue *JobQueue, c Context) []string {
+	_, err := queue.RunPending(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testJobRecorder.takeCalls()
+}
+
+func TestJobQueueRunsJobsWhenDueInOrder(t *testing.T) {
+	queue, clock, cleanup := newTestJobQueue(t)
+	defer cleanup()
+	c := &logContext{}
+
+	for _, job := range []struct {
+		value string
+		delay time.Duration
+	}{
+		{"third", time.Minute * 3},
+		{"first", time.Minute},
+		{"second", time.Minute * 2},
+		{"now", 0},
+	} {
+		err := queue.Add(c, "test-record", job.delay, job.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls := runPendingJobs(t, queue, c); !reflect.DeepEqual(calls, []string{"now"}) {
+		t.Errorf("Jobs run immediately: %v", calls)
+	}
+	clock.advance(time.Second * 90)
+	if calls := runPendingJobs(t, queue, c); !reflect.DeepEqual(calls, []string{"first"}) {
+		t.Errorf("Jobs run after 90 seconds: %v", calls)
+	}
+	clock.advance(time.Hour)
+	if calls := runPendingJobs(t, queue, c); !reflect.DeepEqual(calls, []string{"second", "third"}) {
+		t.Errorf("Jobs run after an hour: %v", calls)
+	}
+	if calls := runPendingJobs(t, queue, c); len(calls) != 0 {
+		t.Errorf("Jobs were run again: %v", calls)
+	}
+}
+
+func TestJobQueueRetriesWithBackoff(t *testing.T) {
+	queue, clock, cleanup := newTestJobQueue(t)
+	defer cleanup()
+	c := &logContext{}
+	testJobFailures = 2
+
+	err := queue.Add(c, "test-flaky", 0, "attempt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := runPendingJobs(t, queue, c); len(calls) != 1 {
+		t.Fatalf("Expected one attempt, got %v", calls)
+	}
+
+	// The first retry is after MinBackoff, the second after twice that.
+	clock.advance(queue.MinBackoff - time.Second)
+	if calls := runPendingJobs(t, queue, c); len(calls) != 0 {
+		t.Errorf("Retried before the backoff: %v", calls)
+	}
+	clock.advance(time.Second)
+	if calls := runPendingJobs(t, queue, c); len(calls) != 1 {
+		t.Errorf("Expected a retry after the backoff, got %v", calls)
+	}
+	clock.advance(queue.MinBackoff)
+	if calls := runPendingJobs(t, queue, c); len(calls) != 0 {
+		t.Errorf("Backoff was not doubled: %v", calls)
+	}
+	clock.advance(queue.MinBackoff)
+	if calls := runPendingJobs(t, queue, c); len(calls) != 1 {
+		t.Errorf("Expected a second retry, got %v", calls)
+	}
+
+	// The job succeeded, so it's not run again.
+	clock.advance(queue.MaxBackoff)
+	if calls := runPendingJobs(t, queue, c); len(calls) != 0 {
+		t.Errorf("Job was run after it succeeded: %v", calls)
+	}
+}
+
+func TestJobQueueGivesUpAfterMaxAttempts(t *testing.T) {
+	queue, clock, cleanup := newTestJobQueue(t)
+	defer cleanup()
+	c := &logContext{}
+	queue.MaxAttempts = 3
+	testJobFailures = 100
+	defer func() { testJobFailures = 0 }()
+
+	err := queue.Add(c, "test-flaky", 0, "attempt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempts := 0
+	for i := 0; i < 10; i++ {
+		attempts += len(runPendingJobs(t, queue, c))
+		clock.advance(queue.MaxBackoff)
+	}
+	if attempts != queue.MaxAttempts {
+		t.Errorf("Expected %d attempts, got %d", queue.MaxAttempts, attempts)
+	}
+}
+
+func TestJobQueueBackoffIsCapped(t *testing.T) {
+	queue := newJobQueue(nil, time.Now)
+	for attempts, expected := range []time.Duration{
+		queue.MinBackoff, queue.MinBackoff, queue.MinBackoff * 2, queue.MinBackoff * 4} {
+		if backoff := queue.backoff(attempts); backoff != expected {
+			t.Errorf("Backoff after %d attempts: %s, expected %s", attempts, backoff, expected)
+		}
+	}
+	if backoff := queue.backoff(100); backoff != queue.MaxBackoff {
+		t.Errorf("Backoff after 100 attempts: %s, expected %s", backoff, queue.MaxBackoff)
+	}
+}
+
+func TestJobQueuePeriodic(t *testing.T) {
+	queue, clock, cleanup := newTestJobQueue(t)
+	defer cleanup()
+	c := &logContext{}
+
+	nextHour := func(now time.Time) time.Time {
+		return now.Truncate(time.Hour).Add(time.Hour)
+	}
+	testPeriodicRunTimes.take()
+	err := queue.AddPeriodic(c, "test-periodic", nextHour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scheduling again (e.g. on a restart) doesn't add a duplicate run.
+	err = queue.schedulePeriodic(c, "test-periodic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := clock.now()
+	runPendingJobs(t, queue, c)
+	clock.advance(time.Hour)
+	runPendingJobs(t, queue, c)
+	clock.advance(time.Hour)
+	runPendingJobs(t, queue, c)
+
+	expected := []time.Time{start.Add(time.Hour), start.Add(time.Hour * 2)}
+	runTimes := testPeriodicRunTimes.take()
+	if len(runTimes) != len(expected) {
+		t.Fatalf("Expected runs at %v, got %v", expected, runTimes)
+	}
+	for i := range expected {
+		if !runTimes[i].Equal(expected[i]) {
+			t.Errorf("Run %d was for %s, expected %s", i, runTimes[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,380 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// Number of fields in localGitLogFormat.
+const localGitLogFieldCount = 8
+
+// Commits are separated by NUL bytes (via -z), and so are their fields.
+const localGitLogFormat = "%H%x00%an%x00%ae%x00%at%x00%cn%x00%ce%x00%ct%x00%B"
+
+// LocalGitProvider reads repositories from the server's filesystem (or from
+// mounts on it) with the git command, so that ones that are never pushed to a
+// hosting service can be included in digests too. Which repositories are
+// read is configured per account, as path globs, and commits are attributed to
+// the user by their author email address (or one of their aliases).
+type LocalGitProvider struct {
+	globs   []string
+	emails  []string
+	aliases []string
+	// Directories that globs are allowed to match repositories in, with
+	// symlinks resolved (like the paths that are checked against them).
+	roots []string
+
+	mutex sync.Mutex
+	repos []github.Repository
+}
+
+func localRepositoriesEnabled() bool {
+	return len(serverConfig.LocalRepositoryRoots) > 0
+}
+
+func newLocalGitProvider(account *Account) (Provider, error) {
+	if !localRepositoriesEnabled() {
+		return nil, errors.New("Local repositories are not enabled on this server")
+	}
+	if len(account.LocalAuthorEmails) == 0 {
+		return nil, errors.New("No author emails for local repositories")
+	}
+	roots := make([]string, 0, len(serverConfig.LocalRepositoryRoots))
+	for _, root := range serverConfig.LocalRepositoryRoots {
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			// Nothing can be in a root that doesn't exist.
+			continue
+		}
+		roots = append(roots, resolvedRoot)
+	}
+	return &LocalGitProvider{
+		globs:   account.LocalRepositoryGlobs,
+		emails:  account.LocalAuthorEmails,
+		aliases: account.AuthorAliases,
+		roots:   roots,
+	}, nil
+}
+
+func (p *LocalGitProvider) Name() string {
+	return "Local"
+}
+
+// GetUser returns a stand-in user for the first author email, since local
+// repositories have no accounts.
+func (p *LocalGitProvider) GetUser() (*github.User, error) {
+	id := -localGitRepoIdOffset
+	login := p.emails[0]
+	htmlURL := "mailto:" + login
+	avatarURL := fmt.Sprintf("https://www.gravatar.com/avatar/%x?d=identicon",
+		md5.Sum([]byte(strings.ToLower(login))))
+	return &github.User{
+		ID:        &id,
+		Login:     &login,
+		Email:     &login,
+		HTMLURL:   &htmlURL,
+		AvatarURL: &avatarURL,
+	}, nil
+}
+
+func (p *LocalGitProvider) GetEmails() ([]github.UserEmail, error) {
+	emails := make([]github.UserEmail, len(p.emails))
+	for i := range p.emails {
+		primary, verified := i == 0, true
+		emails[i] = github.UserEmail{Email: &p.emails[i], Primary: &primary, Verified: &verified}
+	}
+	return emails, nil
+}
+
+// ListRepos returns the repositories that the globs match, all of which are
+// owned by the user. Repositories without any commits on their branches are
+// left out, since they can't have any digest activity.
+func (p *LocalGitProvider) ListRepos() ([]github.Repository, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.repos != nil {
+		return p.repos, nil
+	}
+	user, _ := p.GetUser()
+	repos := make([]github.Repository, 0)
+	seenPaths := make(map[string]bool)
+	for _, glob := range p.globs {
+		paths, err := filepath.Glob(glob)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			path, err = filepath.EvalSymlinks(path)
+			if err != nil || seenPaths[path] || !p.isAllowedPath(path) || !isLocalGitRepository(path) {
+				continue
+			}
+			seenPaths[path] = true
+			repo, err := newLocalGitRepository(path, user)
+			if err != nil {
+				return nil, err
+			}
+			if repo != nil {
+				repos = append(repos, *repo)
+			}
+		}
+	}
+	p.repos = repos
+	return repos, nil
+}
+
+func (p *LocalGitProvider) isAllowedPath(path string) bool {
+	for _, root := range p.roots {
+		relativePath, err := filepath.Rel(root, path)
+		if err == nil && relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalGitRepository returns whether path is a working copy or a bare
+// repository.
+func isLocalGitRepository(path string) bool {
+	if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+		return true
+	}
+	_, headErr := os.Stat(filepath.Join(path, "HEAD"))
+	_, objectsErr := os.Stat(filepath.Join(path, "objects"))
+	return headErr == nil && objectsErr == nil
+}
+
+// newLocalGitRepository describes the repository at path, with its oldest
+// commit as its creation time and its newest commit as its last push. Commits
+// aren't necessarily in time order (e.g. if they were rebased), so all of them
+// have to be looked at. It returns nil if the repository has no commits.
+func newLocalGitRepository(path string, user *github.User) (*github.Repository, error) {
+	commitTimes, err := localGitCommitTimes(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(commitTimes) == 0 {
+		return nil, nil
+	}
+	createdAt, pushedAt := commitTimes[0], commitTimes[0]
+	for _, commitTime := range commitTimes {
+		if commitTime.Before(createdAt) {
+			createdAt = commitTime
+		}
+		if commitTime.After(pushedAt) {
+			pushedAt = commitTime
+		}
+	}
+
+	pathHash := fnv.New64a()
+	pathHash.Write([]byte(path))
+	id := -(localGitRepoIdOffset + int(pathHash.Sum64()%(1<<50)))
+	// The path is both the name and the full name, since it's what
+	// GetVintage needs to find the repository again.
+	name := path
+	htmlURL := "file://" + filepath.ToSlash(path)
+	fork, private := false, true
+	return &github.Repository{
+		ID:        &id,
+		Owner:     user,
+		Name:      &name,
+		FullName:  &name,
+		HTMLURL:   &htmlURL,
+		CreatedAt: &github.Timestamp{Time: createdAt},
+		PushedAt:  &github.Timestamp{Time: pushedAt},
+		Fork:      &fork,
+		Private:   &private,
+	}, nil
+}
+
+// localGitCommitTimes returns the commit times of all of the commits on the
+// repository's branches.
+func localGitCommitTimes(path string) ([]time.Time, error) {
+	output, err := runLocalGit(path, "rev-list", "--branches", "--timestamp")
+	if err != nil {
+		return nil, err
+	}
+	times := make([]time.Time, 0)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line == "" {
+			continue
+		}
+		// Each line is "<timestamp> <SHA>".
+		timestamp, err := strconv.ParseInt(strings.Fields(line)[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed commit time %s in %s", line, path)
+		}
+		times = append(times, time.Unix(timestamp, 0).UTC())
+	}
+	return times, nil
+}
+
+func runLocalGit(path string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", path}, args...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("git %s in %s failed: %s %s", args[0], path, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (p *LocalGitProvider) ListOrgs() ([]github.Organization, error) {
+	return []github.Organization{}, nil
+}
+
+func (p *LocalGitProvider) ListOrgRepos(org *github.Organization) ([]github.Repository, error) {
+	return []github.Repository{}, nil
+}
+
+// ListCommits walks the history of all of the repository's branches. Since
+// local repositories don't record pushes, the commit time is used instead.
+// startTime is checked here rather than with --since, which stops the walk at
+// the first older commit, and so misses ones that are out of order (e.g.
+// because they were rebased or cherry-picked). Authors are matched here too
+// rather than with --author, which can't match Co-authored-by trailers.
+func (p *LocalGitProvider) ListCommits(pool *GitHubWorkerPool, repo *Repo, startTime time.Time, endTime time.Time) ([]github.RepositoryCommit, error) {
+	output, err := runLocalGit(*repo.FullName,
+		"log",
+		"--branches",
+		"-z",
+		"--format="+localGitLogFormat,
+		fmt.Sprintf("--until=%d", endTime.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	commits := make([]github.RepositoryCommit, 0)
+	if output == "" {
+		return commits, nil
+	}
+	fields := strings.Split(strings.TrimSuffix(output, "\x00"), "\x00")
+	if len(fields)%localGitLogFieldCount != 0 {
+		return nil, fmt.Errorf("Malformed git log output for %s", *repo.FullName)
+	}
+	for i := 0; i < len(fields); i += localGitLogFieldCount {
+		commit, err := newLocalGitCommit(fields[i : i+localGitLogFieldCount])
+		if err != nil {
+			return nil, err
+		}
+		// --until is inclusive, unlike digest intervals.
+		committerDate := *commit.Commit.Committer.Date
+		if committerDate.Before(startTime) || !committerDate.Before(endTime) {
+			continue
+		}
+		commits = append(commits, commit)
+	}
+	return p.authorMatcher().filter(commits), nil
+}
+
+func (p *LocalGitProvider) authorMatcher() *AuthorMatcher {
+	matcher := newAuthorMatcher()
+	for _, email := range p.emails {
+		matcher.addEmail(email)
+	}
+	matcher.addAliases(p.aliases)
+	return matcher
+}
+
+func newLocalGitCommit(fields []string) (github.RepositoryCommit, error) {
+	sha, authorName, authorEmail := fields[0], fields[1], fields[2]
+	committerName, committerEmail := fields[4], fields[5]
+	message := strings.TrimRight(fields[7], "\n")
+	authorTimestamp, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return github.RepositoryCommit{}, err
+	}
+	committerTimestamp, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return github.RepositoryCommit{}, err
+	}
+	authorDate := time.Unix(authorTimestamp, 0).UTC()
+	committerDate := time.Unix(committerTimestamp, 0).UTC()
+	return github.RepositoryCommit{
+		SHA: &sha,
+		Commit: &github.Commit{
+			SHA:     &sha,
+			Message: &message,
+			Author: &github.CommitAuthor{
+				Date:  &authorDate,
+				Name:  &authorName,
+				Email: &authorEmail,
+			},
+			Committer: &github.CommitAuthor{
+				Date:  &committerDate,
+				Name:  &committerName,
+				Email: &committerEmail,
+			},
+		},
+	}, nil
+}
+
+// GetVintage returns the repository's creation time (i.e. that of its oldest
+// root commit), which is cheap to compute locally. repoName is its path. It's
+// looked at directly rather than via ListRepos (since vintages are computed
+// one repository at a time, each with a new provider), unless it doesn't
+// match any of the globs as is (e.g. because they go through symlinks).
+func (p *LocalGitProvider) GetVintage(repoOwnerLogin string, repoName string) (time.Time, error) {
+	p.mutex.Lock()
+	repos := p.repos
+	p.mutex.Unlock()
+	if repos == nil && p.matchesGlob(repoName) {
+		path, err := filepath.EvalSymlinks(repoName)
+		if err != nil || path != repoName || !p.isAllowedPath(path) || !isLocalGitRepository(path) {
+			return time.Time{}, ErrRepoNotAccessible
+		}
+		user, _ := p.GetUser()
+		repo, err := newLocalGitRepository(path, user)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if repo == nil {
+			return time.Time{}, ErrRepoNotAccessible
+		}
+		return repo.CreatedAt.UTC(), nil
+	}
+
+	repos, err := p.ListRepos()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, repo := range repos {
+		if *repo.FullName == repoName {
+			return repo.CreatedAt.UTC(), nil
+		}
+	}
+	return time.Time{}, ErrRepoNotAccessible
+}
+
+func (p *LocalGitProvider) matchesGlob(path string) bool {
+	for _, glob := range p.globs {
+		if matched, err := filepath.Match(glob, path); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// CommitURL returns an empty URL, since local commits can't be linked to.
+func (p *LocalGitProvider) CommitURL(repo *Repo, sha string) string {
+	return ""
+}
+
+func (p *LocalGitProvider) OwnsRepoId(repoId int) bool {
+	return repoId <= -localGitRepoIdOffset
+}
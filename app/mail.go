@@ -0,0 +1,150 @@
+package retrogit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+type MailMessage struct {
+	Sender   string
+	To       []string
+	Subject  string
+	Body     string
+	HTMLBody string
+}
+
+type Mailer interface {
+	Send(c Context, message *MailMessage) error
+}
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Fail instead of sending in the clear if the server doesn't support
+	// STARTTLS.
+	RequireTLS bool
+}
+
+type MailConfig struct {
+	// One of the backends supported by newMailer in the current build
+	// ("appengine" on App Engine, "smtp" or "file" otherwise). Defaults to
+	// the first one.
+	Backend string
+	// Sender for digests and other user-facing emails.
+	DigestSender string
+	// Sender and recipients of internal error reports. No reports are sent if
+	// there are no recipients.
+	AdminSender     string
+	AdminRecipients []string
+	SMTP            SMTPConfig
+	// Directory that the "file" backend writes .eml files into.
+	DropDirectory string
+}
+
+func initMail() (mailer Mailer, mailConfig MailConfig) {
+	mailConfig.DigestSender = "RetroGit <digests@retrogit.com>"
+	mailConfig.AdminSender = "RetroGit Admin <digests@retrogit.com>"
+	mailConfig.DropDirectory = "mail"
+	configBytes, err := ioutil.ReadFile("config/mail.json")
+	if err == nil {
+		err = json.Unmarshal(configBytes, &mailConfig)
+		if err != nil {
+			log.Panicf("Could not parse mail config %s: %s", configBytes, err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		log.Panicf("Could not read mail config: %s", err.Error())
+	}
+	mailer, err = newMailer(mailConfig)
+	if err != nil {
+		log.Panicf("Could not initialize %s mailer: %s", mailConfig.Backend, err.Error())
+	}
+	return
+}
+
+// formatMailMessage serializes a message in RFC 5322 format, for backends that
+// don't have their own message representation. If both a plain text and an
+// HTML body are present, they are sent as multipart/alternative parts.
+func formatMailMessage(message *MailMessage) ([]byte, error) {
+	var buffer bytes.Buffer
+	header := textproto.MIMEHeader{}
+	header.Set("From", message.Sender)
+	header.Set("To", strings.Join(message.To, ", "))
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", message.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("MIME-Version", "1.0")
+
+	if message.Body != "" && message.HTMLBody != "" {
+		writer := multipart.NewWriter(&buffer)
+		header.Set("Content-Type",
+			fmt.Sprintf("multipart/alternative; boundary=%s", writer.Boundary()))
+		writeMailHeader(&buffer, header)
+		err := writeMailPart(writer, "text/plain", message.Body)
+		if err != nil {
+			return nil, err
+		}
+		err = writeMailPart(writer, "text/html", message.HTMLBody)
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+
+	contentType, body := "text/plain", message.Body
+	if message.HTMLBody != "" {
+		contentType, body = "text/html", message.HTMLBody
+	}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	writeMailHeader(&buffer, header)
+	err := writeQuotedPrintable(&buffer, body)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeMailHeader(w io.Writer, header textproto.MIMEHeader) {
+	for name, values := range header {
+		for _, value := range values {
+			fmt.Fprintf(w, "%s: %s\r\n", name, value)
+		}
+	}
+	fmt.Fprint(w, "\r\n")
+}
+
+func writeMailPart(writer *multipart.Writer, contentType string, body string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	return writeQuotedPrintable(part, body)
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qpWriter := quotedprintable.NewWriter(w)
+	_, err := io.WriteString(qpWriter, body)
+	if err != nil {
+		return err
+	}
+	return qpWriter.Close()
+}
@@ -0,0 +1,36 @@
+//go:build appengine
+// +build appengine
+
+package retrogit
+
+import (
+	"appengine"
+	"appengine/memcache"
+)
+
+// Stores responses in App Engine's memcache, which evicts them as needed, so
+// only the per-response size limit applies.
+type MemcacheResponseCache struct {
+	maxEntryBytes int
+}
+
+func (cache *MemcacheResponseCache) Get(c Context, key string) ([]byte, bool, error) {
+	item, err := memcache.Get(c.(appengine.Context), key)
+	if err == memcache.ErrCacheMiss {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return item.Value, true, nil
+}
+
+func (cache *MemcacheResponseCache) Put(c Context, key string, value []byte) error {
+	if len(value) > cache.maxEntryBytes {
+		return nil
+	}
+	return memcache.Set(c.(appengine.Context), &memcache.Item{
+		Key:   key,
+		Value: value,
+	})
+}
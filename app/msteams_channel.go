@@ -0,0 +1,131 @@
+package retrogit
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	AdaptiveCardSchema  = "http://adaptivecards.io/schemas/adaptive-card.json"
+	AdaptiveCardVersion = "1.2"
+	// Teams rejects larger cards.
+	maxTeamsCardElements = 100
+)
+
+// TeamsChannel posts digests to a Microsoft Teams incoming webhook (or
+// workflow), formatted as an Adaptive Card.
+type TeamsChannel struct {
+	WebhookURL string
+}
+
+type adaptiveCardElement struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Size     string `json:"size,omitempty"`
+	Weight   string `json:"weight,omitempty"`
+	IsSubtle bool   `json:"isSubtle,omitempty"`
+	Spacing  string `json:"spacing,omitempty"`
+	Wrap     bool   `json:"wrap"`
+}
+
+type adaptiveCardAction struct {
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+type adaptiveCard struct {
+	Schema  string                `json:"$schema"`
+	Type    string                `json:"type"`
+	Version string                `json:"version"`
+	Body    []adaptiveCardElement `json:"body"`
+	Actions []adaptiveCardAction  `json:"actions"`
+}
+
+type teamsAttachment struct {
+	ContentType string        `json:"contentType"`
+	Content     *adaptiveCard `json:"content"`
+}
+
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+func (channel *TeamsChannel) Name() string {
+	return "Microsoft Teams"
+}
+
+func (channel *TeamsChannel) Deliver(c Context, digest *Digest) error {
+	return postWebhookPayload(c, channel.WebhookURL, newTeamsMessage(digest))
+}
+
+func newTeamsMessage(digest *Digest) *teamsMessage {
+	body := []adaptiveCardElement{
+		{Type: "TextBlock", Text: teamsEscape(digestSummary(digest)), Wrap: true},
+	}
+	for _, intervalDigest := range digest.IntervalDigests {
+		body = append(body,
+			adaptiveCardElement{Type: "TextBlock", Text: intervalDigest.Header(),
+				Size: "Large", Weight: "Bolder", Spacing: "Large", Wrap: true},
+			adaptiveCardElement{Type: "TextBlock", Text: teamsEscape(unsafeFormattedText(intervalDigest.Description())),
+				IsSubtle: true, Wrap: true})
+		for _, repoDigest := range intervalDigest.RepoDigests {
+			lines := make([]string, 0, len(repoDigest.Commits))
+			for i, commit := range repoDigest.Commits {
+				if i == MaxChatCommitsPerRepo {
+					lines = append(lines, fmt.Sprintf("- …and %d more", len(repoDigest.Commits)-i))
+					break
+				}
+				lines = append(lines, fmt.Sprintf("- [%s](%s) %s _%s_",
+					commit.DisplaySHA, commit.URL, teamsEscape(commit.Title),
+					chatDisplayDate(intervalDigest, commit.DisplayDate(), commit.WeeklyDisplayDate())))
+			}
+			body = append(body,
+				adaptiveCardElement{Type: "TextBlock",
+					Text:   fmt.Sprintf("[%s](%s)", teamsEscape(*repoDigest.Repo.FullName), *repoDigest.Repo.HTMLURL),
+					Weight: "Bolder", Spacing: "Medium", Wrap: true},
+				// Adaptive Card lists need carriage returns between items.
+				adaptiveCardElement{Type: "TextBlock", Text: strings.Join(lines, "\r"), Spacing: "Small", Wrap: true})
+		}
+		for _, section := range chatActivitySections(intervalDigest) {
+			lines := make([]string, 0, len(section.Items))
+			for _, item := range section.Items {
+				lines = append(lines, fmt.Sprintf("- %s [%s](%s) %s _%s_",
+					item.Action, teamsEscape(item.Label), item.URL, teamsEscape(item.Title), item.Date))
+			}
+			body = append(body,
+				adaptiveCardElement{Type: "TextBlock", Text: section.Title, Weight: "Bolder", Spacing: "Medium", Wrap: true},
+				adaptiveCardElement{Type: "TextBlock", Text: strings.Join(lines, "\r"), Spacing: "Small", Wrap: true})
+		}
+	}
+	if len(body) > maxTeamsCardElements {
+		body = append(body[:maxTeamsCardElements-1], adaptiveCardElement{
+			Type: "TextBlock", Text: "…", Wrap: true})
+	}
+
+	return &teamsMessage{
+		Type: "message",
+		Attachments: []teamsAttachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content: &adaptiveCard{
+				Schema:  AdaptiveCardSchema,
+				Type:    "AdaptiveCard",
+				Version: AdaptiveCardVersion,
+				Body:    body,
+				Actions: []adaptiveCardAction{
+					{Type: "Action.OpenUrl", Title: "View the full digest", URL: viewDigestURL()},
+				},
+			},
+		}},
+	}
+}
+
+// teamsEscape escapes the characters that have special meaning in the
+// Markdown subset that Adaptive Card text blocks support.
+func teamsEscape(text string) string {
+	for _, c := range []string{"\\", "*", "_", "[", "]", "`"} {
+		text = strings.Replace(text, c, "\\"+c, -1)
+	}
+	return text
+}
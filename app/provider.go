@@ -0,0 +1,109 @@
+package retrogit
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+var ErrRepoNotAccessible = errors.New("Repository is not accessible")
+var ErrVintageNotReady = errors.New("Vintage can't be computed yet")
+
+const localGitRepoIdOffset = 1 << 40
+
+// Provider is a source control host that an account's repositories and commits
+// come from. Like GraphQLCommitFetcher, providers return go-github's types
+// regardless of where the data came from, so that repos, digests and templates
+// don't need to know about them.
+//
+// Repository IDs are used as keys for exclusions, vintages and the commit
+// index, so providers other than GitHub (which only uses positive IDs) map
+// theirs to negative ones that can't collide with it. GitLab's are above
+// -localGitRepoIdOffset, and local repositories' are at or below it.
+type Provider interface {
+	// Shown to users, e.g. "GitHub".
+	Name() string
+	// GetUser returns the user that the provider is authenticated as, whose
+	// commits are included in digests.
+	GetUser() (*github.User, error)
+	GetEmails() ([]github.UserEmail, error)
+	// ListRepos returns the repositories that the user has access to, other
+	// than the ones that they have access to via ListOrgs.
+	ListRepos() ([]github.Repository, error)
+	// ListOrgs returns the organizations (or their equivalent) that the user
+	// is a member of.
+	ListOrgs() ([]github.Organization, error)
+	ListOrgRepos(org *github.Organization) ([]github.Repository, error)
+	// ListCommits returns the commits that the user pushed to repo between
+	// startTime and endTime, newest first. Requests are made via pool, so
+	// that they respect rate limits.
+	ListCommits(pool *GitHubWorkerPool, repo *Repo, startTime time.Time, endTime time.Time) ([]github.RepositoryCommit, error)
+	// GetVintage returns the time before which the user can't have commits in
+	// a repository. It returns ErrRepoNotAccessible if the repository can't
+	// be looked up, and ErrVintageNotReady if it should be retried later.
+	GetVintage(repoOwnerLogin string, repoName string) (time.Time, error)
+	CommitURL(repo *Repo, sha string) string
+	// OwnsRepoId returns whether repoId is one of the IDs that the provider
+	// gives its repositories.
+	OwnsRepoId(repoId int) bool
+}
+
+// Providers returns the sources of the account's repositories and commits:
+// GitHub (via githubClient, which must be authenticated as the account's user,
+// who can be passed in as user if already known), its linked identities and
+// any others that the account has connected. githubClient is nil when
+// generating digests offline, from local repositories only.
+func (account *Account) Providers(c Context, githubClient *github.Client, user *github.User) []Provider {
+	providers := make([]Provider, 0)
+	if githubClient != nil {
+		githubProvider := newGitHubProvider(githubClient, user)
+		githubProvider.aliases = account.AuthorAliases
+		providers = append(providers, githubProvider)
+		for i := range account.LinkedIdentities {
+			identity := &account.LinkedIdentities[i]
+			identityProvider := newGitHubProvider(identity.githubClient(c), identity.githubUser())
+			identityProvider.aliases = account.AuthorAliases
+			providers = append(providers, identityProvider)
+		}
+	}
+	if account.GitLabToken != "" {
+		gitlabProvider := newGitLabProvider(c, account.GitLabURL, account.GitLabToken)
+		gitlabProvider.aliases = account.AuthorAliases
+		providers = append(providers, gitlabProvider)
+	}
+	if len(account.LocalRepositoryGlobs) > 0 {
+		provider, err := newLocalGitProvider(account)
+		if err != nil {
+			c.Errorf("Could not read local repositories: %s", err.Error())
+		} else {
+			providers = append(providers, provider)
+		}
+	}
+	return providers
+}
+
+// validateLocalRepositoryGlob checks that glob is a well-formed absolute
+// pattern. Whether it matches anything (under the allowed roots) is only
+// known when repositories are listed.
+func validateLocalRepositoryGlob(glob string) error {
+	if !filepath.IsAbs(glob) {
+		return fmt.Errorf("Local repository path %s is not absolute", glob)
+	}
+	_, err := filepath.Match(glob, "")
+	return err
+}
+
+// providersForRepo returns the providers that repoId is from. Several linked
+// GitHub identities can have access to the same repository.
+func providersForRepo(providers []Provider, repoId int) []Provider {
+	repoProviders := make([]Provider, 0)
+	for _, provider := range providers {
+		if provider.OwnsRepoId(repoId) {
+			repoProviders = append(repoProviders, provider)
+		}
+	}
+	return repoProviders
+}
@@ -0,0 +1,160 @@
+package retrogit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Requests to user-provided URLs (webhooks and GitLab instances) are made by
+// the server, so they must not be able to reach its own network, e.g. other
+// internal services or the cloud metadata endpoint at 169.254.169.254. Hosts
+// are checked both when URLs are saved and when they're connected to, since
+// what they resolve to can change in between.
+var nonPublicIPNets = parseCIDRs(
+	"0.0.0.0/8",      // "This" network
+	"10.0.0.0/8",     // Private
+	"100.64.0.0/10",  // Carrier-grade NAT
+	"127.0.0.0/8",    // Loopback
+	"169.254.0.0/16", // Link-local
+	"172.16.0.0/12",  // Private
+	"192.168.0.0/16", // Private
+	"224.0.0.0/4",    // Multicast
+	"240.0.0.0/4",    // Reserved
+	"::/128",         // Unspecified
+	"::1/128",        // Loopback
+	"fc00::/7",       // Unique local
+	"fe80::/10",      // Link-local
+	"ff00::/8",       // Multicast
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	ipNets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets
+}
+
+func isPublicIP(ip net.IP) bool {
+	// IPv4-mapped IPv6 addresses are checked as IPv4 ones.
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipNet := range nonPublicIPNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupPublicIPs resolves host, and returns an error if any of its addresses
+// are not public (unless privateURLsAllowed).
+func lookupPublicIPs(host string) ([]net.IP, error) {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return nil, fmt.Errorf("Could not resolve %s: %s", host, err.Error())
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("%s has no addresses", host)
+		}
+	}
+	if privateURLsAllowed() {
+		return ips, nil
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return nil, fmt.Errorf("%s is not a public address", host)
+		}
+	}
+	return ips, nil
+}
+
+// validatePublicURL checks that a user-provided URL (described by kind in
+// errors) is an HTTPS one on a public host. Plain HTTP URLs are only allowed
+// in development, so that local stand-ins can be used.
+func validatePublicURL(kind string, rawURL string) error {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if parsedURL.Host == "" {
+		return fmt.Errorf("%s URL %s has no host", kind, rawURL)
+	}
+	if parsedURL.Scheme != "https" && !(parsedURL.Scheme == "http" && isDevelopment()) {
+		return fmt.Errorf("%s URL %s must use HTTPS", kind, rawURL)
+	}
+	_, err = lookupPublicIPs(urlHostname(parsedURL))
+	if err != nil {
+		return fmt.Errorf("%s URL %s can't be used: %s", kind, rawURL, err.Error())
+	}
+	return nil
+}
+
+// urlHostname returns the host of parsedURL without its port (or the brackets
+// around IPv6 addresses).
+func urlHostname(parsedURL *url.URL) string {
+	host, _, err := net.SplitHostPort(parsedURL.Host)
+	if err != nil {
+		host = parsedURL.Host
+		if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+			host = host[1 : len(host)-1]
+		}
+	}
+	return host
+}
+
+// dialPublic wraps dialer's Dial, and only connects to public addresses. The
+// checked address is the one that's dialed, so that the host can't resolve
+// to a different one by then.
+func dialPublic(dialer *net.Dialer) func(network string, address string) (net.Conn, error) {
+	return func(network string, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := lookupPublicIPs(host)
+		if err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		for _, ip := range ips {
+			conn, err = dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// PublicHostTransport checks that requests are for public hosts before they
+// are made, for when connections can't be intercepted (e.g. on App Engine,
+// where requests are made by the URL Fetch service).
+type PublicHostTransport struct {
+	Transport http.RoundTripper
+}
+
+func (t *PublicHostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil {
+		return nil, errors.New("Request has no URL")
+	}
+	_, err := lookupPublicIPs(urlHostname(req.URL))
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.Transport.RoundTrip(req)
+}
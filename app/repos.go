@@ -1,14 +1,8 @@
 package retrogit
 
 import (
-	"fmt"
 	"time"
 
-	"appengine"
-	"appengine/datastore"
-	"appengine/delay"
-	"appengine/taskqueue"
-
 	"github.com/google/go-github/github"
 )
 
@@ -22,13 +16,9 @@ type RepoVintage struct {
 	Vintage time.Time `datastore:",noindex"`
 }
 
-func getVintageKey(c appengine.Context, userId int, repoId int) *datastore.Key {
-	return datastore.NewKey(c, "RepoVintage", fmt.Sprintf("%d-%d", userId, repoId), 0, nil)
-}
-
-var computeVintageFunc *delay.Function
+var computeVintageFunc *delayedFunc
 
-func computeVintage(c appengine.Context, userId int, userLogin string, repoId int, repoOwnerLogin string, repoName string) error {
+func computeVintage(c Context, userId int, userLogin string, repoId int, repoOwnerLogin string, repoName string) error {
 	account, err := getAccount(c, userId)
 	if err != nil {
 		c.Errorf("Could not load account %d: %s. Presumed deleted, aborting computing vintage for %s/%s", userId, err.Error(), repoOwnerLogin, repoName)
@@ -37,80 +27,51 @@ func computeVintage(c appengine.Context, userId int, userLogin string, repoId in
 
 	oauthTransport := githubOAuthTransport(c)
 	oauthTransport.Token = &account.OAuthToken
-	githubClient := github.NewClient(oauthTransport.Client())
-
-	repo, response, err := githubClient.Repositories.Get(repoOwnerLogin, repoName)
-	if response.StatusCode == 403 || response.StatusCode == 404 {
-		c.Warningf("Got a %d when trying to look up %s/%s (%d)", response.StatusCode, repoOwnerLogin, repoName, repoId)
-		_, err = datastore.Put(c, getVintageKey(c, userId, repoId), &RepoVintage{
-			UserId:  userId,
-			RepoId:  repoId,
-			Vintage: time.Unix(0, 0),
-		})
-		return err
-	} else if err != nil {
-		c.Errorf("Could not load repo %s/%s (%d): %s", repoOwnerLogin, repoName, repoId, err.Error())
-		return err
-	}
-
-	// Cheap check to see if there are commits before the creation time.
-	vintage := repo.CreatedAt.UTC()
-	beforeCreationTime := repo.CreatedAt.UTC().AddDate(0, 0, -1)
-	commits, response, err := githubClient.Repositories.ListCommits(
-		repoOwnerLogin,
-		repoName,
-		&github.CommitsListOptions{
-			ListOptions: github.ListOptions{PerPage: 1},
-			Author:      userLogin,
-			Until:       beforeCreationTime,
-		})
-	if response != nil && response.StatusCode == 409 {
-		// GitHub returns with a 409 when a repository is empty.
-		commits = make([]github.RepositoryCommit, 0)
-	} else if err != nil {
-		c.Errorf("Could not load commits for repo %s (%d): %s", *repo.FullName, repoId, err.Error())
-		return err
+	githubClient := newGitHubClient(oauthTransport.Client())
+	providers := providersForRepo(account.Providers(c, githubClient, nil), repoId)
+	if len(providers) == 0 {
+		c.Warningf("No provider for %s/%s (%d), presumed disconnected", repoOwnerLogin, repoName, repoId)
+		return nil
 	}
 
-	// If there are, then we use the contributor stats API to figure out when
-	// the user's first commit in the repository was.
-	if len(commits) > 0 {
-		stats, response, err := githubClient.Repositories.ListContributorsStats(repoOwnerLogin, repoName)
-		if response.StatusCode == 202 {
-			c.Infof("Stats were not available for %s, will try again later", *repo.FullName)
-			task, err := computeVintageFunc.Task(userId, userLogin, repoId, repoOwnerLogin, repoName)
+	// Repositories that several linked identities have access to are fetched
+	// with all of them (see Repos.add), so the earliest vintage is used.
+	vintage := time.Unix(0, 0)
+	var lastErr error
+	for _, provider := range providers {
+		providerVintage, err := provider.GetVintage(repoOwnerLogin, repoName)
+		if err == ErrRepoNotAccessible {
+			c.Warningf("Could not look up %s/%s (%d) as %s on %s", repoOwnerLogin, repoName, repoId, userLogin, provider.Name())
+			continue
+		} else if err == ErrVintageNotReady {
+			c.Infof("Stats were not available for %s/%s, will try again later", repoOwnerLogin, repoName)
+			err := computeVintageFunc.CallLater(c, time.Second*10, userId, userLogin, repoId, repoOwnerLogin, repoName)
 			if err != nil {
-				c.Errorf("Could create delayed task for %s: %s", *repo.FullName, err.Error())
+				c.Errorf("Could create delayed task for %s/%s: %s", repoOwnerLogin, repoName, err.Error())
 				return err
 			}
-			task.Delay = time.Second * 10
-			taskqueue.Add(c, task, "")
 			return nil
+		} else if err != nil {
+			// Other providers may still be able to look it up.
+			c.Errorf("Could not compute vintage for repo %s/%s (%d) on %s: %s", repoOwnerLogin, repoName, repoId, provider.Name(), err.Error())
+			lastErr = err
+			continue
 		}
-		if err != nil {
-			c.Errorf("Could not load stats for repo %s: %s", *repo.FullName, err.Error())
-			return err
-		}
-		for _, stat := range stats {
-			if *stat.Author.ID == userId {
-				for i := range stat.Weeks {
-					weekTimestamp := stat.Weeks[i].Week.UTC()
-					if weekTimestamp.Before(vintage) {
-						vintage = weekTimestamp
-					}
-				}
-				break
-			}
+		if vintage.Unix() == 0 || providerVintage.Before(vintage) {
+			vintage = providerVintage
 		}
 	}
+	if vintage.Unix() == 0 && lastErr != nil {
+		return lastErr
+	}
 
-	_, err = datastore.Put(c, getVintageKey(c, userId, repoId), &RepoVintage{
+	err = storage.PutVintage(c, &RepoVintage{
 		UserId:  userId,
 		RepoId:  repoId,
 		Vintage: vintage,
 	})
 	if err != nil {
-		c.Errorf("Could save vintage for repo %s: %s", *repo.FullName, err.Error())
+		c.Errorf("Could save vintage for repo %s/%s: %s", repoOwnerLogin, repoName, err.Error())
 		return err
 	}
 
@@ -118,32 +79,17 @@ func computeVintage(c appengine.Context, userId int, userLogin string, repoId in
 }
 
 func init() {
-	computeVintageFunc = delay.Func("computeVintage", computeVintage)
+	computeVintageFunc = newDelayedFunc("computeVintage", computeVintage)
 }
 
-func fillVintages(c appengine.Context, user *github.User, repos []*Repo) error {
-	keys := make([]*datastore.Key, len(repos))
+func fillVintages(c Context, account *Account, repos []*Repo) error {
+	repoIds := make([]int, len(repos))
 	for i := range repos {
-		keys[i] = getVintageKey(c, *user.ID, *repos[i].ID)
-	}
-	vintages := make([]*RepoVintage, len(repos))
-	for i := range vintages {
-		vintages[i] = new(RepoVintage)
+		repoIds[i] = *repos[i].ID
 	}
-	err := datastore.GetMulti(c, keys, vintages)
+	vintages, err := storage.GetVintages(c, account.GitHubUserId, repoIds)
 	if err != nil {
-		if errs, ok := err.(appengine.MultiError); ok {
-			for i, err := range errs {
-				if err == datastore.ErrNoSuchEntity {
-					vintages[i] = nil
-				} else if err != nil {
-					c.Errorf("%d/%s vintage fetch error: %s", i, *repos[i].FullName, err.Error())
-					return err
-				}
-			}
-		} else {
-			return err
-		}
+		return err
 	}
 	for i := range vintages {
 		repo := repos[i]
@@ -154,7 +100,11 @@ func fillVintages(c appengine.Context, user *github.User, repos []*Repo) error {
 			}
 			continue
 		}
-		computeVintageFunc.Call(c, *user.ID, *user.Login, *repo.ID, *repo.Owner.Login, *repo.Name)
+		user, err := repo.provider().GetUser()
+		if err != nil {
+			return err
+		}
+		computeVintageFunc.Call(c, account.GitHubUserId, *user.Login, *repo.ID, *repo.Owner.Login, *repo.Name)
 	}
 	return nil
 }
@@ -194,14 +144,34 @@ type Repo struct {
 	*github.Repository
 	Vintage         time.Time
 	IncludeInDigest bool
+	// Where the repository (and its commits) come from. Repositories that
+	// several of the account's GitHub identities have access to have one
+	// provider per identity, so that all of their commits are found.
+	providers []Provider
 }
 
-func newRepo(githubRepo *github.Repository, account *Account) *Repo {
+func newRepo(githubRepo *github.Repository, provider Provider, account *Account) *Repo {
 	return &Repo{
 		Repository:      githubRepo,
 		Vintage:         githubRepo.CreatedAt.UTC(),
 		IncludeInDigest: !account.IsRepoIdExcluded(*githubRepo.ID),
+		providers:       []Provider{provider},
+	}
+}
+
+// provider returns the provider that the repository was first listed by,
+// which is used for everything other than fetching commits.
+func (repo *Repo) provider() Provider {
+	return repo.providers[0]
+}
+
+func (repo *Repo) hasProvider(provider Provider) bool {
+	for _, repoProvider := range repo.providers {
+		if repoProvider == provider {
+			return true
+		}
 	}
+	return false
 }
 
 func (repo *Repo) TypeAsOcticonName() string {
@@ -238,39 +208,144 @@ type OrgRepos struct {
 	Repos []*Repo
 }
 
-func getRepos(c appengine.Context, githubClient *github.Client, account *Account, user *github.User) (*Repos, error) {
-	clientUserRepos := make([]github.Repository, 0)
-	page := 1
-	for {
-		pageClientUserRepos, response, err := githubClient.Repositories.List(
-			// The username parameter must be left blank so that we can get all
-			// of the repositories the user has access to, not just ones that
-			// they own.
-			"",
-			&github.RepositoryListOptions{
-				ListOptions: github.ListOptions{
-					Page:    page,
-					PerPage: 100,
-				},
-			})
+// getRepos returns the repositories of all of the account's providers. user is
+// the account's GitHub user.
+func getRepos(c Context, githubClient *github.Client, account *Account, user *github.User) (*Repos, error) {
+	repos := &Repos{
+		UserRepos:      make([]*Repo, 0),
+		OtherUserRepos: make([]*UserRepos, 0),
+		OrgRepos:       make([]*OrgRepos, 0),
+	}
+	reposById := make(map[int][]*Repo)
+	for i, provider := range account.Providers(c, githubClient, user) {
+		providerRepos, err := getProviderRepos(provider, account, i == 0)
 		if err != nil {
-			return nil, err
+			if i == 0 {
+				return nil, err
+			}
+			// Other providers failing (e.g. because their token was revoked)
+			// shouldn't prevent digests from being generated.
+			c.Errorf("Could not look up %s repositories: %s", provider.Name(), err.Error())
+			continue
+		}
+		repos.add(providerRepos, provider, reposById)
+	}
+
+	repos.AllRepos = make([]*Repo, 0)
+	repos.AllRepos = append(repos.AllRepos, repos.UserRepos...)
+	for _, userRepos := range repos.OtherUserRepos {
+		repos.AllRepos = append(repos.AllRepos, userRepos.Repos...)
+	}
+	for _, org := range repos.OrgRepos {
+		repos.AllRepos = append(repos.AllRepos, org.Repos...)
+	}
+
+	err := fillVintages(c, account, repos.AllRepos)
+	if err != nil {
+		return nil, err
+	}
+
+	repos.OldestVintage = time.Now().UTC()
+	for _, repo := range repos.AllRepos {
+		repoVintage := repo.Vintage
+		if repoVintage.Before(repos.OldestVintage) {
+			repos.OldestVintage = repoVintage
+		}
+	}
+
+	return repos, nil
+}
+
+// add merges the repositories that a provider listed into repos. Ones that an
+// earlier provider already listed (i.e. that several linked identities have
+// access to) aren't shown again, and are fetched with both providers instead.
+// reposById has the repositories of the earlier providers.
+func (repos *Repos) add(providerRepos *Repos, provider Provider, reposById map[int][]*Repo) {
+	providerReposById := make(map[int][]*Repo)
+	newRepos := func(candidateRepos []*Repo) []*Repo {
+		addedRepos := make([]*Repo, 0, len(candidateRepos))
+		for _, repo := range candidateRepos {
+			if existingRepos, ok := reposById[*repo.ID]; ok {
+				for _, existingRepo := range existingRepos {
+					if !existingRepo.hasProvider(provider) {
+						existingRepo.providers = append(existingRepo.providers, provider)
+					}
+				}
+				continue
+			}
+			providerReposById[*repo.ID] = append(providerReposById[*repo.ID], repo)
+			addedRepos = append(addedRepos, repo)
 		}
-		clientUserRepos = append(clientUserRepos, pageClientUserRepos...)
-		if response.NextPage == 0 {
-			break
+		return addedRepos
+	}
+
+	repos.UserRepos = append(repos.UserRepos, newRepos(providerRepos.UserRepos)...)
+	for _, userRepos := range providerRepos.OtherUserRepos {
+		addedRepos := newRepos(userRepos.Repos)
+		if len(addedRepos) == 0 {
+			continue
+		}
+		var existingUserRepos *UserRepos
+		for _, otherUserRepos := range repos.OtherUserRepos {
+			if *otherUserRepos.User.ID == *userRepos.User.ID {
+				existingUserRepos = otherUserRepos
+				break
+			}
+		}
+		if existingUserRepos == nil {
+			repos.OtherUserRepos = append(repos.OtherUserRepos, &UserRepos{userRepos.User, addedRepos})
+		} else {
+			existingUserRepos.Repos = append(existingUserRepos.Repos, addedRepos...)
 		}
-		page = response.NextPage
+	}
+	for _, orgRepos := range providerRepos.OrgRepos {
+		addedRepos := newRepos(orgRepos.Repos)
+		if len(addedRepos) == 0 && len(orgRepos.Repos) > 0 {
+			continue
+		}
+		var existingOrgRepos *OrgRepos
+		for _, otherOrgRepos := range repos.OrgRepos {
+			if *otherOrgRepos.Org.ID == *orgRepos.Org.ID {
+				existingOrgRepos = otherOrgRepos
+				break
+			}
+		}
+		if existingOrgRepos == nil {
+			repos.OrgRepos = append(repos.OrgRepos, &OrgRepos{orgRepos.Org, addedRepos})
+		} else {
+			existingOrgRepos.Repos = append(existingOrgRepos.Repos, addedRepos...)
+		}
+	}
+
+	// Only added afterwards, so that a provider listing a repository twice
+	// (e.g. GitHub, as both the user's and their organization's) is kept as
+	// it was.
+	for id, idRepos := range providerReposById {
+		reposById[id] = idRepos
+	}
+}
+
+// getProviderRepos lists a provider's repositories (without AllRepos and
+// vintages). The ones owned by the provider's user are the UserRepos for the
+// primary provider, and are grouped with other users' for the rest, so that
+// they're shown under the user that they have there.
+func getProviderRepos(provider Provider, account *Account, isPrimary bool) (*Repos, error) {
+	user, err := provider.GetUser()
+	if err != nil {
+		return nil, err
+	}
+	clientUserRepos, err := provider.ListRepos()
+	if err != nil {
+		return nil, err
 	}
 
 	repos := &Repos{}
 	repos.UserRepos = make([]*Repo, 0, len(clientUserRepos))
 	repos.OtherUserRepos = make([]*UserRepos, 0)
-	allRepoCount := len(clientUserRepos)
 	for i := range clientUserRepos {
 		ownerID := *clientUserRepos[i].Owner.ID
-		if ownerID == *user.ID {
-			repos.UserRepos = append(repos.UserRepos, newRepo(&clientUserRepos[i], account))
+		if ownerID == *user.ID && isPrimary {
+			repos.UserRepos = append(repos.UserRepos, newRepo(&clientUserRepos[i], provider, account))
 		} else {
 			var userRepos *UserRepos
 			for j := range repos.OtherUserRepos {
@@ -286,17 +361,11 @@ func getRepos(c appengine.Context, githubClient *github.Client, account *Account
 				}
 				repos.OtherUserRepos = append(repos.OtherUserRepos, userRepos)
 			}
-			userRepos.Repos = append(userRepos.Repos, newRepo(&clientUserRepos[i], account))
+			userRepos.Repos = append(userRepos.Repos, newRepo(&clientUserRepos[i], provider, account))
 		}
 	}
 
-	orgs, _, err := githubClient.Organizations.List(
-		"",
-		&github.ListOptions{
-			// Don't bother with pagination for the organization list, the user
-			// is unlikely to have that many.
-			PerPage: 100,
-		})
+	orgs, err := provider.ListOrgs()
 	if err != nil {
 		return nil, err
 	}
@@ -304,56 +373,15 @@ func getRepos(c appengine.Context, githubClient *github.Client, account *Account
 	repos.OrgRepos = make([]*OrgRepos, 0, len(orgs))
 	for i := range orgs {
 		org := &orgs[i]
-		clientOrgRepos := make([]github.Repository, 0)
-		page := 1
-		for {
-			pageClientOrgRepos, response, err := githubClient.Repositories.ListByOrg(
-				*org.Login,
-				&github.RepositoryListByOrgOptions{
-					Type: "member",
-					ListOptions: github.ListOptions{
-						Page:    page,
-						PerPage: 100,
-					},
-				})
-			if err != nil {
-				return nil, err
-			}
-			clientOrgRepos = append(clientOrgRepos, pageClientOrgRepos...)
-			if response.NextPage == 0 {
-				break
-			}
-			page = response.NextPage
+		clientOrgRepos, err := provider.ListOrgRepos(org)
+		if err != nil {
+			return nil, err
 		}
 		orgRepos := make([]*Repo, 0, len(clientOrgRepos))
-		allRepoCount += len(clientOrgRepos)
 		for j := range clientOrgRepos {
-			orgRepos = append(orgRepos, newRepo(&clientOrgRepos[j], account))
+			orgRepos = append(orgRepos, newRepo(&clientOrgRepos[j], provider, account))
 		}
 		repos.OrgRepos = append(repos.OrgRepos, &OrgRepos{org, orgRepos})
 	}
-
-	repos.AllRepos = make([]*Repo, 0, allRepoCount)
-	repos.AllRepos = append(repos.AllRepos, repos.UserRepos...)
-	for _, userRepos := range repos.OtherUserRepos {
-		repos.AllRepos = append(repos.AllRepos, userRepos.Repos...)
-	}
-	for _, org := range repos.OrgRepos {
-		repos.AllRepos = append(repos.AllRepos, org.Repos...)
-	}
-
-	err = fillVintages(c, user, repos.AllRepos)
-	if err != nil {
-		return nil, err
-	}
-
-	repos.OldestVintage = time.Now().UTC()
-	for _, repo := range repos.AllRepos {
-		repoVintage := repo.Vintage
-		if repoVintage.Before(repos.OldestVintage) {
-			repos.OldestVintage = repoVintage
-		}
-	}
-
 	return repos, nil
 }
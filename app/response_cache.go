@@ -0,0 +1,175 @@
+package retrogit
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultResponseCacheMaxBytes = 64 * 1024 * 1024
+	// Matches memcache's item size limit.
+	DefaultResponseCacheMaxEntryBytes = 1024 * 1024
+)
+
+// ResponseCache stores the serialized GitHub API responses used by
+// CachingTransport, and rendered digest feeds.
+type ResponseCache interface {
+	// Get returns false if there is no entry for key.
+	Get(c Context, key string) ([]byte, bool, error)
+	// Put may silently drop (or later evict) entries to stay within the
+	// cache's size limits.
+	Put(c Context, key string, value []byte) error
+}
+
+// SizedResponseCache is implemented by caches that know how much they hold.
+type SizedResponseCache interface {
+	Size() (entries int, bytes int64)
+}
+
+type ResponseCacheConfig struct {
+	// One of the backends supported by newResponseCache in the current build
+	// ("memcache" and "memory" on App Engine, "disk" and "memory" otherwise),
+	// or "none" to disable caching. Defaults to the first one.
+	Backend string
+	// Directory that the "disk" backend stores responses in.
+	Directory string
+	// Limits on the total size of the cache (for the "disk" and "memory"
+	// backends) and of a single response (for all of them).
+	MaxBytes      int64
+	MaxEntryBytes int
+}
+
+func (config ResponseCacheConfig) maxBytes() int64 {
+	if config.MaxBytes <= 0 {
+		return DefaultResponseCacheMaxBytes
+	}
+	return config.MaxBytes
+}
+
+func (config ResponseCacheConfig) maxEntryBytes() int {
+	if config.MaxEntryBytes <= 0 {
+		return DefaultResponseCacheMaxEntryBytes
+	}
+	return config.MaxEntryBytes
+}
+
+// ResponseCacheMetrics counts how CachingTransport requests were handled, since
+// the process started.
+type ResponseCacheMetrics struct {
+	// Responses that were not in the cache.
+	Misses int64
+	// Cached responses that were still current (i.e. GitHub returned a 304).
+	Hits int64
+	// Cached responses that had changed.
+	Stale  int64
+	Stores int64
+	Errors int64
+}
+
+var responseCacheMetrics = &ResponseCacheMetrics{}
+
+func (m *ResponseCacheMetrics) addMiss()  { atomic.AddInt64(&m.Misses, 1) }
+func (m *ResponseCacheMetrics) addHit()   { atomic.AddInt64(&m.Hits, 1) }
+func (m *ResponseCacheMetrics) addStale() { atomic.AddInt64(&m.Stale, 1) }
+func (m *ResponseCacheMetrics) addStore() { atomic.AddInt64(&m.Stores, 1) }
+func (m *ResponseCacheMetrics) addError() { atomic.AddInt64(&m.Errors, 1) }
+
+// Snapshot returns a copy of the metrics that is safe to read.
+func (m *ResponseCacheMetrics) Snapshot() ResponseCacheMetrics {
+	return ResponseCacheMetrics{
+		Misses: atomic.LoadInt64(&m.Misses),
+		Hits:   atomic.LoadInt64(&m.Hits),
+		Stale:  atomic.LoadInt64(&m.Stale),
+		Stores: atomic.LoadInt64(&m.Stores),
+		Errors: atomic.LoadInt64(&m.Errors),
+	}
+}
+
+// HitRate is the fraction of cached responses that were still current.
+func (m ResponseCacheMetrics) HitRate() string {
+	total := m.Hits + m.Stale + m.Misses
+	if total == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.1f%%", float64(m.Hits)*100/float64(total))
+}
+
+// Keeps responses in process memory, evicting the least recently used ones
+// once the total size goes over the limit.
+type MemoryResponseCache struct {
+	maxBytes      int64
+	maxEntryBytes int
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	// Most recently used first.
+	lru   *list.List
+	bytes int64
+}
+
+type memoryResponseCacheEntry struct {
+	key   string
+	value []byte
+}
+
+func newMemoryResponseCache(config ResponseCacheConfig) *MemoryResponseCache {
+	return &MemoryResponseCache{
+		maxBytes:      config.maxBytes(),
+		maxEntryBytes: config.maxEntryBytes(),
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+	}
+}
+
+func (cache *MemoryResponseCache) Get(c Context, key string) ([]byte, bool, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	cache.lru.MoveToFront(element)
+	return element.Value.(*memoryResponseCacheEntry).value, true, nil
+}
+
+func (cache *MemoryResponseCache) Put(c Context, key string, value []byte) error {
+	if len(value) > cache.maxEntryBytes {
+		return nil
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		cache.removeElement(element)
+	}
+	cache.entries[key] = cache.lru.PushFront(&memoryResponseCacheEntry{key, value})
+	cache.bytes += int64(len(value))
+	for cache.bytes > cache.maxBytes {
+		cache.removeElement(cache.lru.Back())
+	}
+	return nil
+}
+
+func (cache *MemoryResponseCache) removeElement(element *list.Element) {
+	entry := cache.lru.Remove(element).(*memoryResponseCacheEntry)
+	delete(cache.entries, entry.key)
+	cache.bytes -= int64(len(entry.value))
+}
+
+func (cache *MemoryResponseCache) Size() (int, int64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return len(cache.entries), cache.bytes
+}
+
+// Used when caching is disabled.
+type noResponseCache struct{}
+
+func (cache noResponseCache) Get(c Context, key string) ([]byte, bool, error) {
+	return nil, false, nil
+}
+
+func (cache noResponseCache) Put(c Context, key string, value []byte) error {
+	return nil
+}
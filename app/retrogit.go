@@ -9,15 +9,11 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	texttemplate "text/template"
 	"time"
 
-	"appengine"
-	"appengine/datastore"
-	"appengine/delay"
-	"appengine/mail"
-	"appengine/urlfetch"
-
 	"code.google.com/p/goauth2/oauth"
 	"github.com/google/go-github/github"
 	"github.com/gorilla/mux"
@@ -31,15 +27,30 @@ var timezones Timezones
 var sessionStore *sessions.CookieStore
 var sessionConfig SessionConfig
 var templates map[string]*Template
-
-func init() {
+var textTemplates map[string]*texttemplate.Template
+var storage Storage
+var mailer Mailer
+var mailConfig MailConfig
+var githubConfig GitHubConfig
+var commitFetcher CommitFetcher
+var responseCache ResponseCache
+
+func initApp() http.Handler {
 	templates = loadTemplates()
+	textTemplates = loadTextTemplates()
+	storage = initStorage()
+	mailer, mailConfig = initMail()
+	githubConfig, commitFetcher, responseCache = initGitHubConfig()
 	timezones = initTimezones()
 	sessionStore, sessionConfig = initSession()
 	githubOauthConfig = initGithubOAuthConfig(true)
 	githubOauthPublicConfig = initGithubOAuthConfig(false)
+	router = initRouter()
+	return router
+}
 
-	router = mux.NewRouter()
+func initRouter() *mux.Router {
+	router := mux.NewRouter()
 	router.Handle("/", AppHandler(indexHandler)).Name("index")
 	router.Handle("/faq", AppHandler(faqHandler)).Name("faq")
 
@@ -50,22 +61,43 @@ func init() {
 	router.Handle("/digest/view", SignedInAppHandler(viewDigestHandler)).Name("view-digest")
 	router.Handle("/digest/send", SignedInAppHandler(sendDigestHandler)).Name("send-digest").Methods("POST")
 	router.Handle("/digest/cron", AppHandler(digestCronHandler))
+	router.Handle("/digest/history", SignedInAppHandler(digestHistoryHandler)).Name("digest-history").Methods("GET")
+	router.Handle("/digest/history/view", SignedInAppHandler(viewArchivedDigestHandler)).Name("view-archived-digest").Methods("GET")
+	router.Handle("/digest/feed/{user_id:[0-9]+}/{token}", AppHandler(digestFeedHandler)).Name("digest-feed").Methods("GET")
+
+	router.Handle("/teams", SignedInAppHandler(teamDigestsHandler)).Name("team-digests").Methods("GET")
+	router.Handle("/teams/create", SignedInAppHandler(createTeamDigestHandler)).Name("create-team-digest").Methods("POST")
+	router.Handle("/teams/view", SignedInAppHandler(viewTeamDigestHandler)).Name("view-team-digest")
+	router.Handle("/teams/send", SignedInAppHandler(sendTeamDigestHandler)).Name("send-team-digest").Methods("POST")
+	router.Handle("/teams/delete", SignedInAppHandler(deleteTeamDigestHandler)).Name("delete-team-digest").Methods("POST")
 
 	router.Handle("/account/settings", SignedInAppHandler(settingsHandler)).Name("settings").Methods("GET")
 	router.Handle("/account/settings", SignedInAppHandler(saveSettingsHandler)).Name("save-settings").Methods("POST")
 	router.Handle("/account/set-initial-timezone", SignedInAppHandler(setInitialTimezoneHandler)).Name("set-initial-timezone").Methods("POST")
+	router.Handle("/account/feed/create", SignedInAppHandler(createFeedHandler)).Name("create-feed").Methods("POST")
+	router.Handle("/account/feed/revoke", SignedInAppHandler(revokeFeedHandler)).Name("revoke-feed").Methods("POST")
+	router.Handle("/account/api-tokens/create", SignedInAppHandler(createAPITokenHandler)).Name("create-api-token").Methods("POST")
+	router.Handle("/account/api-tokens/revoke", SignedInAppHandler(revokeAPITokenHandler)).Name("revoke-api-token").Methods("POST")
+	router.Handle("/account/identities/link", SignedInAppHandler(linkIdentityHandler)).Name("link-identity").Methods("POST")
+	router.Handle("/account/identities/unlink", SignedInAppHandler(unlinkIdentityHandler)).Name("unlink-identity").Methods("POST")
 	router.Handle("/account/delete", SignedInAppHandler(deleteAccountHandler)).Name("delete-account").Methods("POST")
 
+	router.Handle("/api/v1/digest", APIHandler(apiDigestHandler)).Methods("GET")
+	router.Handle("/api/v1/repos", APIHandler(apiReposHandler)).Methods("GET")
+	router.Handle("/api/v1/settings", APIHandler(apiSettingsHandler)).Methods("GET")
+	router.Handle("/api/v1/settings", APIHandler(apiSaveSettingsHandler)).Methods("PUT")
+
 	router.Handle("/admin/users", AppHandler(usersAdminHandler)).Name("users-admin")
 	router.Handle("/admin/digest", AppHandler(digestAdminHandler)).Name("digest-admin")
 	router.Handle("/admin/repos", AppHandler(reposAdminHandler)).Name("repos-admin")
 	router.Handle("/admin/delete-account", AppHandler(deleteAccountAdminHandler)).Name("delete-account-admin")
-	http.Handle("/", router)
+	router.Handle("/admin/cache", AppHandler(cacheAdminHandler)).Name("cache-admin")
+	return router
 }
 
 func initGithubOAuthConfig(includePrivateRepos bool) (config oauth.Config) {
 	path := "config/github-oauth"
-	if appengine.IsDevAppServer() {
+	if isDevelopment() {
 		path += "-dev"
 	}
 	path += ".json"
@@ -82,8 +114,8 @@ func initGithubOAuthConfig(includePrivateRepos bool) (config oauth.Config) {
 		repoScopeModifier = "public_"
 	}
 	config.Scope = fmt.Sprintf("%srepo user:email", repoScopeModifier)
-	config.AuthURL = "https://github.com/login/oauth/authorize"
-	config.TokenURL = "https://github.com/login/oauth/access_token"
+	config.AuthURL = githubConfig.OAuthAuthURL
+	config.TokenURL = githubConfig.OAuthTokenURL
 	return
 }
 
@@ -96,7 +128,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) *AppError {
 		}
 		return templates["index-signed-out"].Render(w, data)
 	}
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	account, err := getAccount(c, userId)
 	if account == nil {
 		// Can't look up the account, session cookie must be invalid, clear it.
@@ -110,7 +142,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) *AppError {
 
 	oauthTransport := githubOAuthTransport(c)
 	oauthTransport.Token = &account.OAuthToken
-	githubClient := github.NewClient(oauthTransport.Client())
+	githubClient := newGitHubClient(oauthTransport.Client())
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -123,7 +155,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) *AppError {
 		wg.Done()
 	}()
 	go func() {
-		emailAddress, emailAddressErr = account.GetDigestEmailAddress(githubClient)
+		emailAddress, emailAddressErr = account.GetDigestEmailAddress(newGitHubProvider(githubClient, nil))
 		wg.Done()
 	}()
 	wg.Wait()
@@ -145,6 +177,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) *AppError {
 		"Frequency":       account.Frequency,
 		"RepositoryCount": repositoryCount,
 		"EmailAddress":    emailAddress,
+		"DeliveryHour":    account.Schedule().DisplayDeliveryHour(),
 	}
 	var data = map[string]interface{}{
 		"User":            user,
@@ -195,26 +228,34 @@ func signOutHandler(w http.ResponseWriter, r *http.Request) *AppError {
 }
 
 func viewDigestHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
-	c := appengine.NewContext(r)
-	digest, err := newDigest(c, state.GitHubClient, state.Account)
+	c := newContext(r)
+	date, frequency, appErr := parseDigestParameters(r, state.Account)
+	if appErr != nil {
+		return appErr
+	}
+	digest, err := newDigestForDate(c, state.GitHubClient, state.Account, date, frequency)
+	if err == ErrDigestDateTooEarly {
+		return BadRequest(err, "Date is before your oldest repository")
+	}
 	if err != nil {
 		return GitHubFetchError(err, "digest")
 	}
 	var data = map[string]interface{}{
-		"Digest": digest,
+		"Digest":     digest,
+		"Navigation": newDigestNavigation(date, frequency),
 	}
 	return templates["digest-page"].Render(w, data, state)
 }
 
 func sendDigestHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	sent, err := sendDigestForAccount(state.Account, c)
 	if err != nil {
 		return InternalError(err, "Could not send digest")
 	}
 
 	if sent {
-		state.AddFlash("Digest emailed!")
+		state.AddFlash("Digest sent!")
 	} else {
 		state.AddFlash("No digest was sent, it was empty or disabled.")
 	}
@@ -222,30 +263,51 @@ func sendDigestHandler(w http.ResponseWriter, r *http.Request, state *AppSignedI
 }
 
 func digestCronHandler(w http.ResponseWriter, r *http.Request) *AppError {
-	c := appengine.NewContext(r)
-	accounts, err := getAllAccounts(c)
+	c := newContext(r)
+	err := enqueueDigests(c, time.Now())
 	if err != nil {
 		return InternalError(err, "Could not look up accounts")
 	}
-	for _, account := range accounts {
-		if account.Frequency == "weekly" {
-			now := time.Now().In(account.TimezoneLocation)
-			if now.Weekday() != account.WeeklyDay {
-				c.Infof("Skipping %d, since it wants weekly digests on %ss and today is a %s.",
-					account.GitHubUserId, account.WeeklyDay, now.Weekday())
-				continue
-			}
+	fmt.Fprint(w, "Done")
+	return nil
+}
+
+// enqueueDigests is run every hour, and sends digests to the accounts (and
+// team subscriptions) whose delivery time was in the past hour.
+func enqueueDigests(c Context, dispatchTime time.Time) error {
+	accounts, err := getAllAccounts(c)
+	if err != nil {
+		return err
+	}
+	for i := range accounts {
+		account := &accounts[i]
+		if isCommitIndexDue(account, dispatchTime) {
+			indexCommitsFunc.Call(c, account.GitHubUserId)
+		}
+		if !account.Schedule().IsDue(c, dispatchTime, strconv.Itoa(account.GitHubUserId)) {
+			continue
 		}
 		c.Infof("Enqueing task for %d...", account.GitHubUserId)
 		sendDigestForAccountFunc.Call(c, account.GitHubUserId)
 	}
-	fmt.Fprint(w, "Done")
+
+	subscriptions, err := getAllTeamSubscriptions(c)
+	if err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		if !subscription.Schedule().IsDue(c, dispatchTime, fmt.Sprintf("team digest %d", subscription.Id)) {
+			continue
+		}
+		c.Infof("Enqueing task for team digest %d...", subscription.Id)
+		sendTeamDigestFunc.Call(c, subscription.Id)
+	}
 	return nil
 }
 
-var sendDigestForAccountFunc = delay.Func(
+var sendDigestForAccountFunc = newDelayedFunc(
 	"sendDigestForAccount",
-	func(c appengine.Context, githubUserId int) error {
+	func(c Context, githubUserId int) error {
 		c.Infof("Sending digest for %d...", githubUserId)
 		account, err := getAccount(c, githubUserId)
 		if err != nil {
@@ -255,7 +317,7 @@ var sendDigestForAccountFunc = delay.Func(
 		sent, err := sendDigestForAccount(account, c)
 		if err != nil {
 			c.Errorf("  Error: %s", err.Error())
-			if !appengine.IsDevAppServer() {
+			if !isDevelopment() {
 				sendDigestErrorMail(err, c, githubUserId)
 			}
 		} else if sent {
@@ -266,25 +328,28 @@ var sendDigestForAccountFunc = delay.Func(
 		return err
 	})
 
-func sendDigestErrorMail(e error, c appengine.Context, gitHubUserId int) {
-	errorMessage := &mail.Message{
-		Sender:  "RetroGit Admin <digests@retrogit.com>",
-		To:      []string{"mihai.parparita@gmail.com"},
+func sendDigestErrorMail(e error, c Context, gitHubUserId int) {
+	if len(mailConfig.AdminRecipients) == 0 {
+		return
+	}
+	errorMessage := &MailMessage{
+		Sender:  mailConfig.AdminSender,
+		To:      mailConfig.AdminRecipients,
 		Subject: fmt.Sprintf("RetroGit Digest Send Error for %d", gitHubUserId),
 		Body:    fmt.Sprintf("Error: %s", e),
 	}
-	err := mail.Send(c, errorMessage)
+	err := mailer.Send(c, errorMessage)
 	if err != nil {
 		c.Errorf("Error %s sending error email.", err.Error())
 	}
 }
 
-func sendDigestForAccount(account *Account, c appengine.Context) (bool, error) {
+func sendDigestForAccount(account *Account, c Context) (bool, error) {
 	oauthTransport := githubOAuthTransport(c)
 	oauthTransport.Token = &account.OAuthToken
-	githubClient := github.NewClient(oauthTransport.Client())
+	githubClient := newGitHubClient(oauthTransport.Client())
 
-	emailAddress, err := account.GetDigestEmailAddress(githubClient)
+	emailAddress, err := account.GetDigestEmailAddress(newGitHubProvider(githubClient, nil))
 	if err != nil {
 		if gitHubError, ok := (err).(*github.ErrorResponse); ok {
 			gitHubStatus := gitHubError.Response.StatusCode
@@ -297,13 +362,15 @@ func sendDigestForAccount(account *Account, c appengine.Context) (bool, error) {
 
 		return false, err
 	}
-	if emailAddress == "disabled" {
+	emailEnabled := emailAddress != "disabled"
+	channels := account.DeliveryChannels()
+	if !emailEnabled && len(channels) == 0 {
 		return false, nil
 	}
 
 	digest, err := newDigest(c, githubClient, account)
 	if err != nil {
-		if gitHubError, ok := (err).(*github.ErrorResponse); ok {
+		if gitHubError, ok := (err).(*github.ErrorResponse); ok && emailEnabled {
 			gitHubStatus := gitHubError.Response.StatusCode
 			if gitHubStatus == http.StatusUnauthorized ||
 				gitHubStatus == http.StatusForbidden {
@@ -313,13 +380,13 @@ func sendDigestForAccount(account *Account, c appengine.Context) (bool, error) {
 					return false, err
 				}
 
-				digestMessage := &mail.Message{
-					Sender:   "RetroGit <digests@retrogit.com>",
+				digestMessage := &MailMessage{
+					Sender:   mailConfig.DigestSender,
 					To:       []string{emailAddress},
 					Subject:  "RetroGit Digest Error",
 					HTMLBody: authErrorHtml.String(),
 				}
-				err = mail.Send(c, digestMessage)
+				err = mailer.Send(c, digestMessage)
 				return false, err
 			}
 		}
@@ -329,27 +396,66 @@ func sendDigestForAccount(account *Account, c appengine.Context) (bool, error) {
 		return false, nil
 	}
 
+	return true, deliverDigest(c, account, emailAddress, emailEnabled, channels, digest)
+}
+
+// deliverDigest sends the digest by email (if enabled) and to the account's
+// channels. Delivery continues to the remaining destinations if one fails.
+// Only email errors are returned (so that the task is retried); channel ones
+// are logged and archived instead, since retrying would send the digest to
+// the channels that it was delivered to again.
+func deliverDigest(c Context, account *Account, emailAddress string, emailEnabled bool, channels []DeliveryChannel, digest *Digest) error {
+	var emailErr, deliveryErr error
+	deliveredTo := make([]string, 0, len(channels)+1)
+	if emailEnabled {
+		emailErr = emailDigest(c, account, emailAddress, digest)
+		if emailErr == nil {
+			deliveredTo = append(deliveredTo, "email")
+		}
+		deliveryErr = emailErr
+	}
+	for _, channel := range channels {
+		err := channel.Deliver(c, digest)
+		if err != nil {
+			c.Errorf("  Error delivering digest to %s: %s", channel.Name(), err.Error())
+			if deliveryErr == nil {
+				deliveryErr = err
+			}
+		} else {
+			deliveredTo = append(deliveredTo, channel.Name())
+		}
+	}
+	archiveDigest(c, account, digest, deliveredTo, deliveryErr)
+	return emailErr
+}
+
+func emailDigest(c Context, account *Account, emailAddress string, digest *Digest) error {
 	var data = map[string]interface{}{
 		"Digest": digest,
 	}
-	var digestHtml bytes.Buffer
-	if err := templates["digest-email"].Execute(&digestHtml, data); err != nil {
-		return false, err
+	var digestText bytes.Buffer
+	if err := textTemplates["digest-email"].Execute(&digestText, data); err != nil {
+		return err
 	}
-
-	digestMessage := &mail.Message{
-		Sender:   "RetroGit <digests@retrogit.com>",
-		To:       []string{emailAddress},
-		Subject:  "RetroGit Digest",
-		HTMLBody: digestHtml.String(),
+	digestMessage := &MailMessage{
+		Sender:  mailConfig.DigestSender,
+		To:      []string{emailAddress},
+		Subject: "RetroGit Digest",
+		Body:    digestText.String(),
+	}
+	if !account.TextOnlyEmail {
+		var digestHtml bytes.Buffer
+		if err := templates["digest-email"].Execute(&digestHtml, data); err != nil {
+			return err
+		}
+		digestMessage.HTMLBody = digestHtml.String()
 	}
-	err = mail.Send(c, digestMessage)
-	return true, err
+	return mailer.Send(c, digestMessage)
 }
 
 func githubOAuthCallbackHandler(w http.ResponseWriter, r *http.Request) *AppError {
 	code := r.FormValue("code")
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	oauthTransport := githubOAuthTransport(c)
 	token, err := oauthTransport.Exchange(code)
 	if err != nil {
@@ -357,24 +463,30 @@ func githubOAuthCallbackHandler(w http.ResponseWriter, r *http.Request) *AppErro
 	}
 
 	oauthTransport.Token = token
-	githubClient := github.NewClient(oauthTransport.Client())
+	githubClient := newGitHubClient(oauthTransport.Client())
 	user, _, err := githubClient.Users.Get("")
 	if err != nil {
 		return GitHubFetchError(err, "user")
 	}
 
+	session, _ := sessionStore.Get(r, sessionConfig.CookieName)
+	if linked, appErr := linkIdentityCallback(w, r, session, user, token); linked {
+		return appErr
+	}
+
 	account, err := getAccount(c, *user.ID)
-	if err != nil && err != datastore.ErrNoSuchEntity {
+	if err != nil && err != ErrAccountNotFound {
 		return InternalError(err, "Could not look up user")
 	}
-	if account == nil {
+	isNewAccount := account == nil
+	if isNewAccount {
 		account = &Account{GitHubUserId: *user.ID}
 	}
 	account.OAuthToken = *token
 	// Persist the default email address now, both to avoid additional lookups
 	// later and to have a way to contact the user if they ever revoke their
 	// OAuth token.
-	emailAddress, err := account.GetDigestEmailAddress(githubClient)
+	emailAddress, err := account.GetDigestEmailAddress(newGitHubProvider(githubClient, nil))
 	if err == nil && len(emailAddress) > 0 {
 		account.DigestEmailAddress = emailAddress
 	}
@@ -382,8 +494,12 @@ func githubOAuthCallbackHandler(w http.ResponseWriter, r *http.Request) *AppErro
 	if err != nil {
 		return InternalError(err, "Could not save user")
 	}
+	if isNewAccount && !githubConfig.CommitIndex.Disabled {
+		// Builds the initial index, instead of waiting for the account's
+		// daily update.
+		indexCommitsFunc.Call(c, account.GitHubUserId)
+	}
 
-	session, _ := sessionStore.Get(r, sessionConfig.CookieName)
 	session.Values[sessionConfig.UserIdKey] = user.ID
 	session.Save(r, w)
 	continueUrl := r.FormValue("continue_url")
@@ -401,7 +517,7 @@ func githubOAuthCallbackHandler(w http.ResponseWriter, r *http.Request) *AppErro
 }
 
 func settingsHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	user, _, err := state.GitHubClient.Users.Get("")
 	if err != nil {
 		return GitHubFetchError(err, "user")
@@ -420,24 +536,81 @@ func settingsHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInS
 	for i := range emails {
 		emailAddresses[i] = *emails[i].Email
 	}
-	accountEmailAddress, err := state.Account.GetDigestEmailAddress(state.GitHubClient)
+	accountEmailAddress, err := state.Account.GetDigestEmailAddress(newGitHubProvider(state.GitHubClient, nil))
 	if err != nil {
 		return GitHubFetchError(err, "emails")
 	}
 
+	webhookDeliveries, err := storage.GetWebhookDeliveries(c, state.Account.GitHubUserId)
+	if err != nil {
+		return InternalError(err, "Could not look up webhook deliveries")
+	}
+	for i := range webhookDeliveries {
+		webhookDeliveries[i].Time = webhookDeliveries[i].Time.In(state.Account.TimezoneLocation)
+	}
+
+	apiTokens, err := getAPITokens(c, state.Account.GitHubUserId)
+	if err != nil {
+		return InternalError(err, "Could not look up API tokens")
+	}
+
 	var data = map[string]interface{}{
-		"Account":             state.Account,
-		"User":                user,
-		"Timezones":           timezones,
-		"Repos":               repos,
-		"EmailAddresses":      emailAddresses,
-		"AccountEmailAddress": accountEmailAddress,
+		"Account":                  state.Account,
+		"User":                     user,
+		"Timezones":                timezones,
+		"DeliveryHours":            deliveryHourOptions(),
+		"MonthlyDays":              monthlyDayOptions(),
+		"Repos":                    repos,
+		"EmailAddresses":           emailAddresses,
+		"AccountEmailAddress":      accountEmailAddress,
+		"WebhookDeliveries":        webhookDeliveries,
+		"APITokens":                apiTokens,
+		"DigestArchiveOptions":     digestArchiveDaysOptions(),
+		"DefaultGitLabURL":         DefaultGitLabURL,
+		"LocalRepositoriesEnabled": localRepositoriesEnabled(),
 	}
 	return templates["settings"].Render(w, data, state)
 }
 
+func deliveryHourOptions() []map[string]interface{} {
+	deliveryHours := make([]map[string]interface{}, 24)
+	for hour := range deliveryHours {
+		deliveryHours[hour] = map[string]interface{}{
+			"Hour":  hour,
+			"Label": formatDeliveryHour(hour),
+		}
+	}
+	return deliveryHours
+}
+
+func monthlyDayOptions() []map[string]interface{} {
+	monthlyDays := make([]map[string]interface{}, 31)
+	for i := range monthlyDays {
+		monthlyDays[i] = map[string]interface{}{
+			"Day":   i + 1,
+			"Label": formatOrdinal(i + 1),
+		}
+	}
+	return monthlyDays
+}
+
+func formatOrdinal(n int) string {
+	suffix := "th"
+	if n%100 < 11 || n%100 > 13 {
+		switch n % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
+
 func saveSettingsHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	account := state.Account
 
 	user, _, err := state.GitHubClient.Users.Get("")
@@ -450,19 +623,16 @@ func saveSettingsHandler(w http.ResponseWriter, r *http.Request, state *AppSigne
 		return GitHubFetchError(err, "repos")
 	}
 
-	account.Frequency = r.FormValue("frequency")
-	weeklyDay, err := strconv.Atoi(r.FormValue("weekly_day"))
-	if err != nil {
-		return BadRequest(err, "Malformed weekly_day value")
+	schedule, appErr := parseScheduleForm(r)
+	if appErr != nil {
+		return appErr
 	}
-	account.WeeklyDay = time.Weekday(weeklyDay)
-
-	timezoneName := r.FormValue("timezone_name")
-	_, err = time.LoadLocation(timezoneName)
-	if err != nil {
-		return BadRequest(err, "Malformed timezone_name value")
-	}
-	account.TimezoneName = timezoneName
+	account.Frequency = schedule.Frequency
+	account.WeeklyDay = schedule.WeeklyDay
+	account.MonthlyDay = schedule.MonthlyDay
+	account.DeliveryHour = schedule.DeliveryHour
+	account.HasDeliveryHour = true
+	account.TimezoneName = schedule.Location.String()
 
 	account.ExcludedRepoIds = make([]int, 0)
 	for _, repo := range repos.AllRepos {
@@ -473,19 +643,177 @@ func saveSettingsHandler(w http.ResponseWriter, r *http.Request, state *AppSigne
 		}
 	}
 
+	_, account.IncludePullRequests = r.Form["include_pull_requests"]
+	_, account.IncludeIssues = r.Form["include_issues"]
+	_, account.IncludeReviews = r.Form["include_reviews"]
+
 	account.DigestEmailAddress = r.FormValue("email_address")
+	_, account.TextOnlyEmail = r.Form["text_only_email"]
+
+	account.SlackWebhookURL = strings.TrimSpace(r.FormValue("slack_webhook_url"))
+	account.TeamsWebhookURL = strings.TrimSpace(r.FormValue("teams_webhook_url"))
+	account.WebhookURL = strings.TrimSpace(r.FormValue("webhook_url"))
+	_, regenerateWebhookSecret := r.Form["regenerate_webhook_secret"]
+	if account.WebhookURL != "" && (account.WebhookSecret == "" || regenerateWebhookSecret) {
+		account.WebhookSecret, err = newWebhookSecret()
+		if err != nil {
+			return InternalError(err, "Could not generate webhook secret")
+		}
+	}
+	for _, webhookURL := range []string{account.SlackWebhookURL, account.TeamsWebhookURL, account.WebhookURL} {
+		err := validateWebhookURL(webhookURL)
+		if err != nil {
+			return BadRequest(err, "Malformed webhook URL")
+		}
+	}
+
+	gitLabURL := strings.TrimSpace(r.FormValue("gitlab_url"))
+	// The saved token isn't sent to the page, so an empty one means that it's
+	// unchanged.
+	gitLabToken := strings.TrimSpace(r.FormValue("gitlab_token"))
+	if _, clearGitLabToken := r.Form["clear_gitlab_token"]; clearGitLabToken {
+		gitLabToken = ""
+	} else if gitLabToken == "" {
+		gitLabToken = account.GitLabToken
+	}
+	gitLabUserId := account.GitLabUserId
+	if gitLabToken == "" {
+		gitLabUserId = 0
+	} else if gitLabToken != account.GitLabToken || gitLabURL != account.GitLabURL {
+		err := validateGitLabURL(gitLabURL)
+		if err != nil {
+			return BadRequest(err, "Malformed GitLab URL")
+		}
+		gitLabUser, err := newGitLabProvider(c, gitLabURL, gitLabToken).GetUser()
+		if err != nil {
+			return BadRequest(err, "Could not sign in to GitLab with the access token")
+		}
+		gitLabUserId = *gitLabUser.ID
+	}
+	// GitLab repository IDs are only unique within an instance, so indexed
+	// commits and vintages from another instance (or another user's) could
+	// be mistaken for the new one's.
+	resetRepoState := account.GitLabToken != "" &&
+		(gitLabUserId != account.GitLabUserId || gitLabURL != account.GitLabURL)
+	account.GitLabURL = gitLabURL
+	account.GitLabToken = gitLabToken
+	account.GitLabUserId = gitLabUserId
+
+	localRepositoriesChanged := false
+	if localRepositoriesEnabled() {
+		previousGlobs := strings.Join(account.LocalRepositoryGlobs, "\n")
+		previousEmails := strings.Join(account.LocalAuthorEmails, "\n")
+		// Paths may contain spaces, so they're one per line.
+		account.LocalRepositoryGlobs = make([]string, 0)
+		for _, glob := range strings.Split(r.FormValue("local_repository_globs"), "\n") {
+			glob = strings.TrimSpace(glob)
+			if glob == "" {
+				continue
+			}
+			err := validateLocalRepositoryGlob(glob)
+			if err != nil {
+				return BadRequest(err, "Malformed local repository path")
+			}
+			account.LocalRepositoryGlobs = append(account.LocalRepositoryGlobs, glob)
+		}
+		account.LocalAuthorEmails = nil
+		if len(account.LocalRepositoryGlobs) > 0 {
+			account.LocalAuthorEmails, err = parseRecipients(r.FormValue("local_author_emails"))
+			if err != nil {
+				return BadRequest(err, "Malformed or missing author emails for local repositories")
+			}
+		}
+		// Local commits were indexed by matching the previous emails, in the
+		// previous repositories.
+		localRepositoriesChanged = strings.Join(account.LocalRepositoryGlobs, "\n") != previousGlobs ||
+			!strings.EqualFold(strings.Join(account.LocalAuthorEmails, "\n"), previousEmails)
+	}
+
+	authorAliases, err := parseAuthorAliases(r.FormValue("author_aliases"))
+	if err != nil {
+		return BadRequest(err, "Malformed author aliases")
+	}
+	// Indexed commits were only matched with the previous aliases, and
+	// vintages only include their emails' commits.
+	if !authorAliasesEqual(authorAliases, account.AuthorAliases) {
+		resetRepoState = true
+	}
+	resetCommitIndex := resetRepoState || localRepositoriesChanged
+	account.AuthorAliases = authorAliases
+
+	digestArchiveDays, err := strconv.Atoi(r.FormValue("digest_archive_days"))
+	if err != nil || (digestArchiveDays < 0 && digestArchiveDays != DigestArchiveForever) {
+		return BadRequest(err, "Malformed digest_archive_days value")
+	}
+	account.DigestArchiveDays = digestArchiveDays
+	account.HasDigestArchiveDays = true
+	// Shortening the retention applies right away, not just after the next
+	// digest.
+	if cutoff := account.DigestArchiveCutoff(time.Now()); !cutoff.IsZero() {
+		err = storage.DeleteArchivedDigests(c, account.GitHubUserId, cutoff)
+		if err != nil {
+			return InternalError(err, "Could not delete old sent digests")
+		}
+	}
 
 	err = account.Put(c)
 	if err != nil {
 		return InternalError(err, "Could not save user")
 	}
+	if resetRepoState {
+		err = storage.DeleteVintages(c, account.GitHubUserId)
+		if err != nil {
+			return InternalError(err, "Could not reset repository vintages")
+		}
+	}
+	if resetCommitIndex {
+		err = storage.DeleteCommitIndex(c, account.GitHubUserId)
+		if err != nil {
+			return InternalError(err, "Could not reset commit index")
+		}
+		if !githubConfig.CommitIndex.Disabled {
+			indexCommitsFunc.Call(c, account.GitHubUserId)
+		}
+	}
 
 	state.AddFlash("Settings saved.")
 	return RedirectToRoute("settings")
 }
 
+// parseScheduleForm reads the frequency, weekly_day, monthly_day,
+// delivery_hour and timezone_name fields that are shared by the account and
+// team digest forms.
+func parseScheduleForm(r *http.Request) (*DigestSchedule, *AppError) {
+	schedule := &DigestSchedule{
+		Frequency: r.FormValue("frequency"),
+	}
+	weeklyDay, err := strconv.Atoi(r.FormValue("weekly_day"))
+	if err != nil {
+		return nil, BadRequest(err, "Malformed weekly_day value")
+	}
+	schedule.WeeklyDay = time.Weekday(weeklyDay)
+
+	monthlyDay, err := strconv.Atoi(r.FormValue("monthly_day"))
+	if err != nil || monthlyDay < 1 || monthlyDay > 31 {
+		return nil, BadRequest(err, "Malformed monthly_day value")
+	}
+	schedule.MonthlyDay = monthlyDay
+
+	deliveryHour, err := strconv.Atoi(r.FormValue("delivery_hour"))
+	if err != nil || deliveryHour < 0 || deliveryHour > 23 {
+		return nil, BadRequest(err, "Malformed delivery_hour value")
+	}
+	schedule.DeliveryHour = deliveryHour
+
+	schedule.Location, err = time.LoadLocation(r.FormValue("timezone_name"))
+	if err != nil {
+		return nil, BadRequest(err, "Malformed timezone_name value")
+	}
+	return schedule, nil
+}
+
 func setInitialTimezoneHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	account := state.Account
 
 	timezoneName := r.FormValue("timezone_name")
@@ -509,9 +837,9 @@ func setInitialTimezoneHandler(w http.ResponseWriter, r *http.Request, state *Ap
 	return nil
 }
 
-var cacheDigestForAccountFunc = delay.Func(
+var cacheDigestForAccountFunc = newDelayedFunc(
 	"cacheDigestForAccount",
-	func(c appengine.Context, githubUserId int) error {
+	func(c Context, githubUserId int) error {
 		c.Infof("Caching digest for %d...", githubUserId)
 		account, err := getAccount(c, githubUserId)
 		if err != nil {
@@ -523,7 +851,7 @@ var cacheDigestForAccountFunc = delay.Func(
 
 		oauthTransport := githubOAuthTransport(c)
 		oauthTransport.Token = &account.OAuthToken
-		githubClient := github.NewClient(oauthTransport.Client())
+		githubClient := newGitHubClient(oauthTransport.Client())
 		_, err = newDigest(c, githubClient, account)
 		if err != nil {
 			c.Errorf("  Error computing digest: %s", err.Error())
@@ -532,22 +860,83 @@ var cacheDigestForAccountFunc = delay.Func(
 		return nil
 	})
 
+// createFeedHandler turns on the account's digest feed, or (if it was already
+// on) changes its URL, so that the previous one stops working.
+func createFeedHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	c := newContext(r)
+	account := state.Account
+	hadFeed := account.FeedToken != ""
+	var err error
+	account.FeedToken, err = newFeedToken()
+	if err != nil {
+		return InternalError(err, "Could not generate feed token")
+	}
+	err = account.Put(c)
+	if err != nil {
+		return InternalError(err, "Could not save feed token")
+	}
+	if hadFeed {
+		state.AddFlash("Feed URL reset, subscribe to the new one.")
+	} else {
+		state.AddFlash("Feed turned on.")
+	}
+	return RedirectToRoute("settings")
+}
+
+func revokeFeedHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	c := newContext(r)
+	account := state.Account
+	account.FeedToken = ""
+	err := account.Put(c)
+	if err != nil {
+		return InternalError(err, "Could not save account")
+	}
+	state.AddFlash("Feed turned off.")
+	return RedirectToRoute("settings")
+}
+
+func createAPITokenHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	c := newContext(r)
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return BadRequest(nil, "API tokens need a name")
+	}
+	value, token, err := newAPIToken(state.Account.GitHubUserId, name)
+	if err != nil {
+		return InternalError(err, "Could not generate API token")
+	}
+	err = storage.PutAPIToken(c, token)
+	if err != nil {
+		return InternalError(err, "Could not save API token")
+	}
+	state.AddFlash(fmt.Sprintf("Your new API token is %s (it won't be shown again).", value))
+	return RedirectToRoute("settings")
+}
+
+func revokeAPITokenHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	c := newContext(r)
+	token, err := storage.GetAPIToken(c, r.FormValue("hash"))
+	if err != nil || token.GitHubUserId != state.Account.GitHubUserId {
+		return BadRequest(err, "Unknown API token")
+	}
+	err = storage.DeleteAPIToken(c, token.Hash)
+	if err != nil {
+		return InternalError(err, "Could not revoke API token")
+	}
+	state.AddFlash(fmt.Sprintf("API token \"%s\" revoked.", token.Name))
+	return RedirectToRoute("settings")
+}
+
 func deleteAccountHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	state.Account.Delete(c)
 	state.ClearSession()
 	return RedirectToRoute("index")
 }
 
-func githubOAuthTransport(c appengine.Context) *oauth.Transport {
-	appengineTransport := &urlfetch.Transport{Context: c}
-	appengineTransport.Deadline = time.Second * 60
-	cachingTransport := &CachingTransport{
-		Transport: appengineTransport,
-		Context:   c,
-	}
+func githubOAuthTransport(c Context) *oauth.Transport {
 	return &oauth.Transport{
 		Config:    &githubOauthConfig,
-		Transport: cachingTransport,
+		Transport: newGitHubTransport(c),
 	}
 }
@@ -0,0 +1,85 @@
+package retrogit
+
+import (
+	"time"
+)
+
+const (
+	// Matches the time that all digests used to be sent at (in Pacific time).
+	DefaultDeliveryHour = 13
+	DeliveryHourFormat  = "3pm"
+)
+
+// DigestSchedule describes when digests are sent (for accounts and team
+// subscriptions).
+type DigestSchedule struct {
+	// "daily", "weekly" or "monthly".
+	Frequency  string
+	WeeklyDay  time.Weekday
+	MonthlyDay int
+	// Local hour of the day that digests are sent at.
+	DeliveryHour int
+	Location     *time.Location
+}
+
+// IsDeliveryDue returns true if the delivery time for the day falls within the
+// hour ending at dispatchTime (rounded down to the hour). Comparing instants
+// instead of local hours means that a digest is sent exactly once a day even
+// when DST transitions skip or repeat an hour, and in timezones that are not a
+// whole number of hours away from UTC.
+func (s *DigestSchedule) IsDeliveryDue(dispatchTime time.Time) bool {
+	dispatchTime = dispatchTime.Truncate(time.Hour)
+	deliveryTime := s.DeliveryTime(dispatchTime)
+	return deliveryTime.After(dispatchTime.Add(-time.Hour)) && !deliveryTime.After(dispatchTime)
+}
+
+// DeliveryTime returns when the digest is delivered on the (local) day of t.
+func (s *DigestSchedule) DeliveryTime(t time.Time) time.Time {
+	t = t.In(s.Location)
+	return time.Date(t.Year(), t.Month(), t.Day(), s.DeliveryHour, 0, 0, 0, s.Location)
+}
+
+// IsMonthlyDeliveryDay returns true if t is (locally) the day of the month
+// that monthly digests should be sent on. In months that don't have that day,
+// the last day is used instead.
+func (s *DigestSchedule) IsMonthlyDeliveryDay(t time.Time) bool {
+	t = t.In(s.Location)
+	deliveryDay := s.MonthlyDay
+	daysInMonth := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+	if deliveryDay > daysInMonth {
+		deliveryDay = daysInMonth
+	}
+	return t.Day() == deliveryDay
+}
+
+// IsDue returns true if a digest should be sent for the hour ending at
+// dispatchTime. name is used for logging why weekly and monthly digests are
+// skipped.
+func (s *DigestSchedule) IsDue(c Context, dispatchTime time.Time, name string) bool {
+	if !s.IsDeliveryDue(dispatchTime) {
+		return false
+	}
+	now := s.DeliveryTime(dispatchTime)
+	if s.Frequency == "weekly" {
+		if now.Weekday() != s.WeeklyDay {
+			c.Infof("Skipping %s, since it wants weekly digests on %ss and today is a %s.",
+				name, s.WeeklyDay, now.Weekday())
+			return false
+		}
+	} else if s.Frequency == "monthly" {
+		if !s.IsMonthlyDeliveryDay(now) {
+			c.Infof("Skipping %s, since it wants monthly digests on day %d and today is day %d.",
+				name, s.MonthlyDay, now.Day())
+			return false
+		}
+	}
+	return true
+}
+
+func (s *DigestSchedule) DisplayDeliveryHour() string {
+	return formatDeliveryHour(s.DeliveryHour)
+}
+
+func formatDeliveryHour(hour int) string {
+	return time.Date(2000, 1, 1, hour, 0, 0, 0, time.UTC).Format(DeliveryHourFormat)
+}
@@ -0,0 +1,91 @@
+package retrogit
+
+import (
+	"testing"
+	"time"
+)
+
+func loadTestLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("Could not load %s: %s", name, err.Error())
+	}
+	return location
+}
+
+func TestDigestScheduleIsDeliveryDue(t *testing.T) {
+	pacific := loadTestLocation(t, "America/Los_Angeles")
+	india := loadTestLocation(t, "Asia/Kolkata")
+
+	for _, test := range []struct {
+		description  string
+		location     *time.Location
+		deliveryHour int
+		// Local date whose delivery is checked.
+		year  int
+		month time.Month
+		day   int
+		// Expected (UTC) end of the hour that the delivery is dispatched in.
+		dispatchTime time.Time
+	}{
+		{"standard time", pacific, 13, 2015, time.March, 7, time.Date(2015, time.March, 7, 21, 0, 0, 0, time.UTC)},
+		{"spring forward", pacific, 13, 2015, time.March, 8, time.Date(2015, time.March, 8, 20, 0, 0, 0, time.UTC)},
+		{"skipped hour", pacific, 2, 2015, time.March, 8, time.Date(2015, time.March, 8, 9, 0, 0, 0, time.UTC)},
+		{"hour after the skipped one", pacific, 3, 2015, time.March, 8, time.Date(2015, time.March, 8, 10, 0, 0, 0, time.UTC)},
+		{"fall back", pacific, 13, 2015, time.November, 1, time.Date(2015, time.November, 1, 21, 0, 0, 0, time.UTC)},
+		{"repeated hour", pacific, 1, 2015, time.November, 1, time.Date(2015, time.November, 1, 8, 0, 0, 0, time.UTC)},
+		{"half-hour offset", india, 13, 2015, time.March, 8, time.Date(2015, time.March, 8, 8, 0, 0, 0, time.UTC)},
+		{"half-hour offset at midnight", india, 0, 2015, time.March, 8, time.Date(2015, time.March, 7, 19, 0, 0, 0, time.UTC)},
+	} {
+		schedule := &DigestSchedule{DeliveryHour: test.deliveryHour, Location: test.location}
+		// Every hour that could be on the local date, in any timezone.
+		start := time.Date(test.year, test.month, test.day, 0, 0, 0, 0, time.UTC).Add(-time.Hour * 24)
+		dueTimes := make([]time.Time, 0)
+		for dispatchTime := start; dispatchTime.Before(start.Add(time.Hour * 72)); dispatchTime = dispatchTime.Add(time.Hour) {
+			if !schedule.IsDeliveryDue(dispatchTime) {
+				continue
+			}
+			deliveryTime := schedule.DeliveryTime(dispatchTime)
+			if deliveryTime.Year() == test.year && deliveryTime.Month() == test.month && deliveryTime.Day() == test.day {
+				dueTimes = append(dueTimes, dispatchTime)
+			}
+		}
+		if len(dueTimes) != 1 {
+			t.Errorf("%s: due at %v, expected exactly once", test.description, dueTimes)
+			continue
+		}
+		if !dueTimes[0].Equal(test.dispatchTime) {
+			t.Errorf("%s: due at %s, expected %s", test.description, dueTimes[0].UTC(), test.dispatchTime)
+		}
+	}
+}
+
+func TestDigestScheduleIsMonthlyDeliveryDay(t *testing.T) {
+	for _, test := range []struct {
+		monthlyDay int
+		year       int
+		month      time.Month
+		day        int
+		isDue      bool
+	}{
+		{31, 2015, time.February, 28, true},
+		{31, 2015, time.February, 27, false},
+		{31, 2016, time.February, 29, true},
+		{31, 2016, time.February, 28, false},
+		{31, 2015, time.March, 30, false},
+		{31, 2015, time.March, 31, true},
+		{30, 2015, time.April, 30, true},
+		{1, 2015, time.February, 1, true},
+	} {
+		schedule := &DigestSchedule{
+			Frequency:  "monthly",
+			MonthlyDay: test.monthlyDay,
+			Location:   time.UTC,
+		}
+		deliveryTime := time.Date(test.year, test.month, test.day, DefaultDeliveryHour, 0, 0, 0, time.UTC)
+		if isDue := schedule.IsMonthlyDeliveryDay(deliveryTime); isDue != test.isDue {
+			t.Errorf("Day %d on %d-%02d-%02d: due = %t, expected %t",
+				test.monthlyDay, test.year, test.month, test.day, isDue, test.isDue)
+		}
+	}
+}
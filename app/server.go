@@ -0,0 +1,146 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+type ServerConfig struct {
+	// Address to listen on, e.g. ":8080".
+	Address string
+	// Where the server is reachable from, used for absolute links in emails.
+	BaseUrl string
+	// HTTP basic auth credentials for the /admin/ and /digest/cron routes
+	// (which are restricted to admins via app.yaml on App Engine). Those
+	// routes are disabled if no password is set.
+	AdminUsername string
+	AdminPassword string
+	// If both are set, the server is served over HTTPS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// Enables the "-dev" GitHub OAuth config, non-secure cookies and error
+	// details in pages.
+	Development bool
+	// Allows webhooks and GitLab instances on private networks (e.g. a GitLab
+	// server on the same network), which are otherwise rejected so that users
+	// can't make the server send requests to internal services.
+	AllowPrivateNetworkURLs bool
+	// Overrides for the JobQueue defaults.
+	JobWorkers     int
+	JobMaxAttempts int
+	// Directories that accounts' LocalRepositoryGlobs may match repositories
+	// in (see LocalGitProvider). Local repositories are disabled if there are
+	// none, since they're read with the server's permissions. Any user can
+	// include any repository in them, and author emails aren't verified, so
+	// they should only have repositories that all users may read (e.g. with a
+	// server per team).
+	LocalRepositoryRoots []string
+}
+
+var serverConfig ServerConfig
+var jobQueue *JobQueue
+
+func initServerConfig() (config ServerConfig) {
+	config.Address = ":8080"
+	configBytes, err := ioutil.ReadFile("config/server.json")
+	if err == nil {
+		err = json.Unmarshal(configBytes, &config)
+		if err != nil {
+			log.Panicf("Could not parse server config %s: %s", configBytes, err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		log.Panicf("Could not read server config: %s", err.Error())
+	}
+	if config.BaseUrl == "" {
+		config.BaseUrl = "http://localhost" + config.Address
+	}
+	return
+}
+
+// ListenAndServe runs the app as a standalone HTTP server. It must be called
+// with the app directory as the working directory, so that the config,
+// templates and static directories can be found. If address is empty, the one
+// from config/server.json is used.
+func ListenAndServe(address string) error {
+	serverConfig = initServerConfig()
+	if address != "" {
+		serverConfig.Address = address
+	}
+	appHandler := initApp()
+	initJobQueue()
+
+	serveMux := http.NewServeMux()
+	serveMux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	serveMux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/favicon.ico")
+	})
+	serveMux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/robots.txt")
+	})
+	serveMux.Handle("/admin/", AdminHandler{appHandler})
+	serveMux.Handle("/digest/cron", AdminHandler{appHandler})
+	serveMux.Handle("/", appHandler)
+
+	log.Printf("Serving on %s", serverConfig.Address)
+	if serverConfig.TLSCertFile != "" && serverConfig.TLSKeyFile != "" {
+		return http.ListenAndServeTLS(
+			serverConfig.Address, serverConfig.TLSCertFile, serverConfig.TLSKeyFile, serveMux)
+	}
+	return http.ListenAndServe(serverConfig.Address, serveMux)
+}
+
+func initJobQueue() {
+	jobStore, ok := storage.(JobStore)
+	if !ok {
+		log.Panicf("Storage backend does not support jobs")
+	}
+	jobQueue = newJobQueue(jobStore, time.Now)
+	if serverConfig.JobWorkers > 0 {
+		jobQueue.Workers = serverConfig.JobWorkers
+	}
+	if serverConfig.JobMaxAttempts > 0 {
+		jobQueue.MaxAttempts = serverConfig.JobMaxAttempts
+	}
+
+	c := &logContext{}
+	err := jobQueue.AddPeriodic(c, "digestCron", nextDigestCronTime)
+	if err != nil {
+		log.Panicf("Could not schedule digests: %s", err.Error())
+	}
+	jobQueue.Start(c, time.Second*5)
+}
+
+func init() {
+	registerJobFunc("digestCron", enqueueDigests)
+}
+
+// Matches the schedule in cron.yaml (at the start of every hour).
+func nextDigestCronTime(now time.Time) time.Time {
+	return now.Truncate(time.Hour).Add(time.Hour)
+}
+
+// Restricts the wrapped handler to requests with the admin credentials from the
+// server config.
+type AdminHandler struct {
+	http.Handler
+}
+
+func (h AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || serverConfig.AdminPassword == "" ||
+		subtle.ConstantTimeCompare([]byte(username), []byte(serverConfig.AdminUsername)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(serverConfig.AdminPassword)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="RetroGit Admin"`)
+		http.Error(w, "Admin credentials required", http.StatusUnauthorized)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
@@ -6,8 +6,6 @@ import (
 	"io/ioutil"
 	"log"
 
-	"appengine"
-
 	"github.com/gorilla/sessions"
 )
 
@@ -41,6 +39,6 @@ func initSession() (sessionStore *sessions.CookieStore, sessionConfig SessionCon
 	sessionStore.Options.Path = "/"
 	sessionStore.Options.MaxAge = 86400 * 30
 	sessionStore.Options.HttpOnly = true
-	sessionStore.Options.Secure = !appengine.IsDevAppServer()
+	sessionStore.Options.Secure = !isDevelopment()
 	return
 }
@@ -0,0 +1,113 @@
+package retrogit
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Block Kit limits.
+	maxSlackBlocks          = 50
+	maxSlackSectionTextSize = 3000
+)
+
+// SlackChannel posts digests to a Slack incoming webhook, formatted with
+// Block Kit.
+type SlackChannel struct {
+	WebhookURL string
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text,omitempty"`
+	Elements []slackText `json:"elements,omitempty"`
+}
+
+type slackMessage struct {
+	// Shown in notifications.
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+func (channel *SlackChannel) Name() string {
+	return "Slack"
+}
+
+func (channel *SlackChannel) Deliver(c Context, digest *Digest) error {
+	return postWebhookPayload(c, channel.WebhookURL, newSlackMessage(digest))
+}
+
+func newSlackMessage(digest *Digest) *slackMessage {
+	blocks := []slackBlock{slackSectionBlock(slackEscape(digestSummary(digest)))}
+	for _, intervalDigest := range digest.IntervalDigests {
+		blocks = append(blocks,
+			slackBlock{Type: "header", Text: &slackText{"plain_text", intervalDigest.Header()}},
+			slackBlock{Type: "context", Elements: []slackText{
+				{"mrkdwn", slackEscape(unsafeFormattedText(intervalDigest.Description()))},
+			}})
+		for _, repoDigest := range intervalDigest.RepoDigests {
+			lines := []string{fmt.Sprintf("*<%s|%s>*", *repoDigest.Repo.HTMLURL, slackEscape(*repoDigest.Repo.FullName))}
+			for i, commit := range repoDigest.Commits {
+				if i == MaxChatCommitsPerRepo {
+					lines = append(lines, fmt.Sprintf("…and %d more", len(repoDigest.Commits)-i))
+					break
+				}
+				lines = append(lines, fmt.Sprintf("• <%s|`%s`> %s _%s_",
+					commit.URL, commit.DisplaySHA, slackEscape(commit.Title),
+					chatDisplayDate(intervalDigest, commit.DisplayDate(), commit.WeeklyDisplayDate())))
+			}
+			blocks = append(blocks, slackSectionBlock(strings.Join(lines, "\n")))
+		}
+		for _, section := range chatActivitySections(intervalDigest) {
+			lines := []string{fmt.Sprintf("*%s*", section.Title)}
+			for _, item := range section.Items {
+				lines = append(lines, fmt.Sprintf("• %s <%s|%s> %s _%s_",
+					item.Action, item.URL, slackEscape(item.Label), slackEscape(item.Title), item.Date))
+			}
+			blocks = append(blocks, slackSectionBlock(strings.Join(lines, "\n")))
+		}
+	}
+
+	viewBlock := slackBlock{Type: "context", Elements: []slackText{
+		{"mrkdwn", fmt.Sprintf("<%s|View the full digest>", viewDigestURL())},
+	}}
+	if len(blocks) >= maxSlackBlocks {
+		blocks = blocks[:maxSlackBlocks-1]
+	}
+	blocks = append(blocks, viewBlock)
+	return &slackMessage{
+		Text:   digestSummary(digest),
+		Blocks: blocks,
+	}
+}
+
+func slackSectionBlock(text string) slackBlock {
+	if len(text) > maxSlackSectionTextSize {
+		end := maxSlackSectionTextSize - len("…")
+		// Avoid cutting in the middle of a multi-byte character...
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		text = text[:end]
+		// ...or, if possible, of a link.
+		if i := strings.LastIndex(text, "\n"); i > 0 {
+			text = text[:i+1]
+		}
+		text += "…"
+	}
+	return slackBlock{Type: "section", Text: &slackText{"mrkdwn", text}}
+}
+
+// slackEscape escapes the characters that have special meaning in Slack's
+// mrkdwn.
+func slackEscape(text string) string {
+	text = strings.Replace(text, "&", "&amp;", -1)
+	text = strings.Replace(text, "<", "&lt;", -1)
+	return strings.Replace(text, ">", "&gt;", -1)
+}
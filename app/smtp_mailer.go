@@ -0,0 +1,81 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+)
+
+type SMTPMailer struct {
+	config SMTPConfig
+}
+
+func (m *SMTPMailer) Send(c Context, message *MailMessage) error {
+	messageBytes, err := formatMailMessage(message)
+	if err != nil {
+		return err
+	}
+	sender, err := mail.ParseAddress(message.Sender)
+	if err != nil {
+		return err
+	}
+
+	port := m.config.Port
+	if port == 0 {
+		port = 587
+	}
+	client, err := smtp.Dial(net.JoinHostPort(m.config.Host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if hasStartTLS, _ := client.Extension("STARTTLS"); hasStartTLS {
+		err = client.StartTLS(&tls.Config{ServerName: m.config.Host})
+		if err != nil {
+			return err
+		}
+	} else if m.config.RequireTLS {
+		return errors.New("SMTP server does not support STARTTLS")
+	}
+	if m.config.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(sender.Address)
+	if err != nil {
+		return err
+	}
+	for _, to := range message.To {
+		recipient, err := mail.ParseAddress(to)
+		if err != nil {
+			return err
+		}
+		err = client.Rcpt(recipient.Address)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(messageBytes)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,134 @@
+//go:build !appengine
+// +build !appengine
+
+package retrogit
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Context implementation that logs via the standard log package, used when
+// running outside of App Engine.
+type logContext struct{}
+
+func (c *logContext) Debugf(format string, args ...interface{}) {
+	log.Printf("DEBUG: "+format, args...)
+}
+
+func (c *logContext) Infof(format string, args ...interface{}) {
+	log.Printf("INFO: "+format, args...)
+}
+
+func (c *logContext) Warningf(format string, args ...interface{}) {
+	log.Printf("WARNING: "+format, args...)
+}
+
+func (c *logContext) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR: "+format, args...)
+}
+
+func newContext(r *http.Request) Context {
+	return &logContext{}
+}
+
+func isDevelopment() bool {
+	return serverConfig.Development
+}
+
+func baseUrl() string {
+	return serverConfig.BaseUrl
+}
+
+func newGitHubTransport(c Context) http.RoundTripper {
+	return &CachingTransport{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout: time.Second * 30,
+			}).Dial,
+			TLSHandshakeTimeout:   time.Second * 10,
+			ResponseHeaderTimeout: time.Second * 60,
+		},
+		Cache:   responseCache,
+		Context: c,
+	}
+}
+
+// privateURLsAllowed returns whether webhooks and GitLab instances may be on
+// private networks (see validatePublicURL).
+func privateURLsAllowed() bool {
+	return serverConfig.Development || serverConfig.AllowPrivateNetworkURLs
+}
+
+// newPublicTransport returns a transport for requests to user-provided URLs.
+// They're not made via a proxy, since then it would be the proxy's address
+// that is checked when connecting.
+func newPublicTransport(responseHeaderTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		Dial: dialPublic(&net.Dialer{
+			Timeout: time.Second * 30,
+		}),
+		TLSHandshakeTimeout:   time.Second * 10,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+}
+
+func newGitLabTransport(c Context) http.RoundTripper {
+	return &CachingTransport{
+		Transport: newPublicTransport(time.Second * 60),
+		Cache:     responseCache,
+		Context:   c,
+	}
+}
+
+func newWebhookTransport(c Context) http.RoundTripper {
+	return newPublicTransport(time.Second * 30)
+}
+
+func newResponseCache(config ResponseCacheConfig) (ResponseCache, error) {
+	switch config.Backend {
+	case "", "memory":
+		return newMemoryResponseCache(config), nil
+	case "disk":
+		return newDiskResponseCache(config)
+	case "none":
+		return noResponseCache{}, nil
+	}
+	return nil, fmt.Errorf("Response cache backend %s is not available outside of App Engine", config.Backend)
+}
+
+func newMailer(config MailConfig) (Mailer, error) {
+	switch config.Backend {
+	case "", "file":
+		return newFileMailer(config.DropDirectory)
+	case "smtp":
+		return &SMTPMailer{config.SMTP}, nil
+	}
+	return nil, fmt.Errorf("Mail backend %s is not available outside of App Engine", config.Backend)
+}
+
+// Runs functions via the job queue, as a stand-in for App Engine's delay
+// package.
+type delayedFunc struct {
+	key string
+}
+
+func newDelayedFunc(key string, fn interface{}) *delayedFunc {
+	registerJobFunc(key, fn)
+	return &delayedFunc{key}
+}
+
+func (f *delayedFunc) Call(c Context, args ...interface{}) {
+	err := jobQueue.Add(c, f.key, 0, args...)
+	if err != nil {
+		c.Errorf("Could not enqueue %s job: %s", f.key, err.Error())
+	}
+}
+
+func (f *delayedFunc) CallLater(c Context, delay time.Duration, args ...interface{}) error {
+	return jobQueue.Add(c, f.key, delay, args...)
+}
@@ -1,11 +1,11 @@
-function updateWeeklyDayContainer() {
+function updateFrequencyDayContainers() {
   var frequencyNode = document.getElementById("frequency");
   var weeklyDayContainerNode = document.getElementById("weekly-day-container");
-  if (frequencyNode.value == "weekly") {
-    weeklyDayContainerNode.style.display = "inline";
-  } else {
-    weeklyDayContainerNode.style.display = "none";
-  }
+  var monthlyDayContainerNode = document.getElementById("monthly-day-container");
+  weeklyDayContainerNode.style.display =
+      frequencyNode.value == "weekly" ? "inline" : "none";
+  monthlyDayContainerNode.style.display =
+      frequencyNode.value == "monthly" ? "inline" : "none";
 }
 
 function updateReposContainer() {
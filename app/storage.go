@@ -0,0 +1,157 @@
+package retrogit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+var ErrAccountNotFound = errors.New("Account not found")
+var ErrTeamSubscriptionNotFound = errors.New("Team subscription not found")
+var ErrAPITokenNotFound = errors.New("API token not found")
+var ErrArchivedDigestNotFound = errors.New("Archived digest not found")
+var ErrWebhookPayloadNotFound = errors.New("Webhook payload not found")
+
+type AccountStore interface {
+	// GetAccount returns ErrAccountNotFound if there is no account for the
+	// given user.
+	GetAccount(c Context, githubUserId int) (*Account, error)
+	GetAllAccounts(c Context) ([]Account, error)
+	PutAccount(c Context, account *Account) error
+	DeleteAccount(c Context, githubUserId int) error
+}
+
+type VintageStore interface {
+	// GetVintages returns a slice parallel to repoIds, with nil entries for
+	// repos that don't have a vintage computed yet.
+	GetVintages(c Context, userId int, repoIds []int) ([]*RepoVintage, error)
+	PutVintage(c Context, vintage *RepoVintage) error
+	// DeleteVintages removes all of the user's vintages, so that they're
+	// computed again.
+	DeleteVintages(c Context, userId int) error
+}
+
+type TeamSubscriptionStore interface {
+	// GetTeamSubscription returns ErrTeamSubscriptionNotFound if there is no
+	// subscription with the given id.
+	GetTeamSubscription(c Context, id int64) (*TeamSubscription, error)
+	GetTeamSubscriptionsForOwner(c Context, ownerGitHubUserId int) ([]TeamSubscription, error)
+	GetAllTeamSubscriptions(c Context) ([]TeamSubscription, error)
+	// PutTeamSubscription assigns an Id to subscriptions that don't have one
+	// yet.
+	PutTeamSubscription(c Context, subscription *TeamSubscription) error
+	DeleteTeamSubscription(c Context, id int64) error
+}
+
+type CommitIndexStore interface {
+	// GetIndexedCommits returns the user's indexed commits that were pushed
+	// between startTime (inclusive) and endTime (exclusive), in no particular
+	// order.
+	GetIndexedCommits(c Context, userId int, startTime time.Time, endTime time.Time) ([]IndexedCommit, error)
+	// PutIndexedCommits overwrites commits that were already indexed.
+	PutIndexedCommits(c Context, commits []IndexedCommit) error
+	// GetCommitIndexStates returns a slice parallel to repoIds, with nil
+	// entries for repos that haven't been indexed yet.
+	GetCommitIndexStates(c Context, userId int, repoIds []int) ([]*CommitIndexState, error)
+	PutCommitIndexState(c Context, state *CommitIndexState) error
+	// DeleteCommitIndex removes all of the user's indexed commits and states.
+	DeleteCommitIndex(c Context, userId int) error
+}
+
+type WebhookDeliveryStore interface {
+	// PutWebhookDelivery records a delivery attempt, and drops the user's
+	// oldest ones beyond WebhookDeliveryLogSize.
+	PutWebhookDelivery(c Context, delivery *WebhookDelivery) error
+	// GetWebhookDeliveries returns the user's most recent delivery attempts,
+	// newest first.
+	GetWebhookDeliveries(c Context, githubUserId int) ([]WebhookDelivery, error)
+	// PutWebhookPayload keeps the payload of a delivery while it's being
+	// retried, since it's too big to be passed to the retry task.
+	PutWebhookPayload(c Context, githubUserId int, deliveryId string, payload []byte) error
+	// GetWebhookPayload returns ErrWebhookPayloadNotFound if there is no
+	// payload for the delivery.
+	GetWebhookPayload(c Context, githubUserId int, deliveryId string) ([]byte, error)
+	DeleteWebhookPayload(c Context, githubUserId int, deliveryId string) error
+	// DeleteWebhookDeliveries removes all of the user's delivery attempts and
+	// payloads.
+	DeleteWebhookDeliveries(c Context, githubUserId int) error
+}
+
+type APITokenStore interface {
+	// GetAPIToken returns ErrAPITokenNotFound if there is no token with the
+	// given hash.
+	GetAPIToken(c Context, hash string) (*APIToken, error)
+	GetAPITokens(c Context, githubUserId int) ([]APIToken, error)
+	PutAPIToken(c Context, token *APIToken) error
+	DeleteAPIToken(c Context, hash string) error
+	DeleteAPITokens(c Context, githubUserId int) error
+}
+
+type DigestArchiveStore interface {
+	// PutArchivedDigest assigns an Id to the digest, and stores its content
+	// alongside it.
+	PutArchivedDigest(c Context, digest *ArchivedDigest, content *ArchivedDigestContent) error
+	// GetArchivedDigests returns the user's DigestHistoryLimit most recent
+	// archived digests (without their content), newest first.
+	GetArchivedDigests(c Context, githubUserId int) ([]ArchivedDigest, error)
+	// GetArchivedDigest returns ErrArchivedDigestNotFound if the user doesn't
+	// have an archived digest with the given id.
+	GetArchivedDigest(c Context, githubUserId int, id int64) (*ArchivedDigest, *ArchivedDigestContent, error)
+	// DeleteArchivedDigests removes the user's archived digests that were
+	// sent before the given time.
+	DeleteArchivedDigests(c Context, githubUserId int, before time.Time) error
+}
+
+// Storage is implemented by each storage backend.
+type Storage interface {
+	AccountStore
+	VintageStore
+	TeamSubscriptionStore
+	CommitIndexStore
+	WebhookDeliveryStore
+	APITokenStore
+	DigestArchiveStore
+}
+
+type StorageConfig struct {
+	// One of the backends supported by newStorage in the current build
+	// ("datastore" on App Engine, "bolt" otherwise). Defaults to the first
+	// one.
+	Backend string
+	// Path to the database file, for backends that use one.
+	Path string
+}
+
+func initStorage() Storage {
+	var config StorageConfig
+	configBytes, err := ioutil.ReadFile("config/storage.json")
+	if err == nil {
+		err = json.Unmarshal(configBytes, &config)
+		if err != nil {
+			log.Panicf("Could not parse storage config %s: %s", configBytes, err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		log.Panicf("Could not read storage config: %s", err.Error())
+	}
+	storage, err := newStorage(config)
+	if err != nil {
+		log.Panicf("Could not initialize %s storage: %s", config.Backend, err.Error())
+	}
+	return storage
+}
+
+func vintageKey(userId int, repoId int) string {
+	return fmt.Sprintf("%d-%d", userId, repoId)
+}
+
+func indexedCommitKey(userId int, repoId int, sha string) string {
+	return fmt.Sprintf("%d-%d-%s", userId, repoId, sha)
+}
+
+func commitIndexStateKey(userId int, repoId int) string {
+	return fmt.Sprintf("%d-%d", userId, repoId)
+}
@@ -0,0 +1,94 @@
+package retrogit
+
+import (
+	"fmt"
+	"time"
+)
+
+// TeamSubscription is a digest of the commits made by all members of a GitHub
+// organization (or of one of its teams), sent to its own list of recipients.
+// It's fetched with the OAuth token of the account that set it up.
+type TeamSubscription struct {
+	// Assigned by the storage backend when the subscription is first saved.
+	Id                int64 `datastore:"-"`
+	OwnerGitHubUserId int
+	OrgLogin          string `datastore:",noindex"`
+	// Empty if the digest covers the whole organization.
+	TeamSlug         string         `datastore:",noindex"`
+	Recipients       []string       `datastore:",noindex"`
+	TimezoneName     string         `datastore:",noindex"`
+	TimezoneLocation *time.Location `datastore:"-," json:"-"`
+	Frequency        string
+	WeeklyDay        time.Weekday
+	MonthlyDay       int
+	DeliveryHour     int
+}
+
+func getTeamSubscription(c Context, id int64) (*TeamSubscription, error) {
+	subscription, err := storage.GetTeamSubscription(c, id)
+	if err != nil {
+		return nil, err
+	}
+	err = initTeamSubscription(subscription)
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+func getTeamSubscriptionsForOwner(c Context, ownerGitHubUserId int) ([]TeamSubscription, error) {
+	subscriptions, err := storage.GetTeamSubscriptionsForOwner(c, ownerGitHubUserId)
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, initTeamSubscriptions(subscriptions)
+}
+
+func getAllTeamSubscriptions(c Context) ([]TeamSubscription, error) {
+	subscriptions, err := storage.GetAllTeamSubscriptions(c)
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, initTeamSubscriptions(subscriptions)
+}
+
+func initTeamSubscriptions(subscriptions []TeamSubscription) error {
+	for i := range subscriptions {
+		err := initTeamSubscription(&subscriptions[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func initTeamSubscription(subscription *TeamSubscription) (err error) {
+	subscription.TimezoneLocation, err = time.LoadLocation(subscription.TimezoneName)
+	return
+}
+
+// Name is the organization login, followed by the team slug (if there is one).
+func (subscription *TeamSubscription) Name() string {
+	if subscription.TeamSlug == "" {
+		return subscription.OrgLogin
+	}
+	return fmt.Sprintf("%s/%s", subscription.OrgLogin, subscription.TeamSlug)
+}
+
+func (subscription *TeamSubscription) Schedule() *DigestSchedule {
+	return &DigestSchedule{
+		Frequency:    subscription.Frequency,
+		WeeklyDay:    subscription.WeeklyDay,
+		MonthlyDay:   subscription.MonthlyDay,
+		DeliveryHour: subscription.DeliveryHour,
+		Location:     subscription.TimezoneLocation,
+	}
+}
+
+func (subscription *TeamSubscription) Put(c Context) error {
+	return storage.PutTeamSubscription(c, subscription)
+}
+
+func (subscription *TeamSubscription) Delete(c Context) error {
+	return storage.DeleteTeamSubscription(c, subscription.Id)
+}
@@ -0,0 +1,337 @@
+package retrogit
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+type MemberDigest struct {
+	User        *github.User
+	RepoDigests []*RepoDigest
+	CommitCount int
+}
+
+// sort.Interface implementation for sorting MemberDigests.
+type ByMemberLogin []*MemberDigest
+
+func (a ByMemberLogin) Len() int           { return len(a) }
+func (a ByMemberLogin) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByMemberLogin) Less(i, j int) bool { return *a[i].User.Login < *a[j].User.Login }
+
+type TeamIntervalDigest struct {
+	yearDelta     int
+	name          string
+	StartTime     time.Time
+	EndTime       time.Time
+	Weekly        bool
+	Monthly       bool
+	MemberDigests []*MemberDigest
+	repos         []*Repo
+}
+
+func (digest *TeamIntervalDigest) Empty() bool {
+	return len(digest.MemberDigests) == 0
+}
+
+func (digest *TeamIntervalDigest) Header() string {
+	return intervalHeader(digest.yearDelta)
+}
+
+func (digest *TeamIntervalDigest) Description() string {
+	commitCount := 0
+	repoFullNames := make(map[string]bool)
+	for _, memberDigest := range digest.MemberDigests {
+		commitCount += memberDigest.CommitCount
+		for _, repoDigest := range memberDigest.RepoDigests {
+			repoFullNames[*repoDigest.Repo.FullName] = true
+		}
+	}
+	return describeInterval(digest.name, digest.StartTime, digest.EndTime, digest.Weekly, digest.Monthly,
+		commitCount, len(repoFullNames))
+}
+
+// TeamDigest is the equivalent of Digest for a TeamSubscription. Commits are
+// grouped by member, then by repository.
+type TeamDigest struct {
+	Subscription     *TeamSubscription
+	Org              *github.Organization
+	TimezoneLocation *time.Location
+	IntervalDigests  []*TeamIntervalDigest
+	MemberCount      int
+	CommitCount      int
+	RepoErrors       map[string]error
+}
+
+func newTeamDigest(c Context, githubClient *github.Client, subscription *TeamSubscription) (*TeamDigest, error) {
+	org, _, err := githubClient.Organizations.Get(subscription.OrgLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := getTeamMembers(githubClient, subscription.OrgLogin, subscription.TeamSlug)
+	if err != nil {
+		return nil, err
+	}
+
+	repos, err := getOrgRepos(githubClient, subscription.OrgLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	// There are no per-user vintages for the whole team, so repository
+	// creation times are used instead.
+	oldestDigestTime := time.Now()
+	for _, repo := range repos {
+		if repo.Vintage.Before(oldestDigestTime) {
+			oldestDigestTime = repo.Vintage
+		}
+	}
+	intervalDigests := make([]*TeamIntervalDigest, 0)
+	now := time.Now().In(subscription.TimezoneLocation)
+	for yearDelta := -1; ; yearDelta-- {
+		digestStartTime, digestEndTime := digestIntervalTimes(now, subscription.Frequency, yearDelta)
+		if !digestEndTime.After(oldestDigestTime) {
+			break
+		}
+
+		// Only look at repos that may have activity in the digest interval.
+		var intervalRepos []*Repo
+		for _, repo := range repos {
+			if repo.Vintage.Before(digestEndTime) && repo.PushedAt != nil &&
+				repo.PushedAt.After(digestStartTime) {
+				intervalRepos = append(intervalRepos, repo)
+			}
+		}
+
+		intervalDigests = append(intervalDigests, &TeamIntervalDigest{
+			yearDelta:     yearDelta,
+			name:          subscription.Name(),
+			repos:         intervalRepos,
+			MemberDigests: make([]*MemberDigest, 0),
+			StartTime:     digestStartTime,
+			EndTime:       digestEndTime,
+			Weekly:        subscription.Frequency == "weekly",
+			Monthly:       subscription.Frequency == "monthly",
+		})
+	}
+
+	digest := &TeamDigest{
+		Subscription:     subscription,
+		Org:              org,
+		TimezoneLocation: subscription.TimezoneLocation,
+		IntervalDigests:  intervalDigests,
+		RepoErrors:       make(map[string]error),
+	}
+
+	digest.fetch(githubClient, members)
+	for repoFullName, err := range digest.RepoErrors {
+		c.Errorf("Error fetching %s: %s", repoFullName, err.Error())
+	}
+	return digest, nil
+}
+
+// getTeamMembers returns the members of the given team in the organization, or
+// of the whole organization if teamSlug is empty.
+func getTeamMembers(githubClient *github.Client, orgLogin string, teamSlug string) ([]github.User, error) {
+	members := make([]github.User, 0)
+	if teamSlug == "" {
+		page := 1
+		for {
+			pageMembers, response, err := githubClient.Organizations.ListMembers(
+				orgLogin,
+				&github.ListMembersOptions{
+					ListOptions: github.ListOptions{
+						Page:    page,
+						PerPage: 100,
+					},
+				})
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, pageMembers...)
+			if response.NextPage == 0 {
+				break
+			}
+			page = response.NextPage
+		}
+		return members, nil
+	}
+
+	teamId, err := getTeamId(githubClient, orgLogin, teamSlug)
+	if err != nil {
+		return nil, err
+	}
+	page := 1
+	for {
+		pageMembers, response, err := githubClient.Organizations.ListTeamMembers(
+			teamId,
+			&github.ListOptions{
+				Page:    page,
+				PerPage: 100,
+			})
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, pageMembers...)
+		if response.NextPage == 0 {
+			break
+		}
+		page = response.NextPage
+	}
+	return members, nil
+}
+
+func getTeamId(githubClient *github.Client, orgLogin string, teamSlug string) (int, error) {
+	page := 1
+	for {
+		teams, response, err := githubClient.Organizations.ListTeams(
+			orgLogin,
+			&github.ListOptions{
+				Page:    page,
+				PerPage: 100,
+			})
+		if err != nil {
+			return 0, err
+		}
+		for i := range teams {
+			if teams[i].Slug != nil && *teams[i].Slug == teamSlug {
+				return *teams[i].ID, nil
+			}
+		}
+		if response.NextPage == 0 {
+			break
+		}
+		page = response.NextPage
+	}
+	return 0, fmt.Errorf("No team %s found in %s", teamSlug, orgLogin)
+}
+
+func getOrgRepos(githubClient *github.Client, orgLogin string) ([]*Repo, error) {
+	clientOrgRepos := make([]github.Repository, 0)
+	page := 1
+	for {
+		pageClientOrgRepos, response, err := githubClient.Repositories.ListByOrg(
+			orgLogin,
+			&github.RepositoryListByOrgOptions{
+				Type: "all",
+				ListOptions: github.ListOptions{
+					Page:    page,
+					PerPage: 100,
+				},
+			})
+		if err != nil {
+			return nil, err
+		}
+		clientOrgRepos = append(clientOrgRepos, pageClientOrgRepos...)
+		if response.NextPage == 0 {
+			break
+		}
+		page = response.NextPage
+	}
+	provider := newGitHubProvider(githubClient, nil)
+	repos := make([]*Repo, len(clientOrgRepos))
+	for i := range clientOrgRepos {
+		repos[i] = &Repo{
+			Repository:      &clientOrgRepos[i],
+			Vintage:         clientOrgRepos[i].CreatedAt.UTC(),
+			IncludeInDigest: true,
+			providers:       []Provider{provider},
+		}
+	}
+	return repos, nil
+}
+
+func (digest *TeamDigest) fetch(githubClient *github.Client, members []github.User) {
+	membersByLogin := make(map[string]*github.User)
+	for i := range members {
+		membersByLogin[*members[i].Login] = &members[i]
+	}
+	type RepoCommitsResponse struct {
+		intervalDigest *TeamIntervalDigest
+		repo           *Repo
+		commits        []github.RepositoryCommit
+		err            error
+	}
+	pool := newGitHubWorkerPool(githubConfig.FetchParallelism)
+	fetchCount := 0
+	ch := make(chan *RepoCommitsResponse)
+	for _, intervalDigest := range digest.IntervalDigests {
+		for _, repo := range intervalDigest.repos {
+			intervalDigest, repo := intervalDigest, repo
+			pool.Go(func() {
+				commits, err := listIntervalCommits(githubClient, pool, repo,
+					intervalDigest.StartTime, intervalDigest.EndTime)
+				ch <- &RepoCommitsResponse{intervalDigest, repo, commits, err}
+			})
+			fetchCount++
+		}
+	}
+	memberDigestsByInterval := make(map[*TeamIntervalDigest]map[string]*MemberDigest)
+	activeMemberLogins := make(map[string]bool)
+	for i := 0; i < fetchCount; i++ {
+		select {
+		case r := <-ch:
+			if r.err != nil {
+				digest.RepoErrors[*r.repo.FullName] = r.err
+				continue
+			}
+			memberDigests, ok := memberDigestsByInterval[r.intervalDigest]
+			if !ok {
+				memberDigests = make(map[string]*MemberDigest)
+				memberDigestsByInterval[r.intervalDigest] = memberDigests
+			}
+			repoDigests := make(map[string]*RepoDigest)
+			// Commits are returned newest first, but are displayed in
+			// chronological order.
+			for j := len(r.commits) - 1; j >= 0; j-- {
+				commit := &r.commits[j]
+				// Commits by people that aren't members (or whose email
+				// addresses aren't associated with a GitHub account) are
+				// skipped.
+				if commit.Author == nil || commit.Author.Login == nil {
+					continue
+				}
+				login := *commit.Author.Login
+				member, ok := membersByLogin[login]
+				if !ok {
+					continue
+				}
+				memberDigest, ok := memberDigests[login]
+				if !ok {
+					memberDigest = &MemberDigest{User: member}
+					memberDigests[login] = memberDigest
+					r.intervalDigest.MemberDigests = append(r.intervalDigest.MemberDigests, memberDigest)
+				}
+				repoDigest, ok := repoDigests[login]
+				if !ok {
+					repoDigest = &RepoDigest{r.repo, make([]DigestCommit, 0)}
+					repoDigests[login] = repoDigest
+					memberDigest.RepoDigests = append(memberDigest.RepoDigests, repoDigest)
+				}
+				repoDigest.Commits = append(repoDigest.Commits, newDigestCommit(commit, r.repo, digest.TimezoneLocation))
+				memberDigest.CommitCount++
+				digest.CommitCount++
+				activeMemberLogins[login] = true
+			}
+		}
+	}
+	digest.MemberCount = len(activeMemberLogins)
+	nonEmptyIntervalDigests := make([]*TeamIntervalDigest, 0, len(digest.IntervalDigests))
+	for _, intervalDigest := range digest.IntervalDigests {
+		if !intervalDigest.Empty() {
+			nonEmptyIntervalDigests = append(nonEmptyIntervalDigests, intervalDigest)
+			sort.Sort(ByMemberLogin(intervalDigest.MemberDigests))
+			for _, memberDigest := range intervalDigest.MemberDigests {
+				sort.Sort(ByRepoFullName(memberDigest.RepoDigests))
+			}
+		}
+	}
+	digest.IntervalDigests = nonEmptyIntervalDigests
+}
+
+func (digest *TeamDigest) Empty() bool {
+	return len(digest.IntervalDigests) == 0
+}
@@ -0,0 +1,244 @@
+package retrogit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/go-github/github"
+)
+
+func teamDigestsHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	c := newContext(r)
+	subscriptions, err := getTeamSubscriptionsForOwner(c, state.Account.GitHubUserId)
+	if err != nil {
+		return InternalError(err, "Could not look up team digests")
+	}
+
+	orgs, _, err := state.GitHubClient.Organizations.List(
+		"",
+		&github.ListOptions{
+			// Don't bother with pagination for the organization list, the user
+			// is unlikely to have that many.
+			PerPage: 100,
+		})
+	if err != nil {
+		return GitHubFetchError(err, "organizations")
+	}
+
+	var data = map[string]interface{}{
+		"Account":       state.Account,
+		"Subscriptions": subscriptions,
+		"Orgs":          orgs,
+		"Timezones":     timezones,
+		"DeliveryHours": deliveryHourOptions(),
+		"MonthlyDays":   monthlyDayOptions(),
+	}
+	return templates["team-digests"].Render(w, data, state)
+}
+
+func createTeamDigestHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	c := newContext(r)
+	schedule, appErr := parseScheduleForm(r)
+	if appErr != nil {
+		return appErr
+	}
+	recipients, err := parseRecipients(r.FormValue("recipients"))
+	if err != nil {
+		return BadRequest(err, "Malformed recipients value")
+	}
+	subscription := &TeamSubscription{
+		OwnerGitHubUserId: state.Account.GitHubUserId,
+		OrgLogin:          r.FormValue("org_login"),
+		TeamSlug:          strings.TrimSpace(r.FormValue("team_slug")),
+		Recipients:        recipients,
+		TimezoneName:      schedule.Location.String(),
+		TimezoneLocation:  schedule.Location,
+		Frequency:         schedule.Frequency,
+		WeeklyDay:         schedule.WeeklyDay,
+		MonthlyDay:        schedule.MonthlyDay,
+		DeliveryHour:      schedule.DeliveryHour,
+	}
+	if subscription.OrgLogin == "" {
+		return BadRequest(errors.New("Missing org_login"), "Missing org_login value")
+	}
+
+	// Make sure that the organization (and team) can be seen by the user, so
+	// that the digest can be fetched later.
+	_, err = getTeamMembers(state.GitHubClient, subscription.OrgLogin, subscription.TeamSlug)
+	if err != nil {
+		return BadRequest(err, fmt.Sprintf("Could not look up members of %s", subscription.Name()))
+	}
+
+	err = subscription.Put(c)
+	if err != nil {
+		return InternalError(err, "Could not save team digest")
+	}
+
+	state.AddFlash(fmt.Sprintf("Team digest for %s created.", subscription.Name()))
+	return RedirectToRoute("team-digests")
+}
+
+// parseRecipients splits a comma or whitespace-separated list of email
+// addresses.
+func parseRecipients(value string) ([]string, error) {
+	recipients := make([]string, 0)
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, field := range fields {
+		address, err := mail.ParseAddress(field)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, address.Address)
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("No recipients")
+	}
+	return recipients, nil
+}
+
+// getOwnedTeamSubscription looks up the subscription identified by the id
+// parameter, making sure that it belongs to the signed in user.
+func getOwnedTeamSubscription(r *http.Request, state *AppSignedInState) (*TeamSubscription, *AppError) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return nil, BadRequest(err, "Malformed id value")
+	}
+	c := newContext(r)
+	subscription, err := getTeamSubscription(c, id)
+	if err == ErrTeamSubscriptionNotFound ||
+		(err == nil && subscription.OwnerGitHubUserId != state.Account.GitHubUserId) {
+		return nil, BadRequest(ErrTeamSubscriptionNotFound, "id does not point to a team digest")
+	}
+	if err != nil {
+		return nil, InternalError(err, "Could not look up team digest")
+	}
+	return subscription, nil
+}
+
+func viewTeamDigestHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	subscription, appErr := getOwnedTeamSubscription(r, state)
+	if appErr != nil {
+		return appErr
+	}
+	c := newContext(r)
+	digest, err := newTeamDigest(c, state.GitHubClient, subscription)
+	if err != nil {
+		return GitHubFetchError(err, "team digest")
+	}
+	var data = map[string]interface{}{
+		"Digest": digest,
+	}
+	return templates["team-digest-page"].Render(w, data, state)
+}
+
+func sendTeamDigestHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	subscription, appErr := getOwnedTeamSubscription(r, state)
+	if appErr != nil {
+		return appErr
+	}
+	c := newContext(r)
+	sent, err := sendTeamDigest(c, subscription, state.Account)
+	if err != nil {
+		return InternalError(err, "Could not send team digest")
+	}
+
+	if sent {
+		state.AddFlash(fmt.Sprintf("Team digest for %s emailed!", subscription.Name()))
+	} else {
+		state.AddFlash(fmt.Sprintf("No team digest for %s was sent, it was empty.", subscription.Name()))
+	}
+	return RedirectToRoute("team-digests")
+}
+
+func deleteTeamDigestHandler(w http.ResponseWriter, r *http.Request, state *AppSignedInState) *AppError {
+	subscription, appErr := getOwnedTeamSubscription(r, state)
+	if appErr != nil {
+		return appErr
+	}
+	c := newContext(r)
+	err := subscription.Delete(c)
+	if err != nil {
+		return InternalError(err, "Could not delete team digest")
+	}
+	state.AddFlash(fmt.Sprintf("Team digest for %s deleted.", subscription.Name()))
+	return RedirectToRoute("team-digests")
+}
+
+var sendTeamDigestFunc = newDelayedFunc(
+	"sendTeamDigest",
+	func(c Context, id int64) error {
+		c.Infof("Sending team digest %d...", id)
+		subscription, err := getTeamSubscription(c, id)
+		if err == ErrTeamSubscriptionNotFound {
+			c.Infof("  Team digest was deleted")
+			return nil
+		}
+		if err != nil {
+			c.Errorf("  Error looking up team digest: %s", err.Error())
+			return err
+		}
+		account, err := getAccount(c, subscription.OwnerGitHubUserId)
+		if err != nil {
+			c.Errorf("  Error looking up owner account: %s", err.Error())
+			return err
+		}
+		sent, err := sendTeamDigest(c, subscription, account)
+		if err != nil {
+			c.Errorf("  Error: %s", err.Error())
+			if !isDevelopment() {
+				sendDigestErrorMail(err, c, subscription.OwnerGitHubUserId)
+			}
+		} else if sent {
+			c.Infof("  Sent!")
+		} else {
+			c.Infof("  Not sent, digest was empty")
+		}
+		return err
+	})
+
+// sendTeamDigest fetches the team digest with the OAuth token of the owner
+// account, and mails it to the subscription's recipients. Unlike personal
+// digests, team digests are not archived (see archiveDigest).
+func sendTeamDigest(c Context, subscription *TeamSubscription, owner *Account) (bool, error) {
+	oauthTransport := githubOAuthTransport(c)
+	oauthTransport.Token = &owner.OAuthToken
+	githubClient := newGitHubClient(oauthTransport.Client())
+
+	digest, err := newTeamDigest(c, githubClient, subscription)
+	if err != nil {
+		return false, err
+	}
+	if digest.Empty() {
+		return false, nil
+	}
+
+	var data = map[string]interface{}{
+		"Digest": digest,
+	}
+	var digestText bytes.Buffer
+	if err := textTemplates["team-digest-email"].Execute(&digestText, data); err != nil {
+		return false, err
+	}
+	var digestHtml bytes.Buffer
+	if err := templates["team-digest-email"].Execute(&digestHtml, data); err != nil {
+		return false, err
+	}
+
+	digestMessage := &MailMessage{
+		Sender:   mailConfig.DigestSender,
+		To:       subscription.Recipients,
+		Subject:  fmt.Sprintf("RetroGit Digest for %s", subscription.Name()),
+		Body:     digestText.String(),
+		HTMLBody: digestHtml.String(),
+	}
+	err = mailer.Send(c, digestMessage)
+	return true, err
+}
@@ -0,0 +1,209 @@
+package retrogit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	WebhookSignatureHeader = "X-RetroGit-Signature-256"
+	WebhookDeliveryHeader  = "X-RetroGit-Delivery"
+	WebhookEventHeader     = "X-RetroGit-Event"
+	// Including the first one.
+	MaxWebhookDeliveryAttempts = 5
+	// Doubled after each failed attempt.
+	InitialWebhookRetryDelay = time.Minute
+	// How many delivery attempts are kept per user.
+	WebhookDeliveryLogSize = 50
+)
+
+// WebhookChannel posts digests as JSON (see DigestJSON) to a URL of the
+// user's choosing. Requests are signed with an HMAC-SHA256 of the body, keyed
+// with the account's webhook secret. Failed deliveries are retried with
+// exponential backoff, and all attempts are logged.
+type WebhookChannel struct {
+	GitHubUserId int
+	URL          string
+	Secret       string
+}
+
+// WebhookDelivery is the log entry for a webhook delivery attempt. Retries of
+// the same delivery share its Id.
+type WebhookDelivery struct {
+	Id           string `datastore:",noindex"`
+	GitHubUserId int
+	Time         time.Time
+	Attempt      int    `datastore:",noindex"`
+	URL          string `datastore:",noindex"`
+	// 0 if no response was received.
+	StatusCode int           `datastore:",noindex"`
+	Error      string        `datastore:",noindex"`
+	Duration   time.Duration `datastore:",noindex"`
+}
+
+func (delivery *WebhookDelivery) Succeeded() bool {
+	return delivery.Error == ""
+}
+
+func (delivery *WebhookDelivery) DisplayTime() string {
+	return delivery.Time.Format(CommitDisplayDateFullFormat)
+}
+
+func (delivery *WebhookDelivery) DisplayDuration() string {
+	return delivery.Duration.String()
+}
+
+func (channel *WebhookChannel) Name() string {
+	return "webhook"
+}
+
+func (channel *WebhookChannel) Deliver(c Context, digest *Digest) error {
+	payload, err := json.Marshal(newDigestJSON(digest))
+	if err != nil {
+		return err
+	}
+	deliveryId, err := newWebhookDeliveryId()
+	if err != nil {
+		return err
+	}
+	return deliverWebhook(c, channel, deliveryId, payload, 1)
+}
+
+// deliverWebhook makes a delivery attempt, and schedules a retry if it fails.
+// The payload is stored while the delivery is being retried, since tasks are
+// too small for it. Errors are only returned if the retry couldn't be
+// scheduled, since returning them would cause the whole digest to be sent
+// again.
+func deliverWebhook(c Context, channel *WebhookChannel, deliveryId string, payload []byte, attempt int) error {
+	delivery := channel.post(c, deliveryId, payload, attempt)
+	err := storage.PutWebhookDelivery(c, delivery)
+	if err != nil {
+		c.Errorf("Could not log webhook delivery %s: %s", deliveryId, err.Error())
+	}
+	if delivery.Succeeded() || attempt >= MaxWebhookDeliveryAttempts {
+		if !delivery.Succeeded() {
+			c.Errorf("Giving up on webhook delivery %s: %s", deliveryId, delivery.Error)
+		}
+		if attempt > 1 {
+			deleteWebhookPayload(c, channel.GitHubUserId, deliveryId)
+		}
+		return nil
+	}
+	c.Warningf("Webhook delivery %s attempt %d failed: %s", deliveryId, attempt, delivery.Error)
+	if attempt == 1 {
+		err = storage.PutWebhookPayload(c, channel.GitHubUserId, deliveryId, payload)
+		if err != nil {
+			return err
+		}
+	}
+	retryDelay := InitialWebhookRetryDelay * time.Duration(1<<uint(attempt-1))
+	return retryWebhookDeliveryFunc.CallLater(c, retryDelay, channel.GitHubUserId, deliveryId, attempt+1)
+}
+
+var retryWebhookDeliveryFunc *delayedFunc
+
+func retryWebhookDelivery(c Context, githubUserId int, deliveryId string, attempt int) error {
+	account, err := getAccount(c, githubUserId)
+	if err != nil {
+		c.Errorf("Could not load account %d: %s. Presumed deleted, aborting webhook delivery %s", githubUserId, err.Error(), deliveryId)
+		return nil
+	}
+	// The current URL and secret are used, in case the user fixed them in the
+	// meantime.
+	channel := account.webhookChannel()
+	if channel == nil {
+		c.Infof("Webhook was removed, aborting webhook delivery %s", deliveryId)
+		deleteWebhookPayload(c, githubUserId, deliveryId)
+		return nil
+	}
+	payload, err := storage.GetWebhookPayload(c, githubUserId, deliveryId)
+	if err == ErrWebhookPayloadNotFound {
+		c.Errorf("Payload of webhook delivery %s is gone, aborting it", deliveryId)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return deliverWebhook(c, channel, deliveryId, payload, attempt)
+}
+
+func deleteWebhookPayload(c Context, githubUserId int, deliveryId string) {
+	err := storage.DeleteWebhookPayload(c, githubUserId, deliveryId)
+	if err != nil {
+		c.Errorf("Could not delete payload of webhook delivery %s: %s", deliveryId, err.Error())
+	}
+}
+
+func init() {
+	retryWebhookDeliveryFunc = newDelayedFunc("retryWebhookDelivery", retryWebhookDelivery)
+}
+
+func (channel *WebhookChannel) post(c Context, deliveryId string, payload []byte, attempt int) *WebhookDelivery {
+	delivery := &WebhookDelivery{
+		Id:           deliveryId,
+		GitHubUserId: channel.GitHubUserId,
+		Time:         time.Now(),
+		Attempt:      attempt,
+		URL:          channel.URL,
+	}
+	request, err := http.NewRequest("POST", channel.URL, bytes.NewReader(payload))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "RetroGit-Webhook")
+	request.Header.Set(WebhookEventHeader, "digest")
+	request.Header.Set(WebhookDeliveryHeader, deliveryId)
+	request.Header.Set(WebhookSignatureHeader, signWebhookPayload(channel.Secret, payload))
+
+	httpClient := &http.Client{Transport: newWebhookTransport(c)}
+	response, err := httpClient.Do(request)
+	delivery.Duration = time.Since(delivery.Time)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	defer response.Body.Close()
+	delivery.StatusCode = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		responseBytes, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxWebhookResponseBytes))
+		delivery.Error = fmt.Sprintf("Webhook returned %s: %s", response.Status, bytes.TrimSpace(responseBytes))
+	}
+	return delivery
+}
+
+// signWebhookPayload returns the signature header value for payload, in the
+// same format as GitHub's webhooks, so that existing verification code can be
+// reused.
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	return randomHex(20)
+}
+
+func newWebhookDeliveryId() (string, error) {
+	return randomHex(16)
+}
+
+func randomHex(byteCount int) (string, error) {
+	randomBytes := make([]byte, byteCount)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
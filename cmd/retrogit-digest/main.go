@@ -0,0 +1,78 @@
+// Command retrogit-digest prints the digest for a GitHub personal access token
+// and/or local repositories to stdout, for previewing and debugging digests
+// without a server, or for generating them offline.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mihaip/retrogit/app"
+)
+
+func main() {
+	appDir := flag.String("app_dir", "app", "Directory with the config and templates directories")
+	token := flag.String("token", "", "GitHub personal access token, defaults to the GITHUB_TOKEN environment variable")
+	timezone := flag.String("timezone", "", "Timezone name, e.g. America/New_York (defaults to America/Los_Angeles)")
+	frequency := flag.String("frequency", "daily", "Digest frequency: daily, weekly or monthly")
+	date := flag.String("date", "", "Date of the digest, e.g. 2015-03-04 (defaults to today)")
+	format := flag.String("format", "html", "Output format: html, text or json")
+	excludedRepoIds := flag.String("exclude_repo_ids", "", "Comma-separated IDs of repositories to leave out")
+	includePullRequests := flag.Bool("include_pull_requests", false, "Include pull requests")
+	includeIssues := flag.Bool("include_issues", false, "Include issues")
+	includeReviews := flag.Bool("include_reviews", false, "Include reviews")
+	localRepos := flag.String("local_repos", "", "Comma-separated path globs of local git repositories to include, e.g. /srv/git/*.git")
+	authorEmails := flag.String("author_emails", "", "Comma-separated author emails of your commits in local repositories")
+	flag.Parse()
+
+	options := retrogit.DigestOptions{
+		Token:               *token,
+		TimezoneName:        *timezone,
+		Frequency:           *frequency,
+		Date:                *date,
+		Format:              *format,
+		IncludePullRequests: *includePullRequests,
+		IncludeIssues:       *includeIssues,
+		IncludeReviews:      *includeReviews,
+	}
+	if options.Token == "" {
+		options.Token = os.Getenv("GITHUB_TOKEN")
+	}
+	if *localRepos != "" {
+		options.LocalRepositoryGlobs = splitList(*localRepos)
+	}
+	if *authorEmails != "" {
+		options.AuthorEmails = splitList(*authorEmails)
+	}
+	if *excludedRepoIds != "" {
+		for _, repoIdString := range strings.Split(*excludedRepoIds, ",") {
+			repoId, err := strconv.Atoi(strings.TrimSpace(repoIdString))
+			if err != nil {
+				log.Fatalf("Malformed repository ID %s", repoIdString)
+			}
+			options.ExcludedRepoIds = append(options.ExcludedRepoIds, repoId)
+		}
+	}
+
+	err := os.Chdir(*appDir)
+	if err != nil {
+		log.Fatalf("Could not change to app directory %s: %s", *appDir, err.Error())
+	}
+	err = retrogit.WriteDigest(os.Stdout, options)
+	if err != nil {
+		log.Fatalf("Could not generate digest: %s", err.Error())
+	}
+}
+
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,23 @@
+// Command retrogit runs RetroGit as a standalone HTTP server, for hosting it
+// outside of App Engine.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/mihaip/retrogit/app"
+)
+
+func main() {
+	appDir := flag.String("app_dir", "app", "Directory with the config, templates and static directories")
+	address := flag.String("address", "", "Address to listen on, overrides the one in config/server.json")
+	flag.Parse()
+
+	err := os.Chdir(*appDir)
+	if err != nil {
+		log.Fatalf("Could not change to app directory %s: %s", *appDir, err.Error())
+	}
+	log.Fatal(retrogit.ListenAndServe(*address))
+}